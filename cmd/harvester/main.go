@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wvh/urn-harvester/internal/version"
+	"github.com/wvh/urn-harvester/pkg/archive"
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/psql"
+
+	log "github.com/go-kit/kit/log"
+)
+
+const (
+	// name of this application, also used as user-agent
+	appName = "urn-harvester"
+)
+
+// userAgentTransport sets the User-Agent header on outgoing requests.
+type userAgentTransport struct {
+	agent string
+	next  http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.agent)
+	return t.next.RoundTrip(r)
+}
+
+func run(args []string) error {
+	var (
+		flags = flag.NewFlagSet(args[0], flag.ExitOnError)
+
+		timeout     = flags.Duration("timeout", 5*time.Minute, "timeout for a single HTTP request")
+		delay       = flags.Duration("delay", time.Second, "minimum delay between consecutive requests to a host")
+		retryLimit  = flags.Duration("retry-limit", 10*time.Minute, "total time a source may spend waiting to retry failed requests, 0 to disable retries")
+		all         = flags.Bool("all", false, "harvest all sources")
+		workers     = flags.Int("workers", 4, "number of sources to harvest at the same time")
+		rejects     = flags.String("rejects", "", "write records with invalid URNs to this file as JSON (- for stdout, logging to stderr)")
+		full        = flags.Bool("full", false, "harvest all records, not only those changed since the last successful run")
+		dryRun      = flags.String("dry-run", "", "write nothing, save a JSON report of the changes to this file instead (- for stdout, logging to stderr)")
+		archiveDir  = flags.String("archive", os.Getenv("HARVEST_ARCHIVE"), "save raw responses in this directory, env: HARVEST_ARCHIVE")
+		retention   = flags.Duration("archive-retention", 90*24*time.Hour, "delete archived responses older than this before harvesting, 0 to keep them")
+		replay      = flags.Bool("replay", false, "read responses from the archive instead of the network, with -dry-run")
+		replayAt    = flags.String("replay-before", "", "with -replay, use the last responses archived before this RFC 3339 time")
+		showVersion = flags.Bool("version", false, "show harvester version")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] <source title>...\n       %s [flags] -all\n", args[0], args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *showVersion {
+		fmt.Fprintf(os.Stderr, "%s %s\n", appName, version.Version)
+		return nil
+	}
+
+	switch {
+	case *all && flags.NArg() > 0:
+		flags.Usage()
+		return fmt.Errorf("-all doesn't take source titles")
+	case !*all && flags.NArg() == 0:
+		flags.Usage()
+		return fmt.Errorf("expected source titles or -all")
+	case (*all || flags.NArg() > 1) && (*dryRun != "" || *rejects != ""):
+		return fmt.Errorf("-dry-run and -rejects work with one source only")
+	}
+
+	switch {
+	case *replay && *archiveDir == "":
+		return fmt.Errorf("-replay needs -archive")
+	case *replay && *dryRun == "":
+		// archived responses are old: writing them would undo newer changes and move the source's last run forward
+		return fmt.Errorf("-replay needs -dry-run")
+	}
+	var before time.Time
+	if *replayAt != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, *replayAt); err != nil {
+			return fmt.Errorf("invalid -replay-before time: %w", err)
+		}
+	}
+
+	// keep the log out of JSON written to stdout, so it can be piped
+	logOut := os.Stdout
+	if *dryRun == "-" || *rejects == "-" {
+		logOut = os.Stderr
+	}
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(logOut))
+	logger = log.With(logger, "service", appName, "time", log.DefaultTimestampUTC)
+
+	ctx := context.Background()
+
+	// a run holds a connection for its transaction and needs another one now and then for its checkpoints
+	db, err := psql.NewPool(ctx, psql.MinConns(int32(2**workers)))
+	if err != nil {
+		return fmt.Errorf("can't connect to database: %w", err)
+	}
+	defer db.Close()
+
+	sources, err := loadSources(ctx, db, *all, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &userAgentTransport{
+			agent: appName + "/" + version.Version,
+			next:  http.DefaultTransport,
+		},
+	}
+
+	opts := []func(*harvest.Harvester){harvest.WithDelay(*delay), harvest.WithRetryLimit(*retryLimit)}
+	if *archiveDir != "" {
+		a, err := archive.New(*archiveDir)
+		if err != nil {
+			return fmt.Errorf("can't open archive: %w", err)
+		}
+		if *replay {
+			// no need to be polite to the disk
+			client.Transport = archive.NewReplay(a, before)
+			opts = append(opts, harvest.WithDelay(0), harvest.WithRetryLimit(0))
+		} else {
+			if *retention > 0 {
+				pages, blobs, err := a.Prune(time.Now().Add(-*retention))
+				if err != nil {
+					return fmt.Errorf("can't prune archive: %w", err)
+				}
+				logger.Log("msg", "archive pruned", "pages", pages, "bodies", blobs)
+			}
+			opts = append(opts, harvest.WithArchive(a))
+		}
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		opts = append(opts, harvest.WithNotifier(mailNotifier(addr)))
+	}
+
+	hv := harvest.New(client, logger, opts...)
+	if len(sources) > 1 {
+		return runAll(ctx, hv, db, sources, *workers, *full)
+	}
+
+	src := sources[0]
+	if *dryRun != "" {
+		rep, err := hv.DryRun(ctx, harvest.NewStore(db), src, *full)
+		if err != nil {
+			return err
+		}
+		return writeJSON(*dryRun, rep)
+	}
+
+	res, err := hv.Run(ctx, db, src, *full)
+	if res != nil && *rejects != "" {
+		if werr := writeRejects(*rejects, res.Rejected); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// loadSources loads the sources with the given titles, or all sources.
+func loadSources(ctx context.Context, db harvest.Querier, all bool, titles []string) ([]*harvest.Source, error) {
+	if all {
+		sources, err := harvest.LoadSources(ctx, db)
+		if err == nil && len(sources) == 0 {
+			err = fmt.Errorf("no sources")
+		}
+		return sources, err
+	}
+
+	var sources []*harvest.Source
+	for _, title := range titles {
+		src, err := harvest.LoadSource(ctx, db, title)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// runAll harvests several sources concurrently and reports the sources that failed.
+func runAll(ctx context.Context, hv *harvest.Harvester, db harvest.TxBeginner, sources []*harvest.Source, workers int, full bool) error {
+	var failed []string
+	for _, res := range hv.RunAll(ctx, db, sources, workers, full) {
+		if res.Err != nil {
+			failed = append(failed, res.Source.Title)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d sources failed: %s", len(failed), len(sources), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// mailNotifier creates a notifier for the SMTP server at addr, configured by the SMTP_FROM, SMTP_USER and
+// SMTP_PASSWORD environment variables.
+func mailNotifier(addr string) *harvest.MailNotifier {
+	n := &harvest.MailNotifier{
+		Addr: addr,
+		From: os.Getenv("SMTP_FROM"),
+	}
+	if n.From == "" {
+		n.From = appName + "@localhost"
+	}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		n.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return n
+}
+
+// writeRejects writes the rejection report of a harvest to a file.
+func writeRejects(path string, rejected []harvest.Rejection) error {
+	if rejected == nil {
+		rejected = []harvest.Rejection{}
+	}
+	return writeJSON(path, rejected)
+}
+
+// writeJSON writes a value as indented JSON to a file, or to stdout if path is "-".
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("can't write report: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	if err := run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", appName, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// repository is what an OAI-PMH repository says about itself.
+type repository struct {
+	BaseURL  string
+	Identity *oaipmh.Identity
+	Formats  []oaipmh.MetadataFormat
+	Sets     []oaipmh.Set
+	// error listing sets, which doesn't stop discovery
+	SetsErr error
+}
+
+// discover asks the repository at baseURL to identify itself and list its metadata formats and sets.
+func discover(ctx context.Context, c *oaipmh.Client, baseURL string) (*repository, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL: %q", baseURL)
+	}
+	if u.RawQuery != "" {
+		return nil, fmt.Errorf("base URL %q has a query, expected the URL without verb and arguments", baseURL)
+	}
+
+	repo := &repository{BaseURL: baseURL}
+	if repo.Identity, err = c.Identify(ctx, baseURL); err != nil {
+		return nil, fmt.Errorf("Identify: %w", err)
+	}
+	if repo.Formats, err = c.ListMetadataFormats(ctx, baseURL); err != nil {
+		return nil, fmt.Errorf("ListMetadataFormats: %w", err)
+	}
+	repo.Sets, repo.SetsErr = c.ListSets(ctx, baseURL)
+	return repo, nil
+}
+
+// describe writes a report of the repository.
+func (r *repository) describe(w io.Writer) {
+	id := r.Identity
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "repository:\t%s\n", id.RepositoryName)
+	fmt.Fprintf(tw, "base URL:\t%s\n", r.BaseURL)
+	if id.BaseURL != "" && id.BaseURL != r.BaseURL {
+		fmt.Fprintf(tw, "declared base URL:\t%s\n", id.BaseURL)
+	}
+	fmt.Fprintf(tw, "protocol version:\t%s\n", id.ProtocolVersion)
+	fmt.Fprintf(tw, "admin email:\t%s\n", strings.Join(id.AdminEmails, ", "))
+	fmt.Fprintf(tw, "earliest datestamp:\t%s\n", id.EarliestDatestamp)
+	fmt.Fprintf(tw, "granularity:\t%s\n", id.Granularity)
+	fmt.Fprintf(tw, "deleted records:\t%s\n", id.DeletedRecord)
+	tw.Flush()
+
+	for _, warning := range r.warnings() {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+
+	fmt.Fprintf(w, "\nmetadata formats:\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range r.Formats {
+		fmt.Fprintf(tw, "  %s\t%s\n", f.Prefix, f.Namespace)
+	}
+	tw.Flush()
+
+	switch {
+	case r.SetsErr != nil:
+		fmt.Fprintf(w, "\nsets: can't list: %v\n", r.SetsErr)
+	case len(r.Sets) == 0:
+		fmt.Fprintf(w, "\nsets: none\n")
+	default:
+		fmt.Fprintf(w, "\nsets:\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, s := range r.Sets {
+			fmt.Fprintf(tw, "  %s\t%s\n", s.Spec, s.Name)
+		}
+		tw.Flush()
+	}
+	fmt.Fprintln(w)
+}
+
+// warnings returns the repository's properties that affect harvesting.
+func (r *repository) warnings() []string {
+	var warnings []string
+	id := r.Identity
+	if id.ProtocolVersion != "2.0" {
+		warnings = append(warnings, fmt.Sprintf("protocol version %q, the harvester expects 2.0", id.ProtocolVersion))
+	}
+	switch id.DeletedRecord {
+	case oaipmh.DeletedNo:
+		warnings = append(warnings, "deleted records are not reported; mappings are only withdrawn after going missing from full harvests")
+	case oaipmh.DeletedTransient:
+		warnings = append(warnings, "deleted records are reported only for a while; run full harvests now and then")
+	}
+	return warnings
+}
+
+// sourceOptions are the settings of a source that can't be discovered, and choices between what was.
+type sourceOptions struct {
+	Title    string
+	Prefix   string
+	Sets     []string
+	Priority int
+	URLType  harvest.URLType
+	Email    string
+}
+
+// source returns the configuration of a source that harvests the repository.
+func (r *repository) source(opts sourceOptions) (*harvest.Source, error) {
+	if !r.hasFormat(opts.Prefix) {
+		return nil, fmt.Errorf("repository doesn't offer metadata prefix %q", opts.Prefix)
+	}
+	if !harvest.SupportsMetadataPrefix(opts.Prefix) {
+		return nil, fmt.Errorf("harvester can't read metadata prefix %q", opts.Prefix)
+	}
+	for _, set := range opts.Sets {
+		if !r.hasSet(set) {
+			if r.SetsErr != nil {
+				return nil, fmt.Errorf("can't check set %q: %w", set, r.SetsErr)
+			}
+			return nil, fmt.Errorf("repository has no set %q", set)
+		}
+	}
+	switch opts.URLType {
+	case harvest.URLTypeNormal, harvest.URLTypeVapaakappale:
+	default:
+		return nil, fmt.Errorf("unknown URL type: %q", opts.URLType)
+	}
+
+	src := &harvest.Source{
+		Title:          opts.Title,
+		Format:         harvest.FormatOAIPMH,
+		StartURL:       oaipmh.RequestURL(r.BaseURL, "ListRecords", url.Values{"metadataPrefix": {opts.Prefix}}),
+		ResumeURL:      oaipmh.ResumeURL(r.BaseURL, "ListRecords"),
+		Priority:       opts.Priority,
+		Email:          opts.Email,
+		Description:    r.Identity.RepositoryName,
+		URLType:        opts.URLType,
+		Sets:           opts.Sets,
+		MetadataPrefix: opts.Prefix,
+	}
+	if src.Title == "" {
+		src.Title = r.Identity.RepositoryName
+	}
+	if src.Email == "" && len(r.Identity.AdminEmails) > 0 {
+		src.Email = r.Identity.AdminEmails[0]
+	}
+	if src.Title == "" {
+		return nil, errors.New("repository has no name, set a title")
+	}
+	return src, nil
+}
+
+func (r *repository) hasFormat(prefix string) bool {
+	for _, f := range r.Formats {
+		if f.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *repository) hasSet(spec string) bool {
+	for _, s := range r.Sets {
+		if s.Spec == spec {
+			return true
+		}
+	}
+	return false
+}
+
+// insertSQL returns an SQL statement that adds a source to the source table. Columns with a default are left to
+// the database.
+func insertSQL(src *harvest.Source) string {
+	return fmt.Sprintf(`INSERT INTO source (title, format, start_url, resume_url, priority, email, description, source_type, oai_sets, metadata_prefix)
+VALUES (%s, %s, %s, %s, %d, %s, %s, %s, %s, %s);
+`, quote(src.Title), quote(string(src.Format)), quote(src.StartURL), quote(src.ResumeURL), src.Priority,
+		quote(src.Email), quote(src.Description), quote(string(src.URLType)), quoteArray(src.Sets), quote(src.MetadataPrefix))
+}
+
+// quote returns s as an SQL string literal, or NULL if it is empty.
+func quote(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quoteArray returns ss as an SQL array of string literals, or NULL if it is empty.
+func quoteArray(ss []string) string {
+	if len(ss) == 0 {
+		return "NULL"
+	}
+	quoted := make([]string, len(ss))
+	for i, s := range ss {
+		quoted[i] = quote(s)
+	}
+	return "ARRAY[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/harvest/harvesttest"
+)
+
+func TestDiscover(t *testing.T) {
+	repo := &harvesttest.OAIPMH{
+		Name:              "Example's repository",
+		AdminEmail:        "admin@example.com",
+		EarliestDatestamp: time.Date(2005, 1, 1, 0, 0, 0, 0, time.UTC),
+		DeletedRecord:     "transient",
+		Sets: []harvesttest.Set{
+			{Spec: "com_1", Name: "Community 1"}, {Spec: "com_1:col_2", Name: "Collection 2"}, {Spec: "com_3", Name: "Community 3"},
+		},
+		Formats: []harvesttest.Format{
+			{Prefix: "marcxml", Namespace: "http://www.loc.gov/MARC21/slim"},
+			{Prefix: "ead", Namespace: "urn:isbn:1-931666-22-9"},
+		},
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"oaidiscover", "-set", "com_1:col_2", "-set", "com_3", "-prefix", "marcxml", srv.URL}, &stdout, &stderr); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	for _, want := range []string{
+		"repository:          Example's repository",
+		"earliest datestamp:  2005-01-01",
+		"granularity:         YYYY-MM-DD",
+		"warning: deleted records are reported only for a while",
+		"  marcxml  http://www.loc.gov/MARC21/slim",
+		"  com_1:col_2  Collection 2",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("%q not found in report:\n%s", want, stderr.String())
+		}
+	}
+
+	want := `INSERT INTO source (title, format, start_url, resume_url, priority, email, description, source_type, oai_sets, metadata_prefix)
+VALUES ('Example''s repository', 'OAI-PMH', '` + srv.URL + `?verb=ListRecords&metadataPrefix=marcxml', '` +
+		srv.URL + `?verb=ListRecords&resumptionToken=', 1, 'admin@example.com', 'Example''s repository', 'normal', ` +
+		`ARRAY['com_1:col_2', 'com_3'], 'marcxml');
+`
+	if stdout.String() != want {
+		t.Errorf("wrong SQL\nwant: %s\n got: %s", want, stdout.String())
+	}
+
+	for _, args := range [][]string{
+		{"oaidiscover", "-prefix", "mods", srv.URL},
+		{"oaidiscover", "-prefix", "ead", srv.URL},
+		{"oaidiscover", "-set", "com_9", srv.URL},
+		{"oaidiscover", "-url-type", "odd", srv.URL},
+		{"oaidiscover", srv.URL + "?verb=Identify"},
+	} {
+		stdout.Reset()
+		if err := run(args, &stdout, &stderr); err == nil || stdout.Len() != 0 {
+			t.Errorf("%q: expected error and no output, got: %v, %q", args, err, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wvh/urn-harvester/internal/version"
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+const (
+	// name of this application, also used as user-agent
+	appName = "oaidiscover"
+)
+
+const usage = `Usage: %s [flags] <OAI-PMH base URL>
+
+Describes an OAI-PMH repository on stderr and prints an SQL statement that adds
+it to the source table.
+
+Flags:
+`
+
+// setsFlag is a flag that can be given several times, collecting set specs.
+type setsFlag []string
+
+func (f *setsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *setsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// userAgentTransport sets the User-Agent header on outgoing requests.
+type userAgentTransport struct {
+	agent string
+	next  http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.agent)
+	return t.next.RoundTrip(r)
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	var (
+		flags = flag.NewFlagSet(args[0], flag.ExitOnError)
+
+		timeout     = flags.Duration("timeout", time.Minute, "timeout for a single HTTP request")
+		title       = flags.String("title", "", "source title, the repository name by default")
+		prefix      = flags.String("prefix", "oai_dc", "metadata prefix to harvest")
+		priority    = flags.Int("priority", 1, "source priority")
+		urlType     = flags.String("url-type", string(harvest.URLTypeNormal), "URL type of the source's mappings")
+		email       = flags.String("email", "", "contact address, the repository's admin email by default")
+		quiet       = flags.Bool("q", false, "don't describe the repository, only print the source")
+		showVersion = flags.Bool("version", false, "show version")
+		sets        setsFlag
+	)
+	flags.Var(&sets, "set", "harvest only this set; repeat to harvest several sets")
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), usage, args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *showVersion {
+		fmt.Fprintf(stderr, "%s %s\n", appName, version.Version)
+		return nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one base URL")
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &userAgentTransport{
+			agent: appName + "/" + version.Version,
+			next:  http.DefaultTransport,
+		},
+	}
+	repo, err := discover(context.Background(), oaipmh.NewClient(client, time.Second), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !*quiet {
+		repo.describe(stderr)
+	}
+
+	src, err := repo.source(sourceOptions{
+		Title:    *title,
+		Prefix:   *prefix,
+		Sets:     sets,
+		Priority: *priority,
+		URLType:  harvest.URLType(*urlType),
+		Email:    *email,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdout, insertSQL(src))
+	return err
+}
+
+func main() {
+	if err := run(os.Args, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", appName, err)
+		os.Exit(1)
+	}
+}
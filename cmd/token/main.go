@@ -1,18 +1,36 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 
 	"github.com/wvh/urn-harvester/pkg/token"
 )
 
+// main issues an API token for the user id given as its argument, with the hex encoded secret key in AUTH_SECRET
+// that the web server verifies tokens with.
 func main() {
-	fmt.Println("secmsg:", os.Args)
+	if len(os.Args) != 2 || os.Args[1] == "" {
+		fmt.Fprintln(os.Stderr, "usage: token <user id>")
+		os.Exit(2)
+	}
+
+	key, err := hex.DecodeString(os.Getenv("AUTH_SECRET"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid AUTH_SECRET:", err)
+		os.Exit(1)
+	}
+	svc, err := token.NewTokenService(key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid AUTH_SECRET:", err)
+		os.Exit(1)
+	}
 
-	svc, err := token.NewTokenService([]byte("12345678901234567890123456789012"))
+	tok, err := svc.Encode([]byte(os.Args[1]))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	_ = svc
+	fmt.Println(string(tok))
 }
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/wvh/urn-harvester/internal/version"
+	"github.com/wvh/urn-harvester/pkg/harvest"
 )
 
 const (
-	// token authentication scheme for Authorization header (rfc7235)
-	tokenAuthScheme = "Bearer"
+	// token authentication scheme for Authorization header (rfc7235), as expected by pkg/auth
+	tokenAuthScheme = "apiv1"
 )
 
 type API struct {
@@ -29,7 +34,10 @@ func NewAPIClient(app, srv, token string) (*API, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid API URL: %w", err)
 	}
-	fmt.Printf("%+v\n", url)
+	// resolve API paths below the given URL, not next to it
+	if !strings.HasSuffix(url.Path, "/") {
+		url.Path += "/"
+	}
 
 	client := &http.Client{
 		Transport: &http.Transport{
@@ -48,38 +56,93 @@ func NewAPIClient(app, srv, token string) (*API, error) {
 	}, nil
 }
 
-// request sets up a basic API request for a given URL path.
+// request sets up a basic API request for a given method and URL path.
 // The request will add hostname and authentication information from the API client.
-func (api *API) request(path string) *http.Request {
+func (api *API) request(method, path string) *http.Request {
 	url, err := api.baseURL.Parse(path)
 	if err != nil {
 		panic(err)
 	}
 
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := http.NewRequest(method, url.String(), nil)
 	if err != nil {
 		panic(err)
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Add("If-None-Match", `W/"wyzzy"`)
-	req.Header.Add("Authorization", api.authHeader)
+	if api.token != "" {
+		req.Header.Add("Authorization", api.authHeader)
+	}
 	req.Header.Add("User-Agent", api.userAgent)
 	return req
 }
 
 func (api *API) get(url string) (*http.Response, error) {
-	//resp, err := client.Do(req)
-	return api.httpClient.Do(api.request(url))
+	return api.httpClient.Do(api.request(http.MethodGet, url))
 }
 
+// do sends a request and decodes the JSON response into v. Responses other than 2xx are returned as errors,
+// with the error message sent by the server.
 func (api *API) do(req *http.Request, v interface{}) (*http.Response, error) {
 	resp, err := api.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	//	err = json.NewDecoder(resp.Body).Decode(v)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(b, &apiErr) != nil || apiErr.Error == "" {
+			return resp, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+		}
+		return resp, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, apiErr.Error)
+	}
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+	}
 	return resp, err
 }
 
 func (api *API) Version() {}
+
+// ChangeSets lists the change sets with a status, or all change sets if status is empty.
+func (api *API) ChangeSets(status string) ([]harvest.ChangeSetInfo, error) {
+	path := "changesets"
+	if status != "" {
+		path += "?status=" + url.QueryEscape(status)
+	}
+	var list []harvest.ChangeSetInfo
+	_, err := api.do(api.request(http.MethodGet, path), &list)
+	return list, err
+}
+
+// ChangeSet returns a change set with its changes.
+func (api *API) ChangeSet(id int64) (*harvest.StagedChangeSet, error) {
+	var cs harvest.StagedChangeSet
+	_, err := api.do(api.request(http.MethodGet, fmt.Sprintf("changesets/%d", id)), &cs)
+	return &cs, err
+}
+
+// Diff compares the changes of a change set with the current mappings.
+func (api *API) Diff(id int64) ([]harvest.Diff, error) {
+	var diffs []harvest.Diff
+	_, err := api.do(api.request(http.MethodGet, fmt.Sprintf("changesets/%d/diff", id)), &diffs)
+	return diffs, err
+}
+
+// Approve applies the changes of a change set.
+func (api *API) Approve(id int64) (*harvest.StagedChangeSet, error) {
+	var cs harvest.StagedChangeSet
+	_, err := api.do(api.request(http.MethodPost, fmt.Sprintf("changesets/%d/approve", id)), &cs)
+	return &cs, err
+}
+
+// Reject discards the changes of a change set.
+func (api *API) Reject(id int64) (*harvest.StagedChangeSet, error) {
+	var cs harvest.StagedChangeSet
+	_, err := api.do(api.request(http.MethodPost, fmt.Sprintf("changesets/%d/reject", id)), &cs)
+	return &cs, err
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +56,56 @@ func TestHeaders(t *testing.T) {
 
 	t.Logf("response: %s", body)
 }
+
+func TestChangeSetCommands(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/changesets":
+			if r.URL.Query().Get("status") != "pending" {
+				t.Errorf("wrong status: %q", r.URL.Query().Get("status"))
+			}
+			fmt.Fprint(w, `[{"id":7,"source":"Doria","status":"pending","count":2,"reason":"source requires review"}]`)
+		case "GET /api/changesets/7/diff":
+			fmt.Fprint(w, `[{"kind":"changed","urn":"URN:NBN:fi-fe3214","current_url":"http://a","proposed_url":"http://b"}]`)
+		case "POST /api/changesets/7/approve":
+			if r.Header.Get("Authorization") != tokenAuthScheme+" "+testToken {
+				t.Errorf("invalid Authorization header: %q", r.Header.Get("Authorization"))
+			}
+			fmt.Fprint(w, `{"id":7,"status":"approved","resolved_by":"jack"}`)
+		default:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":"change set already resolved"}`)
+		}
+	}))
+	defer srv.Close()
+
+	api, err := NewAPIClient(appName, srv.URL+"/api", testToken)
+	if err != nil {
+		t.Fatal("can't create API client:", err)
+	}
+
+	tests := []struct {
+		cmd  string
+		args []string
+		out  string
+	}{
+		{"changesets", []string{"pending"}, "Doria"},
+		{"diff", []string{"7"}, "http://b"},
+		{"approve", []string{"7"}, "change set 7 approved by jack\n"},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		if err := command(api, &b, test.cmd, test.args); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.cmd, err)
+			continue
+		}
+		if !strings.Contains(b.String(), test.out) {
+			t.Errorf("%s: output doesn't contain %q: %s", test.cmd, test.out, b.String())
+		}
+	}
+
+	err = command(api, ioutil.Discard, "reject", []string{"7"})
+	if err == nil || !strings.Contains(err.Error(), "already resolved") {
+		t.Errorf("want: server error, got: %v", err)
+	}
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/wvh/urn-harvester/internal/version"
+	"github.com/wvh/urn-harvester/pkg/harvest"
 )
 
 const (
@@ -20,6 +25,18 @@ const (
 	envAPIToken  = "URN_API_TOKEN"
 )
 
+const usage = `Usage: %s [flags] <command> [arguments]
+
+Commands:
+  changesets [status]   list change sets held for approval, or with the given status
+  changeset <id>        show the changes of a change set
+  diff <id>             compare the changes of a change set with the current mappings
+  approve <id>          apply the changes of a change set (needs a token)
+  reject <id>           discard the changes of a change set (needs a token)
+
+Flags:
+`
+
 func run(args []string) error {
 	var (
 		flags = flag.NewFlagSet(args[0], flag.ExitOnError)
@@ -30,6 +47,10 @@ func run(args []string) error {
 		apiToken    = flags.String("token", os.Getenv(envAPIToken), "API token, env: "+envAPIToken)
 		showVersion = flags.Bool("version", false, "show client version")
 	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), usage, args[0])
+		flags.PrintDefaults()
+	}
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
@@ -52,16 +73,114 @@ func run(args []string) error {
 		return fmt.Errorf("API token unset")
 	}
 
-	fmt.Fprintln(os.Stderr, appName, version.Version, "not doing anything!")
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no command")
+	}
 
-	api, err := NewAPIClient(appName, *apiServer, "abc123")
+	api, err := NewAPIClient(appName, *apiServer, *apiToken)
 	if err != nil {
 		return err
 	}
-	_ = api
+	return command(api, os.Stdout, flags.Arg(0), flags.Args()[1:])
+}
+
+// command runs a client command, writing its output to w.
+func command(api *API, w io.Writer, cmd string, args []string) error {
+	if cmd == "changesets" {
+		if len(args) > 1 {
+			return fmt.Errorf("%s: too many arguments", cmd)
+		}
+		var status string
+		if len(args) == 1 {
+			status = args[0]
+		}
+		list, err := api.ChangeSets(status)
+		if err != nil {
+			return err
+		}
+		printChangeSets(w, list)
+		return nil
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("%s: expected one change set id", cmd)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid change set id: %q", cmd, args[0])
+	}
+
+	switch cmd {
+	case "changeset":
+		cs, err := api.ChangeSet(id)
+		if err != nil {
+			return err
+		}
+		printChangeSet(w, cs)
+	case "diff":
+		diffs, err := api.Diff(id)
+		if err != nil {
+			return err
+		}
+		printDiffs(w, diffs)
+	case "approve", "reject":
+		if api.token == "" {
+			return fmt.Errorf("%s: API token unset", cmd)
+		}
+		resolve := api.Approve
+		if cmd == "reject" {
+			resolve = api.Reject
+		}
+		cs, err := resolve(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "change set %d %s by %s\n", cs.ID, cs.Status, cs.ResolvedBy)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
 	return nil
 }
 
+func printChangeSets(w io.Writer, list []harvest.ChangeSetInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSOURCE\tCREATED\tSTATUS\tCHANGES\tREASON")
+	for _, c := range list {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%s\n", c.ID, c.Source, c.Created.Format(time.RFC3339), c.Status, c.Count, c.Reason)
+	}
+	tw.Flush()
+}
+
+func printChangeSet(w io.Writer, cs *harvest.StagedChangeSet) {
+	fmt.Fprintf(w, "change set %d of %s, %s\n", cs.ID, cs.Source, cs.Status)
+	fmt.Fprintf(w, "created %s: %s\n", cs.Created.Format(time.RFC3339), cs.Reason)
+	if cs.Resolved != nil {
+		fmt.Fprintf(w, "resolved %s by %s\n", cs.Resolved.Format(time.RFC3339), cs.ResolvedBy)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tURN\tOLD URL\tURL")
+	for _, c := range cs.Changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Kind, c.URN, c.OldURL, c.URL)
+	}
+	tw.Flush()
+}
+
+func printDiffs(w io.Writer, diffs []harvest.Diff) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tURN\tCURRENT URL\tPROPOSED URL\t")
+	for _, d := range diffs {
+		stale := ""
+		if d.Stale {
+			stale = "stale"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Kind, d.URN, d.CurrentURL, d.ProposedURL, stale)
+	}
+	tw.Flush()
+}
+
 func main() {
 	if err := run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", appName, err)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -13,11 +14,18 @@ import (
 
 	"github.com/wvh/urn-harvester/internal/version"
 	"github.com/wvh/urn-harvester/pkg/api"
+	"github.com/wvh/urn-harvester/pkg/auth"
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/psql"
+	"github.com/wvh/urn-harvester/pkg/token"
 )
 
 const (
 	httpPort = "8080"
 	httpHost = "localhost"
+
+	// auth policy for the API if AUTH_POLICY is not set: reading is public, writing needs a token
+	defaultAuthPolicy = "writeonly"
 )
 
 var (
@@ -95,16 +103,38 @@ func run(args []string, env string) error {
 		"state", "starting",
 	)
 
-	api, err := api.New()
+	db, err := psql.NewPool(context.Background())
+	if err != nil {
+		return fmt.Errorf("%w: can't connect to database: %v", errStartup, err)
+	}
+	defer db.Close()
+
+	api, err := api.New(harvest.NewStore(db), harvest.NewReview(db))
 	if err != nil {
 		return fmt.Errorf("%w: %v", errStartup, err)
 	}
 
+	policy := os.Getenv("AUTH_POLICY")
+	if policy == "" {
+		policy = defaultAuthPolicy
+	}
+	tokens, maxAge, err := tokenService()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errStartup, err)
+	}
+	if tokens == nil {
+		logger.Log("warning", "AUTH_SECRET unset, API tokens are refused")
+	}
+	authHandler, err := auth.NewHandlerFromString(policy, auth.WithTokens(tokens, maxAge))
+	if err != nil {
+		return fmt.Errorf("%w: %v: %q", errStartup, err, policy)
+	}
+
 	router := http.NewServeMux()
 	router.HandleFunc("/", helloHandler)
 	router.HandleFunc("/version", handleVersion())
 	router.HandleFunc("/health", handleHealth())
-	router.Handle("/api", api)
+	router.Handle("/api/", http.StripPrefix("/api", authHandler(api)))
 
 	srv := http.Server{
 		Addr: ":" + httpPort,
@@ -123,6 +153,30 @@ func run(args []string, env string) error {
 	return nil
 }
 
+// tokenService sets up the verification of API tokens with the hex encoded secret key in AUTH_SECRET, returning
+// the maximum age of tokens in AUTH_TOKEN_MAX_AGE with it. The service is nil if there is no key.
+func tokenService() (*token.TokenService, time.Duration, error) {
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" {
+		return nil, 0, nil
+	}
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid AUTH_SECRET: %v", err)
+	}
+	svc, err := token.NewTokenService(key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid AUTH_SECRET: %v", err)
+	}
+	var maxAge time.Duration
+	if s := os.Getenv("AUTH_TOKEN_MAX_AGE"); s != "" {
+		if maxAge, err = time.ParseDuration(s); err != nil {
+			return nil, 0, fmt.Errorf("invalid AUTH_TOKEN_MAX_AGE: %v", err)
+		}
+	}
+	return svc, maxAge, nil
+}
+
 func main() {
 	fmt.Println("args:", os.Args)
 
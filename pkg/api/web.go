@@ -1,20 +1,263 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wvh/urn-harvester/pkg/auth"
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/urn"
 )
 
-type API struct{}
+// ChangeSets is the store of change sets held for approval. It is satisfied by *harvest.Review.
+type ChangeSets interface {
+	List(ctx context.Context, status harvest.ChangeSetStatus) ([]harvest.ChangeSetInfo, error)
+	Get(ctx context.Context, id int64) (*harvest.StagedChangeSet, error)
+	Diff(ctx context.Context, id int64) ([]harvest.Diff, error)
+	Approve(ctx context.Context, id int64, user string) error
+	Reject(ctx context.Context, id int64, user string) error
+}
+
+// Mappings looks up the mappings of a URN, by its normalised name. It is satisfied by harvest.Store.
+type Mappings interface {
+	Mappings(ctx context.Context, urn string) ([]harvest.Mapping, error)
+}
+
+// API serves the JSON API. Paths are relative to the API root:
+//
+//	GET  /resolve?urn={urn}            redirect to the URL of a URN
+//	GET  /changesets[?status=pending]  list change sets
+//	GET  /changesets/{id}              a change set with its changes
+//	GET  /changesets/{id}/diff         the changes compared with the current mappings
+//	POST /changesets/{id}/approve      apply the changes
+//	POST /changesets/{id}/reject       discard the changes
+//
+// Approving and rejecting require a user authenticated by the auth middleware.
+type API struct {
+	mappings   Mappings
+	changeSets ChangeSets
+}
 
-func New() (*API, error) {
-	return &API{}, nil
+func New(mappings Mappings, changeSets ChangeSets) (*API, error) {
+	if mappings == nil {
+		return nil, errors.New("no mapping store")
+	}
+	if changeSets == nil {
+		return nil, errors.New("no change set store")
+	}
+	return &API{mappings: mappings, changeSets: changeSets}, nil
 }
 
 func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	api.writeHeaders(w)
-	w.Write([]byte("API"))
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "resolve" {
+		if api.allow(w, r, http.MethodGet) {
+			api.redirect(w, r)
+		}
+		return
+	}
+	if parts[0] != "changesets" {
+		api.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		if api.allow(w, r, http.MethodGet) {
+			api.list(w, r)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || len(parts) > 3 {
+		api.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 2 {
+		if api.allow(w, r, http.MethodGet) {
+			api.get(w, r, id)
+		}
+		return
+	}
+	switch parts[2] {
+	case "diff":
+		if api.allow(w, r, http.MethodGet) {
+			api.diff(w, r, id)
+		}
+	case "approve":
+		if api.allow(w, r, http.MethodPost) {
+			api.resolve(w, r, id, api.changeSets.Approve)
+		}
+	case "reject":
+		if api.allow(w, r, http.MethodPost) {
+			api.resolve(w, r, id, api.changeSets.Reject)
+		}
+	default:
+		api.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// allow checks the request method, answering 405 Method Not Allowed if it isn't the expected one.
+// HEAD is allowed for GET.
+func (api *API) allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	api.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func (api *API) list(w http.ResponseWriter, r *http.Request) {
+	status := harvest.ChangeSetStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", harvest.ChangeSetPending, harvest.ChangeSetApproved, harvest.ChangeSetRejected, harvest.ChangeSetSuperseded:
+	default:
+		api.writeError(w, http.StatusBadRequest, "unknown status: "+string(status))
+		return
+	}
+
+	list, err := api.changeSets.List(r.Context(), status)
+	if err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	if list == nil {
+		list = []harvest.ChangeSetInfo{}
+	}
+	api.writeJSON(w, http.StatusOK, list)
+}
+
+func (api *API) get(w http.ResponseWriter, r *http.Request, id int64) {
+	cs, err := api.changeSets.Get(r.Context(), id)
+	if err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	api.writeJSON(w, http.StatusOK, cs)
+}
+
+func (api *API) diff(w http.ResponseWriter, r *http.Request, id int64) {
+	diffs, err := api.changeSets.Diff(r.Context(), id)
+	if err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	api.writeJSON(w, http.StatusOK, diffs)
+}
+
+// redirect answers a request for a URN, with its components, with a redirect to the URL it maps to. The URN is
+// given in the urn query parameter, so the "?" and "#" of its components must be percent-encoded. The q- and
+// f-components are passed on to the URL, see urn.URN.Resolve. Withdrawn mappings are never used; of the others,
+// one with the requested r-component and then one that isn't a legal deposit copy is preferred.
+func (api *API) redirect(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("urn"))
+	if raw == "" {
+		api.writeError(w, http.StatusBadRequest, "missing urn parameter")
+		return
+	}
+	u, err := urn.Parse(raw)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mappings, err := api.mappings.Mappings(r.Context(), u.Normalise().Name())
+	if err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	m := pickMapping(mappings, u.RComponent)
+	if m == nil {
+		api.writeError(w, http.StatusNotFound, "no URL for URN")
+		return
+	}
+	target, err := u.Resolve(m.URL)
+	if err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	w.Header().Set("Location", target)
+	api.writeJSON(w, http.StatusFound, struct {
+		URN string `json:"urn"`
+		URL string `json:"url"`
+	}{raw, target})
+}
+
+// pickMapping returns the mapping a URN with the given r-component resolves to, or nil if there is none.
+func pickMapping(mappings []harvest.Mapping, rComponent string) *harvest.Mapping {
+	var (
+		best     *harvest.Mapping
+		bestRank int
+	)
+	for i := range mappings {
+		m := &mappings[i]
+		if m.IsWithdrawn() {
+			continue
+		}
+		rank := 0
+		if m.RComponent != rComponent {
+			rank += 2
+		}
+		if m.URLType == harvest.URLTypeVapaakappale {
+			rank++
+		}
+		if best == nil || rank < bestRank {
+			best, bestRank = m, rank
+		}
+	}
+	return best
+}
+
+// resolve approves or rejects a change set in the name of the authenticated user and returns the change set.
+func (api *API) resolve(w http.ResponseWriter, r *http.Request, id int64, f func(context.Context, int64, string) error) {
+	user := auth.User(r.Context())
+	if user == "" {
+		api.writeError(w, http.StatusForbidden, "authentication required")
+		return
+	}
+	if err := f(r.Context(), id, user); err != nil {
+		api.writeErr(w, err)
+		return
+	}
+	api.get(w, r, id)
 }
 
 func (api *API) writeHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 }
+
+func (api *API) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeErr maps errors of the change set store to status codes.
+func (api *API) writeErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, harvest.ErrUnknownChangeSet):
+		api.writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, harvest.ErrChangeSetResolved), errors.Is(err, harvest.ErrChangeSetStale):
+		api.writeError(w, http.StatusConflict, err.Error())
+	default:
+		api.writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+func (api *API) writeError(w http.ResponseWriter, status int, msg string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{msg})
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/auth"
+	"github.com/wvh/urn-harvester/pkg/harvest"
+	"github.com/wvh/urn-harvester/pkg/token"
+)
+
+// fakeMappings maps urn:nbn:fi-fe3214 to a normal and a legal deposit URL, and urn:nbn:fi:example-1 to a URL
+// with r-component "pdf", a URL without one and a withdrawn URL.
+type fakeMappings struct{}
+
+func (fakeMappings) Mappings(ctx context.Context, urn string) ([]harvest.Mapping, error) {
+	switch urn {
+	case "urn:nbn:fi-fe3214":
+		return []harvest.Mapping{
+			{URN: urn, URL: "http://example.com/deposit/1", URLType: harvest.URLTypeVapaakappale},
+			{URN: urn, URL: "http://example.com/handle/1?view=full#top", URLType: harvest.URLTypeNormal},
+		}, nil
+	case "urn:nbn:fi:example-1":
+		return []harvest.Mapping{
+			{URN: urn, URL: "http://example.com/withdrawn", RComponent: "pdf", Withdrawn: time.Now()},
+			{URN: urn, URL: "http://example.com/1", URLType: harvest.URLTypeNormal},
+			{URN: urn, URL: "http://example.com/1.pdf", URLType: harvest.URLTypeNormal, RComponent: "pdf"},
+		}, nil
+	case "urn:nbn:fi:example-2":
+		return []harvest.Mapping{{URN: urn, URL: "http://example.com/deposit/2", URLType: harvest.URLTypeVapaakappale}}, nil
+	}
+	return nil, nil
+}
+
+// fakeChangeSets has one pending change set with id 1, and a stale one with id 3 that can't be approved.
+type fakeChangeSets struct {
+	status   harvest.ChangeSetStatus
+	resolved string
+}
+
+func (f *fakeChangeSets) List(ctx context.Context, status harvest.ChangeSetStatus) ([]harvest.ChangeSetInfo, error) {
+	f.status = status
+	return []harvest.ChangeSetInfo{{ID: 1, Status: harvest.ChangeSetPending}}, nil
+}
+
+func (f *fakeChangeSets) Get(ctx context.Context, id int64) (*harvest.StagedChangeSet, error) {
+	if id != 1 {
+		return nil, fmt.Errorf("%w: %d", harvest.ErrUnknownChangeSet, id)
+	}
+	return &harvest.StagedChangeSet{ChangeSetInfo: harvest.ChangeSetInfo{ID: 1}}, nil
+}
+
+func (f *fakeChangeSets) Diff(ctx context.Context, id int64) ([]harvest.Diff, error) {
+	if _, err := f.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	return []harvest.Diff{{Kind: harvest.ChangeURL, URN: "urn:nbn:fi-fe3214", CurrentURL: "a", ProposedURL: "b"}}, nil
+}
+
+func (f *fakeChangeSets) Approve(ctx context.Context, id int64, user string) error {
+	if id == 3 {
+		return fmt.Errorf("%w: 1 of the 1 changes of 3", harvest.ErrChangeSetStale)
+	}
+	return f.resolve(id, "approved by "+user)
+}
+
+func (f *fakeChangeSets) Reject(ctx context.Context, id int64, user string) error {
+	return f.resolve(id, "rejected by "+user)
+}
+
+func (f *fakeChangeSets) resolve(id int64, how string) error {
+	if id != 1 {
+		return fmt.Errorf("%w: %d", harvest.ErrUnknownChangeSet, id)
+	}
+	if f.resolved != "" {
+		return harvest.ErrChangeSetResolved
+	}
+	f.resolved = how
+	return nil
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		query    string
+		status   int
+		location string
+	}{
+		{"URN:NBN:fi-fe3214", 302, "http://example.com/handle/1?view=full#top"},
+		{"urn%3Anbn%3Afi-fe3214%3F%3Dlang%3Dfi%26page%3D2%23chapter%25202", 302, "http://example.com/handle/1?view=full&lang=fi&page=2#chapter%202"},
+		{"urn:nbn:fi:example-1", 302, "http://example.com/1"},
+		{"urn:nbn:fi:example-1%3F%2Bpdf", 302, "http://example.com/1.pdf"},
+		{"urn:nbn:fi:example-1%3F%2Bother", 302, "http://example.com/1"},
+		{"urn:nbn:fi:example-2", 302, "http://example.com/deposit/2"},
+		{"urn:nbn:fi:example-3", 404, ""},
+		{"nope", 400, ""},
+		{"", 400, ""},
+	}
+
+	api, err := New(fakeMappings{}, &fakeChangeSets{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/resolve?urn="+test.query, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: wrong status code, want: %d, got: %d", test.query, test.status, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != test.location {
+			t.Errorf("%s: wrong location, want: %q, got: %q", test.query, test.location, got)
+		}
+	}
+}
+
+func TestChangeSets(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		user     string
+		status   int
+		body     string
+		resolved string
+	}{
+		{"list", http.MethodGet, "/changesets?status=pending", "", 200, `"status":"pending"`, ""},
+		{"list bad status", http.MethodGet, "/changesets?status=meh", "", 400, `"error"`, ""},
+		{"get", http.MethodGet, "/changesets/1", "", 200, `"id":1`, ""},
+		{"get unknown", http.MethodGet, "/changesets/2", "", 404, "unknown change set", ""},
+		{"get bad id", http.MethodGet, "/changesets/x", "", 404, `"error"`, ""},
+		{"diff", http.MethodGet, "/changesets/1/diff", "", 200, `"current_url":"a"`, ""},
+		{"approve", http.MethodPost, "/changesets/1/approve", "jack", 200, `"id":1`, "approved by jack"},
+		{"reject", http.MethodPost, "/changesets/1/reject", "jack", 200, `"id":1`, "rejected by jack"},
+		{"approve unknown", http.MethodPost, "/changesets/2/approve", "jack", 404, "unknown change set", ""},
+		{"approve stale", http.MethodPost, "/changesets/3/approve", "jack", 409, "change set is stale", ""},
+		{"approve with get", http.MethodGet, "/changesets/1/approve", "jack", 405, "method not allowed", ""},
+		{"approve without user", http.MethodPost, "/changesets/1/approve", "", 403, "authentication required", ""},
+		{"unknown path", http.MethodGet, "/meh", "", 404, `"error"`, ""},
+	}
+
+	tokens, err := token.NewTokenService([]byte("12345678901234567890123456789012"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changeSets := &fakeChangeSets{}
+			api, err := New(fakeMappings{}, changeSets)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			handler := auth.NewHandler(auth.Pass, auth.WithTokens(tokens, 0))(api)
+
+			req := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+			var tok string
+			if test.user != "" {
+				tok = string(tokens.MustEncode([]byte(test.user)))
+				req.Header.Add("Authorization", "apiv1 "+tok)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("wrong status code, want: %d, got: %d", test.status, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), test.body) {
+				t.Errorf("body doesn't contain %q: %s", test.body, w.Body.String())
+			}
+			if tok != "" && strings.Contains(w.Body.String(), tok) {
+				t.Errorf("body contains the token: %s", w.Body.String())
+			}
+			if changeSets.resolved != test.resolved {
+				t.Errorf("wrong resolution, want: %q, got: %q", test.resolved, changeSets.resolved)
+			}
+		})
+	}
+}
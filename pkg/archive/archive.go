@@ -0,0 +1,322 @@
+// Package archive keeps the raw responses fetched by the harvester on disk, so that what a source served at a
+// given time can be inspected, and parsed again, later.
+//
+// Response bodies are stored once per content, gzip-compressed, under their SHA-256 digest. Every fetch gets a
+// page: a small JSON file with the URL, status, headers and time of the fetch and the digest of its body. Pages
+// are kept in a directory per day, so old ones can be pruned by date.
+//
+//	blobs/ab/abcdef....gz
+//	pages/2020-10-02/20201002T030000.000000001Z-1.json
+package archive
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// layout of the time in page ids and of page directories
+	idLayout  = "20060102T150405.000000000Z"
+	dayLayout = "2006-01-02"
+
+	// blobs younger than this are not pruned, as a page referring to them may be about to be written
+	blobGrace = time.Hour
+)
+
+var (
+	// ErrNotFound is returned for pages or bodies that are not in the archive.
+	ErrNotFound = errors.New("not found in archive")
+
+	idPattern = regexp.MustCompile(`^(\d{8})T\d{6}\.\d{9}Z-\d+$`)
+)
+
+// Page is a fetched response. Digest is the hex SHA-256 digest of its body and Size its length; a body that was
+// not read to the end is archived as far as it was read.
+type Page struct {
+	ID      string      `json:"id"`
+	Source  string      `json:"source,omitempty"`
+	URL     string      `json:"url"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Fetched time.Time   `json:"fetched"`
+	Digest  string      `json:"digest"`
+	Size    int64       `json:"size"`
+}
+
+// Archive is a response archive in a directory. It is safe for concurrent use.
+type Archive struct {
+	dir string
+	seq uint64
+}
+
+// New opens the archive in dir, creating the directory if needed.
+func New(dir string) (*Archive, error) {
+	for _, sub := range []string{"blobs", "pages"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Archive{dir: dir}, nil
+}
+
+// newID returns a unique id for a page fetched at t.
+func (a *Archive) newID(t time.Time) string {
+	return fmt.Sprintf("%s-%d", t.UTC().Format(idLayout), atomic.AddUint64(&a.seq, 1))
+}
+
+func (a *Archive) pagePath(id string) (string, error) {
+	m := idPattern.FindStringSubmatch(id)
+	if m == nil {
+		return "", fmt.Errorf("invalid page id: %q", id)
+	}
+	day, err := time.Parse("20060102", m[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid page id: %q", id)
+	}
+	return filepath.Join(a.dir, "pages", day.Format(dayLayout), id+".json"), nil
+}
+
+func (a *Archive) blobPath(digest string) string {
+	return filepath.Join(a.dir, "blobs", digest[:2], digest+".gz")
+}
+
+// Create starts archiving a page, setting its id. The body is written to the returned writer; the page is saved
+// when the writer is closed. Pages that are never closed are not saved.
+func (a *Archive) Create(p *Page) (io.WriteCloser, error) {
+	if p.Fetched.IsZero() {
+		p.Fetched = time.Now()
+	}
+	p.ID = a.newID(p.Fetched)
+
+	tmp, err := ioutil.TempFile(filepath.Join(a.dir, "blobs"), ".body-")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	return &pageWriter{a: a, page: p, tmp: tmp, zw: gzip.NewWriter(tmp), hash: h}, nil
+}
+
+// pageWriter compresses a body into a temporary file while hashing it.
+type pageWriter struct {
+	a    *Archive
+	page *Page
+	tmp  *os.File
+	zw   *gzip.Writer
+	hash hash.Hash
+	err  error
+}
+
+func (w *pageWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.hash.Write(b)
+	w.page.Size += int64(len(b))
+	n, err := w.zw.Write(b)
+	w.err = err
+	return n, err
+}
+
+// Close stores the body under its digest, unless an equal body is already stored, and saves the page.
+func (w *pageWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	if w.err == nil {
+		w.err = w.zw.Close()
+	}
+	if err := w.tmp.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	p := w.page
+	p.Digest = hex.EncodeToString(w.hash.Sum(nil))
+	blob := w.a.blobPath(p.Digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(w.tmp.Name(), blob); err != nil {
+			return err
+		}
+	} else {
+		// refresh the blob's time, so it isn't pruned before its new page is written
+		now := time.Now()
+		os.Chtimes(blob, now, now)
+	}
+	return w.a.savePage(p)
+}
+
+func (a *Archive) savePage(p *Page) error {
+	path, err := a.pagePath(p.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// Page returns the page with the given id.
+func (a *Archive) Page(id string) (*Page, error) {
+	path, err := a.pagePath(id)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(path)
+}
+
+func readPage(path string) (*Page, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var p Page
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Body opens the uncompressed body of a page.
+func (a *Archive) Body(p *Page) (io.ReadCloser, error) {
+	f, err := os.Open(a.blobPath(p.Digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &blobReader{Reader: zr, f: f}, nil
+}
+
+type blobReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *blobReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// Walk calls fn for every page in the archive, in the order they were fetched, stopping at the first error.
+func (a *Archive) Walk(fn func(*Page) error) error {
+	days, err := ioutil.ReadDir(filepath.Join(a.dir, "pages"))
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		dir := filepath.Join(a.dir, "pages", day.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var pages []*Page
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".json") {
+				continue
+			}
+			p, err := readPage(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return err
+			}
+			pages = append(pages, p)
+		}
+		sortPages(pages)
+		for _, p := range pages {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune deletes the pages fetched before the given time and the bodies no page refers to any more.
+// It returns the number of pages and bodies deleted.
+func (a *Archive) Prune(before time.Time) (pages, blobs int, err error) {
+	days, err := ioutil.ReadDir(filepath.Join(a.dir, "pages"))
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := before.UTC().Format(dayLayout)
+	for _, day := range days {
+		if !day.IsDir() || day.Name() > cutoff {
+			continue
+		}
+		dir := filepath.Join(a.dir, "pages", day.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return pages, blobs, err
+		}
+		left := 0
+		for _, f := range files {
+			p, err := readPage(filepath.Join(dir, f.Name()))
+			if err != nil || !p.Fetched.Before(before) {
+				left++
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return pages, blobs, err
+			}
+			pages++
+		}
+		if left == 0 {
+			os.Remove(dir)
+		}
+	}
+
+	used := make(map[string]bool)
+	if err := a.Walk(func(p *Page) error {
+		used[p.Digest] = true
+		return nil
+	}); err != nil {
+		return pages, blobs, err
+	}
+	err = filepath.Walk(filepath.Join(a.dir, "blobs"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".gz") {
+			return err
+		}
+		if used[strings.TrimSuffix(fi.Name(), ".gz")] || time.Since(fi.ModTime()) < blobGrace {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		blobs++
+		return nil
+	})
+	return pages, blobs, err
+}
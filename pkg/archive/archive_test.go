@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestArchive(t *testing.T) (*Archive, func()) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return a, func() { os.RemoveAll(dir) }
+}
+
+func put(t *testing.T, a *Archive, url, body string, fetched time.Time) *Page {
+	p := &Page{URL: url, Status: http.StatusOK, Header: http.Header{"Content-Type": {"text/xml"}}, Fetched: fetched}
+	w, err := a.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func readBody(t *testing.T, a *Archive, p *Page) string {
+	r, err := a.Body(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestArchive(t *testing.T) {
+	a, cleanup := newTestArchive(t)
+	defer cleanup()
+
+	day := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+	p1 := put(t, a, "http://example.com/1", "<page>1</page>", day)
+	p2 := put(t, a, "http://example.com/1", "<page>1</page>", day.Add(time.Hour))
+
+	if p1.ID == p2.ID {
+		t.Errorf("pages got the same id: %s", p1.ID)
+	}
+	if p1.Digest != p2.Digest || p1.Size != 14 {
+		t.Errorf("equal bodies got different digests or wrong size: %+v, %+v", p1, p2)
+	}
+	blobs, _ := filepath.Glob(filepath.Join(a.dir, "blobs", "*", "*.gz"))
+	if len(blobs) != 1 {
+		t.Errorf("equal bodies not stored once: %q", blobs)
+	}
+
+	got, err := a.Page(p1.ID)
+	if err != nil {
+		t.Fatal("can't load page:", err)
+	}
+	if got.URL != p1.URL || !got.Fetched.Equal(day) || got.Header.Get("Content-Type") != "text/xml" {
+		t.Errorf("wrong page: %+v", got)
+	}
+	if body := readBody(t, a, got); body != "<page>1</page>" {
+		t.Errorf("wrong body: %q", body)
+	}
+
+	if _, err := a.Page("../../etc/passwd"); err == nil {
+		t.Error("invalid page id accepted")
+	}
+	if _, err := a.Page("20201002T030000.000000000Z-99"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want: %v, got: %v", ErrNotFound, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	a, cleanup := newTestArchive(t)
+	defer cleanup()
+
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p1 := put(t, a, "http://example.com/1", "old", old)
+	p2 := put(t, a, "http://example.com/2", "shared", old)
+	p3 := put(t, a, "http://example.com/2", "shared", old.AddDate(0, 6, 0))
+
+	// make the bodies old enough to be pruned
+	blobs, _ := filepath.Glob(filepath.Join(a.dir, "blobs", "*", "*.gz"))
+	for _, b := range blobs {
+		os.Chtimes(b, old, old)
+	}
+
+	pages, bodies, err := a.Prune(old.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if pages != 2 || bodies != 1 {
+		t.Errorf("want 2 pages and 1 body pruned, got: %d, %d", pages, bodies)
+	}
+	for _, p := range []*Page{p1, p2} {
+		if _, err := a.Page(p.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("page %s not pruned: %v", p.ID, err)
+		}
+	}
+	if body := readBody(t, a, p3); body != "shared" {
+		t.Errorf("body of kept page pruned: %q", body)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	a, cleanup := newTestArchive(t)
+	defer cleanup()
+
+	day := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+	put(t, a, "http://example.com/oai?verb=Identify", "first", day)
+	put(t, a, "http://example.com/oai?verb=Identify", "second", day.Add(time.Hour))
+
+	tests := []struct {
+		before time.Time
+		want   string
+	}{
+		{time.Time{}, "second"},
+		{day.Add(time.Minute), "first"},
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: NewReplay(a, test.before)}
+		resp, err := client.Get("http://example.com/oai?verb=Identify")
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != test.want || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/xml" {
+			t.Errorf("before %v: want %q, got: %d %q", test.before, test.want, resp.StatusCode, b)
+		}
+
+		if _, err := client.Get("http://example.com/other"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("want: %v, got: %v", ErrNotFound, err)
+		}
+	}
+}
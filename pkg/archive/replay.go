@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replay is an http.RoundTripper that answers GET requests with archived pages instead of the network, so a
+// harvest can be parsed again from what a source served. A request gets the last page fetched from its exact URL
+// before the replay's time; requests for URLs that were not archived fail with ErrNotFound.
+type Replay struct {
+	a      *Archive
+	before time.Time
+
+	once  sync.Once
+	err   error
+	pages map[string]*Page
+}
+
+// NewReplay returns a Replay of the pages in an archive fetched before the given time, or of all pages if it
+// is the zero time.
+func NewReplay(a *Archive, before time.Time) *Replay {
+	return &Replay{a: a, before: before}
+}
+
+func (t *Replay) index() {
+	t.pages = make(map[string]*Page)
+	t.err = t.a.Walk(func(p *Page) error {
+		if t.before.IsZero() || p.Fetched.Before(t.before) {
+			t.pages[p.URL] = p
+		}
+		return nil
+	})
+}
+
+func (t *Replay) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.once.Do(t.index)
+	if t.err != nil {
+		return nil, t.err
+	}
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("can't replay %s request", r.Method)
+	}
+
+	p, ok := t.pages[r.URL.String()]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", r.URL, ErrNotFound)
+	}
+	body, err := t.a.Body(p)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", p.Status, http.StatusText(p.Status)),
+		StatusCode:    p.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        p.Header.Clone(),
+		Body:          body,
+		ContentLength: p.Size,
+		Request:       r,
+	}, nil
+}
+
+// sortPages sorts pages by the time they were fetched.
+func sortPages(pages []*Page) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].Fetched.Before(pages[j].Fetched)
+	})
+}
@@ -1,9 +1,14 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wvh/urn-harvester/pkg/token"
 )
 
 const (
@@ -18,6 +23,11 @@ var (
 
 type authPolicy int
 
+// key for the authenticated user in the request context
+type contextKey int
+
+const userKey contextKey = 0
+
 // Auth policies defined.
 const (
 	Unset authPolicy = iota
@@ -47,6 +57,8 @@ func (policy authPolicy) String() string {
 type Handler struct {
 	policy authPolicy
 	onUser func(string)
+	tokens *token.TokenService
+	maxAge time.Duration
 }
 
 // NewHandler creates an authorization handler from the provided policy constant.
@@ -87,12 +99,12 @@ func NewHandler(policy authPolicy, opts ...func(*Handler)) func(http.Handler) ht
 // If the provided string can't be parsed into an auth policy constant, an error is returned.
 // This constructor can be used to setup authentication policy from the environment or other means of configuration.
 //func NewHandlerFromString(s string) (*Handler, error) {
-func NewHandlerFromString(s string) (func(http.Handler) http.Handler, error) {
+func NewHandlerFromString(s string, opts ...func(*Handler)) (func(http.Handler) http.Handler, error) {
 	policy, err := fromString(s)
 	if err != nil {
 		return nil, err
 	}
-	return NewHandler(policy), nil
+	return NewHandler(policy, opts...), nil
 }
 
 func fromString(s string) (authPolicy, error) {
@@ -119,17 +131,30 @@ func (h *Handler) userFromRequest(r *http.Request) string {
 		return ""
 	}
 
-	user := parseToken(hdr[len(headerTokenPrefix):])
-	if h.onUser != nil {
+	user := h.parseToken(hdr[len(headerTokenPrefix):])
+	if user != "" && h.onUser != nil {
 		h.onUser(user)
 	}
 	return user
 }
 
+// withUser adds the user to the request context, if there is one.
+func withUser(r *http.Request, user string) *http.Request {
+	if user == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey, user))
+}
+
+// User returns the user authenticated by the auth handler, or the empty string if the request had no valid token.
+func User(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
 func (h *Handler) pass(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_ = h.userFromRequest(r)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withUser(r, h.userFromRequest(r)))
 	})
 }
 
@@ -137,8 +162,9 @@ func (h *Handler) pass(next http.Handler) http.Handler {
 func (h *Handler) ro(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// authenticated, pass
-		if h.userFromRequest(r) != "" {
-			next.ServeHTTP(w, r)
+		if user := h.userFromRequest(r); user != "" {
+			next.ServeHTTP(w, withUser(r, user))
+			return
 		}
 
 		// not authenticated, only read methods
@@ -154,8 +180,9 @@ func (h *Handler) ro(next http.Handler) http.Handler {
 // middleware that allows HTTP methods with no side effects without authentication
 func (h *Handler) rw(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if h.userFromRequest(r) != "" {
-			next.ServeHTTP(w, r)
+		if user := h.userFromRequest(r); user != "" {
+			next.ServeHTTP(w, withUser(r, user))
+			return
 		}
 		h.forbidden(w, r)
 	})
@@ -171,8 +198,26 @@ func (h *Handler) forbidden(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 }
 
-func parseToken(token string) string {
-	return token
+// parseToken verifies a token and returns the id of the user it was issued to, or the empty string if the token
+// is not valid. Without a token service, no token is valid.
+func (h *Handler) parseToken(tok string) string {
+	if h.tokens == nil {
+		return ""
+	}
+	msg, err := h.tokens.Decode([]byte(tok), h.maxAge)
+	if err != nil || !utf8.Valid(msg) {
+		return ""
+	}
+	return strings.TrimSpace(string(msg))
+}
+
+// WithTokens sets the token service that verifies tokens, which hold the id of the user they were issued to.
+// Tokens older than maxAge are refused; 0 means tokens don't expire.
+func WithTokens(svc *token.TokenService, maxAge time.Duration) func(*Handler) {
+	return func(h *Handler) {
+		h.tokens = svc
+		h.maxAge = maxAge
+	}
 }
 
 // OnUser allows passing a callback function executed when a valid token is found in the request.
@@ -8,10 +8,38 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/token"
 )
 
 const testBody = "Well hello there!"
 
+// testTokens issues and verifies the tokens of the tests.
+var testTokens = func() *token.TokenService {
+	svc, err := token.NewTokenService([]byte("12345678901234567890123456789012"))
+	if err != nil {
+		panic(err)
+	}
+	return svc
+}()
+
+// testToken returns a token for the user.
+func testToken(user string) string {
+	return string(testTokens.MustEncode([]byte(user)))
+}
+
+// tampered returns a token with a character changed in the middle.
+func tampered(tok string) string {
+	b := []byte(tok)
+	if b[len(b)/2] == 'A' {
+		b[len(b)/2] = 'B'
+	} else {
+		b[len(b)/2] = 'A'
+	}
+	return string(b)
+}
+
 func hasBody(res *http.Response, s string) bool {
 	// body is bytes.Buffer, no close required
 	body, _ := ioutil.ReadAll(res.Body)
@@ -35,7 +63,8 @@ func TestAuth(t *testing.T) {
 			io.WriteString(w, testBody)
 		}
 	*/
-	validToken := "jack"
+	validToken := testToken("jack")
+	withTokens := WithTokens(testTokens, time.Minute)
 
 	tests := []struct {
 		name    string
@@ -46,29 +75,33 @@ func TestAuth(t *testing.T) {
 	}{
 		// read method without token
 		{"none", http.MethodGet, nil, 200, ""},
-		{"unset", http.MethodGet, NewHandler(Unset), 403, ""},
-		{"skip", http.MethodGet, NewHandler(Skip), 200, ""},
-		{"pass", http.MethodGet, NewHandler(Pass), 200, ""},
-		{"writeonly", http.MethodGet, NewHandler(WriteOnly), 200, ""},
-		{"all", http.MethodGet, NewHandler(All), 403, ""},
+		{"unset", http.MethodGet, NewHandler(Unset, withTokens), 403, ""},
+		{"skip", http.MethodGet, NewHandler(Skip, withTokens), 200, ""},
+		{"pass", http.MethodGet, NewHandler(Pass, withTokens), 200, ""},
+		{"writeonly", http.MethodGet, NewHandler(WriteOnly, withTokens), 200, ""},
+		{"all", http.MethodGet, NewHandler(All, withTokens), 403, ""},
 		// write method without token
 		{"none", http.MethodPost, nil, 200, ""},
-		{"unset", http.MethodPost, NewHandler(Unset), 403, ""},
-		{"skip", http.MethodPost, NewHandler(Skip), 200, ""},
-		{"pass", http.MethodPost, NewHandler(Pass), 200, ""},
-		{"writeonly", http.MethodPost, NewHandler(WriteOnly), 403, ""},
-		{"all", http.MethodPost, NewHandler(All), 403, ""},
+		{"unset", http.MethodPost, NewHandler(Unset, withTokens), 403, ""},
+		{"skip", http.MethodPost, NewHandler(Skip, withTokens), 200, ""},
+		{"pass", http.MethodPost, NewHandler(Pass, withTokens), 200, ""},
+		{"writeonly", http.MethodPost, NewHandler(WriteOnly, withTokens), 403, ""},
+		{"all", http.MethodPost, NewHandler(All, withTokens), 403, ""},
 		// write method with token
 		{"none", http.MethodPut, nil, 200, validToken},
-		{"unset", http.MethodPut, NewHandler(Unset), 403, validToken},
-		{"skip", http.MethodPut, NewHandler(Skip), 200, validToken},
-		{"pass", http.MethodPut, NewHandler(Pass), 200, validToken},
-		{"writeonly", http.MethodPut, NewHandler(WriteOnly), 200, validToken},
-		{"all", http.MethodPut, NewHandler(All), 200, validToken},
+		{"unset", http.MethodPut, NewHandler(Unset, withTokens), 403, validToken},
+		{"skip", http.MethodPut, NewHandler(Skip, withTokens), 200, validToken},
+		{"pass", http.MethodPut, NewHandler(Pass, withTokens), 200, validToken},
+		{"writeonly", http.MethodPut, NewHandler(WriteOnly, withTokens), 200, validToken},
+		{"all", http.MethodPut, NewHandler(All, withTokens), 200, validToken},
+		// write method with a token that isn't valid
+		{"writeonly", http.MethodPut, NewHandler(WriteOnly, withTokens), 403, "jack"},
+		{"all", http.MethodPut, NewHandler(All, withTokens), 403, tampered(validToken)},
+		{"all", http.MethodPut, NewHandler(All), 403, validToken},
 		// invalid policy
-		{"pass", http.MethodGet, NewHandler(-1), 403, validToken},
+		{"pass", http.MethodGet, NewHandler(-1, withTokens), 403, validToken},
 		// from string
-		{"pass", http.MethodGet, func() func(http.Handler) http.Handler { h, _ := NewHandlerFromString("pass"); return h }(), 200, ""},
+		{"pass", http.MethodGet, func() func(http.Handler) http.Handler { h, _ := NewHandlerFromString("pass", withTokens); return h }(), 200, ""},
 	}
 
 	for _, test := range tests {
@@ -118,7 +151,7 @@ func TestAuth(t *testing.T) {
 }
 
 func TestOnUserCallback(t *testing.T) {
-	token := "abc123"
+	user := "jack"
 
 	var (
 		called bool
@@ -129,10 +162,10 @@ func TestOnUserCallback(t *testing.T) {
 		called = true
 		cbUser = u
 	}
-	handler := NewHandler(Pass, OnUser(onUserFunc))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler := NewHandler(Pass, WithTokens(testTokens, 0), OnUser(onUserFunc))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/meh", nil)
-	req.Header.Add("Authorization", headerTokenType+" "+token)
+	req.Header.Add("Authorization", headerTokenType+" "+testToken(user))
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 
@@ -146,24 +179,62 @@ func TestOnUserCallback(t *testing.T) {
 		t.Error("callback function was not called")
 	}
 
-	if cbUser != token {
-		t.Errorf("callback got passed wrong value, want: %q, got: %q", token, cbUser)
+	if cbUser != user {
+		t.Errorf("callback got passed wrong value, want: %q, got: %q", user, cbUser)
+	}
+}
+
+func TestContextUser(t *testing.T) {
+	want := "jack"
+
+	for _, policy := range []authPolicy{Pass, WriteOnly, All} {
+		t.Run(policy.String(), func(t *testing.T) {
+			var (
+				calls int
+				user  string
+			)
+			handler := NewHandler(policy, WithTokens(testTokens, 0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				user = User(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/meh", nil)
+			req.Header.Add("Authorization", headerTokenType+" "+testToken(want))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if calls != 1 {
+				t.Errorf("endpoint called %d times, want: 1", calls)
+			}
+			if user != want {
+				t.Errorf("wrong user in context, want: %q, got: %q", want, user)
+			}
+		})
 	}
 }
 
 func TestParseToken(t *testing.T) {
-	tokenFunc := parseToken
+	otherTokens, err := token.NewTokenService([]byte("abcdefghijklmnopqrstuvwxyzabcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{tokens: testTokens, maxAge: time.Minute}
 	tokens := []struct {
+		name    string
 		enc     string
 		payload string
 		valid   bool
 	}{
-		{"jack", "jack", true},
+		{"valid", testToken("jack"), "jack", true},
+		{"raw user", "jack", "", false},
+		{"other key", string(otherTokens.MustEncode([]byte("jack"))), "", false},
+		{"tampered", tampered(testToken("jack")), "", false},
+		{"no user", testToken(" "), "", false},
+		{"binary", testToken("\xff\xfe"), "", false},
 	}
 
 	for _, token := range tokens {
-		t.Run(token.enc, func(t *testing.T) {
-			payload := tokenFunc(token.enc)
+		t.Run(token.name, func(t *testing.T) {
+			payload := h.parseToken(token.enc)
 
 			if token.valid && payload == "" {
 				t.Errorf("valid token should return payload, want: %q, got: %q", token.payload, payload)
@@ -178,6 +249,10 @@ func TestParseToken(t *testing.T) {
 			}
 		})
 	}
+
+	if user := (&Handler{}).parseToken(testToken("jack")); user != "" {
+		t.Errorf("token valid without token service, got user: %q", user)
+	}
 }
 
 func TestFromString(t *testing.T) {
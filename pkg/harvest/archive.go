@@ -0,0 +1,116 @@
+package harvest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/wvh/urn-harvester/pkg/archive"
+)
+
+// pageTracker follows the archived page a harvest is reading, carried in the request context. The requests of
+// one harvest are sent one after the other, and a page is fetched before its records are read, so the last page
+// fetched is the page of the current record.
+type pageTracker struct {
+	mu     sync.Mutex
+	source string
+	page   string
+}
+
+type pageTrackerKey struct{}
+
+// withPageTracker returns a context that follows the archived pages of a source's harvest.
+func withPageTracker(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, pageTrackerKey{}, &pageTracker{source: source})
+}
+
+// archivedPage returns the id of the archived page the harvest in ctx is reading, or an empty string.
+func archivedPage(ctx context.Context) string {
+	pt, ok := ctx.Value(pageTrackerKey{}).(*pageTracker)
+	if !ok {
+		return ""
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.page
+}
+
+// archiveTransport saves every response in an archive as its body is read. Responses are still returned if they
+// can't be archived.
+type archiveTransport struct {
+	next    http.RoundTripper
+	archive *archive.Archive
+	logger  log.Logger
+}
+
+func (t *archiveTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+
+	p := &archive.Page{
+		URL:     r.URL.String(),
+		Status:  resp.StatusCode,
+		Header:  resp.Header.Clone(),
+		Fetched: time.Now(),
+	}
+	pt, _ := r.Context().Value(pageTrackerKey{}).(*pageTracker)
+	if pt != nil {
+		p.Source = pt.source
+	}
+	w, err := t.archive.Create(p)
+	if err != nil {
+		t.logger.Log("msg", "can't archive response", "url", p.URL, "err", err)
+		return resp, nil
+	}
+	if pt != nil {
+		pt.mu.Lock()
+		pt.page = p.ID
+		pt.mu.Unlock()
+	}
+	resp.Body = &archiveBody{ReadCloser: resp.Body, w: w, page: p, logger: t.logger}
+	return resp, nil
+}
+
+// archiveBody copies a response body into the archive as it is read.
+type archiveBody struct {
+	io.ReadCloser
+	w      io.WriteCloser
+	page   *archive.Page
+	logger log.Logger
+	once   sync.Once
+	failed bool
+}
+
+func (b *archiveBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.failed {
+		if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.failed = true
+			b.logger.Log("msg", "can't archive response", "url", b.page.URL, "err", werr)
+		}
+	}
+	return n, err
+}
+
+func (b *archiveBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if werr := b.w.Close(); werr != nil && !b.failed {
+			b.logger.Log("msg", "can't archive response", "url", b.page.URL, "err", werr)
+		}
+	})
+	return err
+}
+
+// WithArchive saves every response the harvester receives, including failed attempts, in an archive. History
+// entries record the archived page their record was read from.
+func WithArchive(a *archive.Archive) func(*Harvester) {
+	return func(hv *Harvester) {
+		hv.archive = a
+	}
+}
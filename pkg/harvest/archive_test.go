@@ -0,0 +1,74 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/archive"
+)
+
+func TestArchive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testOAIDeleted)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := archive.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := *testSource
+	src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+	newStore := func() *memStore {
+		return &memStore{mappings: []Mapping{
+			{URN: "urn:nbn:fi:example-2", URL: "http://example.com/handle/2", SourceID: 1, OAIIdentifier: "oai:example.com:2"},
+		}}
+	}
+
+	store := newStore()
+	hv := New(srv.Client(), nil, WithDelay(0), WithArchive(a))
+	if _, err := hv.harvestSince(context.Background(), store, &src, time.Time{}, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(store.history) != 2 {
+		t.Fatalf("want 2 history entries, got: %+v", store.history)
+	}
+	id := store.history[0].ArchivePage
+	for _, h := range store.history {
+		if h.ArchivePage == "" || h.ArchivePage != id {
+			t.Errorf("history entry not linked to the archived page: %+v", h)
+		}
+	}
+
+	p, err := a.Page(id)
+	if err != nil {
+		t.Fatal("can't load archived page:", err)
+	}
+	if p.URL != src.StartURL || p.Source != src.Title || p.Status != http.StatusOK || p.Size != int64(len(testOAIDeleted)) {
+		t.Errorf("wrong archived page: %+v", p)
+	}
+
+	// parse the archived page again, without the network
+	srv.Close()
+	store = newStore()
+	hv = New(&http.Client{Transport: archive.NewReplay(a, time.Time{})}, nil, WithDelay(0), WithRetryLimit(0))
+	res, err := hv.harvestSince(context.Background(), store, &src, time.Time{}, nil)
+	if err != nil {
+		t.Fatal("replay failed:", err)
+	}
+	if res.Records != 2 || res.Withdrawn != 1 || len(store.history) != 2 {
+		t.Errorf("wrong replay result: %+v", res)
+	}
+}
@@ -0,0 +1,243 @@
+package harvest
+
+import (
+	"context"
+)
+
+// Change kinds.
+const (
+	ChangeNew         = "new"
+	ChangeOtherSource = "other-source"
+	ChangeURL         = "changed"
+	ChangeDetails     = "details"
+	ChangeWithdrawn   = "withdrawn"
+	ChangeRestored    = "restored"
+)
+
+// Change is a change to a mapping of the harvested source, for reports.
+// Sources lists the other sources that already map a URN of kind ChangeOtherSource.
+type Change struct {
+	Kind    string `json:"kind"`
+	URN     string `json:"urn"`
+	URL     string `json:"url,omitempty"`
+	OldURL  string `json:"old_url,omitempty"`
+	Sources []int  `json:"sources,omitempty"`
+}
+
+// ChangeOp is a single write recorded by a ChangeSet; exactly one of Insert, Update and History is set.
+// Old is the mapping in the underlying store that the first update of a mapping replaces, so it can be checked
+// before the write is applied later.
+type ChangeOp struct {
+	Insert  *Mapping `json:"insert,omitempty"`
+	Update  *Mapping `json:"update,omitempty"`
+	Old     *Mapping `json:"old,omitempty"`
+	History *History `json:"history,omitempty"`
+}
+
+// mappingKey identifies a mapping: a URN maps to one URL per source.
+type mappingKey struct {
+	urn      string
+	sourceID int
+}
+
+// ChangeSet is a Store that records writes instead of performing them. Reads go to the underlying store,
+// with the recorded writes applied on top, so a harvest sees the same state as when writing for real.
+// The recorded writes can be reported or applied to a store later.
+type ChangeSet struct {
+	store Store
+
+	ops     []ChangeOp
+	changes []Change
+
+	// latest version of each written mapping, in order of first write
+	pending map[mappingKey]*Mapping
+	order   []mappingKey
+}
+
+// NewChangeSet creates an empty change set on top of a store.
+func NewChangeSet(store Store) *ChangeSet {
+	return &ChangeSet{
+		store:   store,
+		pending: make(map[mappingKey]*Mapping),
+	}
+}
+
+// Ops returns the recorded writes in order.
+func (cs *ChangeSet) Ops() []ChangeOp {
+	return cs.ops
+}
+
+// Changes returns the changes to mappings in the order they were made. Updates that only change bookkeeping,
+// such as the missing count, are not included.
+func (cs *ChangeSet) Changes() []Change {
+	return cs.changes
+}
+
+// Apply performs the recorded writes on a store.
+func (cs *ChangeSet) Apply(ctx context.Context, store Store) error {
+	return ApplyOps(ctx, store, cs.ops)
+}
+
+// ApplyOps performs writes recorded by a change set on a store.
+func ApplyOps(ctx context.Context, store Store, ops []ChangeOp) error {
+	for _, op := range ops {
+		var err error
+		switch {
+		case op.Insert != nil:
+			err = store.InsertMapping(ctx, op.Insert)
+		case op.Update != nil:
+			err = store.UpdateMapping(ctx, op.Update)
+		case op.History != nil:
+			err = store.InsertHistory(ctx, op.History)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *ChangeSet) Mappings(ctx context.Context, urn string) ([]Mapping, error) {
+	base, err := cs.store.Mappings(ctx, urn)
+	if err != nil {
+		return nil, err
+	}
+	return cs.overlay(base, func(m *Mapping) bool { return m.URN == urn }), nil
+}
+
+func (cs *ChangeSet) SourceMappings(ctx context.Context, sourceID int) ([]Mapping, error) {
+	base, err := cs.store.SourceMappings(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	return cs.overlay(base, func(m *Mapping) bool { return m.SourceID == sourceID }), nil
+}
+
+func (cs *ChangeSet) OAIMappings(ctx context.Context, sourceID int, identifier string) ([]Mapping, error) {
+	base, err := cs.store.OAIMappings(ctx, sourceID, identifier)
+	if err != nil {
+		return nil, err
+	}
+	return cs.overlay(base, func(m *Mapping) bool { return m.SourceID == sourceID && m.OAIIdentifier == identifier }), nil
+}
+
+// overlay replaces mappings read from the underlying store by their pending versions and adds pending mappings
+// that are not in the store yet. The result only contains mappings that match.
+func (cs *ChangeSet) overlay(base []Mapping, match func(*Mapping) bool) []Mapping {
+	var (
+		result []Mapping
+		found  = make(map[mappingKey]bool)
+	)
+	for _, m := range base {
+		key := mappingKey{m.URN, m.SourceID}
+		found[key] = true
+		if p, ok := cs.pending[key]; ok {
+			m = *p
+		}
+		if match(&m) {
+			result = append(result, m)
+		}
+	}
+	for _, key := range cs.order {
+		if p := cs.pending[key]; !found[key] && match(p) {
+			result = append(result, *p)
+		}
+	}
+	return result
+}
+
+// InsertMapping records a new mapping. If other sources map the same URN, the change is of kind ChangeOtherSource.
+func (cs *ChangeSet) InsertMapping(ctx context.Context, m *Mapping) error {
+	others, err := cs.Mappings(ctx, m.URN)
+	if err != nil {
+		return err
+	}
+
+	c := Change{Kind: ChangeNew, URN: m.URN, URL: m.URL}
+	for _, o := range others {
+		if o.SourceID != m.SourceID && !o.IsWithdrawn() {
+			c.Kind = ChangeOtherSource
+			c.Sources = append(c.Sources, o.SourceID)
+		}
+	}
+	cs.changes = append(cs.changes, c)
+
+	cs.record(ChangeOp{Insert: copyMapping(m)}, m)
+	return nil
+}
+
+// UpdateMapping records a change to a mapping. The first update of a mapping also records the version in the
+// underlying store.
+func (cs *ChangeSet) UpdateMapping(ctx context.Context, m *Mapping) error {
+	op := ChangeOp{Update: copyMapping(m)}
+	if _, ok := cs.pending[mappingKey{m.URN, m.SourceID}]; !ok {
+		old, err := sourceMapping(ctx, cs.store, m.URN, m.SourceID)
+		if err != nil {
+			return err
+		}
+		op.Old = old
+	}
+	cs.record(op, m)
+	return nil
+}
+
+// InsertHistory records a history entry. History entries describe the changes to mappings: a changed URL, a
+// changed URL type or r-component with the same URL, a withdrawal or a restored mapping. Entries for new mappings
+// are already covered by InsertMapping.
+func (cs *ChangeSet) InsertHistory(ctx context.Context, h *History) error {
+	c := Change{URN: h.URN, URL: h.URLNew, OldURL: h.URLOld}
+	switch {
+	case h.URLNew == "":
+		c.Kind = ChangeWithdrawn
+	case h.URLOld == h.URLNew:
+		c.Kind = ChangeDetails
+	case h.URLOld != "":
+		c.Kind = ChangeURL
+	case len(cs.ops) > 0 && cs.ops[len(cs.ops)-1].Update != nil:
+		c.Kind = ChangeRestored
+	}
+	if c.Kind != "" {
+		cs.changes = append(cs.changes, c)
+	}
+
+	hc := *h
+	cs.ops = append(cs.ops, ChangeOp{History: &hc})
+	return nil
+}
+
+// record adds a write to the log and updates the pending version of the mapping.
+func (cs *ChangeSet) record(op ChangeOp, m *Mapping) {
+	cs.ops = append(cs.ops, op)
+
+	key := mappingKey{m.URN, m.SourceID}
+	if _, ok := cs.pending[key]; !ok {
+		cs.order = append(cs.order, key)
+	}
+	cs.pending[key] = copyMapping(m)
+}
+
+// sourceMapping returns the mapping of a URN by a source, or nil if there is none.
+func sourceMapping(ctx context.Context, store Store, urn string, sourceID int) (*Mapping, error) {
+	mappings, err := store.Mappings(ctx, urn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mappings {
+		if mappings[i].SourceID == sourceID {
+			return &mappings[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// sameMapping checks if two versions of a mapping are equal.
+func sameMapping(a, b *Mapping) bool {
+	return a.URN == b.URN && a.URL == b.URL && a.SourceID == b.SourceID && a.URLType == b.URLType &&
+		a.RComponent == b.RComponent && a.OAIIdentifier == b.OAIIdentifier && a.MissingRuns == b.MissingRuns &&
+		a.Withdrawn.Equal(b.Withdrawn)
+}
+
+func copyMapping(m *Mapping) *Mapping {
+	c := *m
+	return &c
+}
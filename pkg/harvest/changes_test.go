@@ -0,0 +1,63 @@
+package harvest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestChangeSet(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{mappings: []Mapping{
+		{URN: "urn:nbn:fi-1", URL: "http://example.com/1", SourceID: 1},
+		{URN: "urn:nbn:fi-1", URL: "http://example.org/1", SourceID: 2},
+	}}
+	cs := NewChangeSet(store)
+
+	if err := cs.UpdateMapping(ctx, &Mapping{URN: "urn:nbn:fi-1", URL: "http://example.com/1b", SourceID: 1}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := cs.InsertMapping(ctx, &Mapping{URN: "urn:nbn:fi-2", URL: "http://example.com/2", SourceID: 1, OAIIdentifier: "oai:2"}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// reads see the recorded writes, the store does not
+	got, _ := cs.Mappings(ctx, "urn:nbn:fi-1")
+	if len(got) != 2 || got[0].URL != "http://example.com/1b" || got[1].URL != "http://example.org/1" {
+		t.Errorf("wrong mappings for updated URN: %+v", got)
+	}
+	got, _ = cs.SourceMappings(ctx, 1)
+	if len(got) != 2 || got[1].URN != "urn:nbn:fi-2" {
+		t.Errorf("wrong source mappings: %+v", got)
+	}
+	got, _ = cs.OAIMappings(ctx, 1, "oai:2")
+	if len(got) != 1 || got[0].URN != "urn:nbn:fi-2" {
+		t.Errorf("wrong OAI mappings: %+v", got)
+	}
+	if store.url("urn:nbn:fi-1", 1) != "http://example.com/1" || len(store.mappings) != 2 {
+		t.Errorf("change set wrote to store: %+v", store.mappings)
+	}
+
+	// the first update of a mapping records the version it replaces
+	if old := cs.Ops()[0].Old; old == nil || old.URL != "http://example.com/1" || old.SourceID != 1 {
+		t.Errorf("wrong old mapping: %+v", old)
+	}
+	if err := cs.UpdateMapping(ctx, &Mapping{URN: "urn:nbn:fi-1", URL: "http://example.com/1c", SourceID: 1}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if old := cs.Ops()[len(cs.Ops())-1].Old; old != nil {
+		t.Errorf("old mapping recorded for later update: %+v", old)
+	}
+
+	if err := cs.Apply(ctx, store); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := []Mapping{
+		{URN: "urn:nbn:fi-1", URL: "http://example.com/1c", SourceID: 1},
+		{URN: "urn:nbn:fi-1", URL: "http://example.org/1", SourceID: 2},
+		{URN: "urn:nbn:fi-2", URL: "http://example.com/2", SourceID: 1, OAIIdentifier: "oai:2"},
+	}
+	if !reflect.DeepEqual(store.mappings, want) {
+		t.Errorf("wrong mappings after apply\nwant: %+v\n got: %+v", want, store.mappings)
+	}
+}
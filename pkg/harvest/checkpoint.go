@@ -0,0 +1,306 @@
+package harvest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// checkpoint is a row in the harvest_checkpoint table: the position of an OAI-PMH harvest in its lists.
+// Token requests page Page, counting from 1 across the lists of all sets, in the list of Set; an empty token
+// requests the first page of that list. While a run is going on, the checkpoint is updated at the start of
+// every page, and what the run harvested since the last checkpoint is added to the harvest_checkpoint_page table
+// under the page of that checkpoint, so the next run can continue from there even if the harvester is killed.
+// State is what was harvested before Page: its counters are in the checkpoint, the rest is made up of the rows
+// of the pages before it. Started is the start of the run that began the list, Since the from date it asked for.
+type checkpoint struct {
+	SourceID int
+	RunID    int64
+	Started  time.Time
+	Since    time.Time
+	Page     int
+	Set      string
+	Token    string
+	Expires  time.Time
+	Updated  time.Time
+	State    *resumeState
+}
+
+// resumeState is the part of a harvest before a checkpoint: its result, the URNs it wrote and its writes. When
+// the source is harvested by set, IDs holds the OAI identifiers of the records read, so records of earlier sets
+// are still skipped after resuming.
+type resumeState struct {
+	Records      int           `json:"records"`
+	Warnings     []Warning     `json:"warnings,omitempty"`
+	Rejected     []Rejection   `json:"rejected,omitempty"`
+	RejectedURLs []RejectedURL `json:"rejected_urls,omitempty"`
+	Withdrawn    int           `json:"withdrawn"`
+	Seen         []string      `json:"seen"`
+	IDs          []string      `json:"ids,omitempty"`
+	Ops          []ChangeOp    `json:"ops"`
+}
+
+// pageReader is a RecordReader of a list that is read in pages, such as OAI-PMH, whose pages can be requested
+// again with a resumption token.
+type pageReader interface {
+	RecordReader
+	// Page returns the number of the current page, counting from 1, and the resumption token that requested it.
+	// The token is empty for the first page of a list.
+	Page() (int, oaipmh.ResumptionToken)
+	// Set returns the set of the current list, or the empty string if the source isn't harvested by set.
+	Set() string
+}
+
+// progress follows a harvest through the pages of its list, remembering where each page started.
+type progress struct {
+	started time.Time
+	since   time.Time
+	// checkpoint being resumed, or nil
+	resume *checkpoint
+	// called at the start of each page; errors are logged
+	onPage func(*Result)
+
+	cs   *ChangeSet
+	seen []string
+	// OAI identifiers of the records read, when harvesting by set
+	ids []string
+
+	// position and sizes of the harvest at the start of the current page
+	cp checkpoint
+	at position
+	// page and sizes of the last checkpoint saved, which the state of the next one starts from
+	savedPage int
+	saved     position
+}
+
+// position is how much a harvest has harvested: its counters and the sizes of the lists that make up its state.
+type position struct {
+	records int
+	withdr  int
+	warn    int
+	rej     int
+	rejURLs int
+	ops     int
+	seen    int
+	ids     int
+}
+
+// position returns the current position of the harvest.
+func (p *progress) position(res *Result) position {
+	return position{
+		records: res.Records,
+		withdr:  res.Withdrawn,
+		warn:    len(res.Warnings),
+		rej:     len(res.Rejected),
+		rejURLs: len(res.RejectedURLs),
+		ops:     len(p.cs.Ops()),
+		seen:    len(p.seen),
+		ids:     len(p.ids),
+	}
+}
+
+// startPage records that a page begins with the record about to be read.
+func (p *progress) startPage(n int, set string, token oaipmh.ResumptionToken, res *Result) {
+	p.cp.Page, p.cp.Set, p.cp.Token, p.cp.Expires = n, set, token.Value, token.ExpirationDate
+	p.at = p.position(res)
+	if p.onPage != nil {
+		p.onPage(res)
+	}
+}
+
+// restore sets up a result with the state of the resumed checkpoint.
+func (p *progress) restore(res *Result, seen map[string]struct{}) {
+	if p.resume == nil {
+		return
+	}
+	st := p.resume.State
+	res.Records, res.Withdrawn = st.Records, st.Withdrawn
+	res.Warnings = append(res.Warnings, st.Warnings...)
+	res.Rejected = append(res.Rejected, st.Rejected...)
+	res.RejectedURLs = append(res.RejectedURLs, st.RejectedURLs...)
+	for _, urn := range st.Seen {
+		seen[urnKey(urn)] = struct{}{}
+	}
+	p.seen = append(p.seen, st.Seen...)
+	p.ids = append(p.ids, st.IDs...)
+	// the pages before the resumed one are saved already
+	p.savedPage, p.saved = p.resume.Page, p.position(res)
+}
+
+// pageState returns what was harvested between the last saved checkpoint and the start of the current page.
+func (p *progress) pageState(res *Result) *resumeState {
+	from, to := p.saved, p.at
+	return &resumeState{
+		Warnings:     res.Warnings[from.warn:to.warn],
+		Rejected:     res.Rejected[from.rej:to.rej],
+		RejectedURLs: res.RejectedURLs[from.rejURLs:to.rejURLs],
+		Seen:         p.seen[from.seen:to.seen],
+		IDs:          p.ids[from.ids:to.ids],
+		Ops:          p.cs.Ops()[from.ops:to.ops],
+	}
+}
+
+// newProgress sets up the progress of a run of an OAI-PMH source, resuming the checkpoint of a failed run if it
+// asked for the same records and its token has not expired. Other formats can't be resumed and get nil.
+// Its checkpoints are saved with db at the start of every page, see saveProgress.
+func (hv *Harvester) newProgress(ctx context.Context, db Querier, src *Source, run *Run, since time.Time) *progress {
+	if src.Format != FormatOAIPMH {
+		return nil
+	}
+	p := &progress{started: run.Start, since: since}
+
+	cp, err := loadCheckpoint(ctx, db, src.ID)
+	switch {
+	case err != nil:
+		hv.logger.Log("msg", "can't load checkpoint", "source", src.Title, "err", err)
+	case cp == nil || cp.State == nil:
+	case !cp.Since.Equal(since):
+		hv.logger.Log("msg", "not resuming harvest with different from date", "source", src.Title, "run", cp.RunID)
+	case !src.harvestsSet(cp.Set):
+		hv.logger.Log("msg", "not resuming harvest of set no longer harvested", "source", src.Title, "run", cp.RunID,
+			"set", cp.Set)
+	case !cp.Expires.IsZero() && !run.Start.Before(cp.Expires):
+		hv.logger.Log("msg", "not resuming harvest, resumption token expired", "source", src.Title, "run", cp.RunID,
+			"expired", cp.Expires.Format(time.RFC3339))
+	default:
+		hv.logger.Log("msg", "resuming harvest", "source", src.Title, "run", cp.RunID, "page", cp.Page,
+			"set", cp.Set, "records", cp.State.Records)
+		p.resume, p.started = cp, cp.Started
+		run.ResumedFrom = cp.RunID
+	}
+
+	p.cp = checkpoint{SourceID: src.ID, Started: p.started, Since: since}
+	p.onPage = func(res *Result) {
+		if err := hv.saveProgress(ctx, db, p, res, 0); err != nil {
+			hv.logger.Log("msg", "can't save checkpoint", "source", src.Title, "page", p.cp.Page, "err", err)
+		}
+	}
+	return p
+}
+
+// saveProgress saves the checkpoint of the current page of a harvest, first adding what was harvested since the
+// last checkpoint under the page of that one. The harvest can be resumed from the current page once it gets past
+// the first one. Checkpoints are written with db, which is not the transaction of the run, so they outlive it.
+func (hv *Harvester) saveProgress(ctx context.Context, db Querier, p *progress, res *Result, runID int64) error {
+	cp := p.cp
+	cp.RunID, cp.Updated = runID, hv.now()
+	if cp.Page > 1 {
+		if p.savedPage < cp.Page {
+			from := p.savedPage
+			if from < 1 {
+				// the checkpoint of the first page wasn't saved
+				from = 1
+			}
+			if err := saveCheckpointPage(ctx, db, cp.SourceID, from, p.pageState(res)); err != nil {
+				return err
+			}
+		}
+		cp.State = &resumeState{Records: p.at.records, Withdrawn: p.at.withdr}
+	}
+	if err := saveCheckpoint(ctx, db, &cp); err != nil {
+		return err
+	}
+	p.savedPage, p.saved = cp.Page, p.at
+	return nil
+}
+
+// saveFailed saves the checkpoint of a failed run, or removes it if the run can't be resumed.
+func (hv *Harvester) saveFailed(ctx context.Context, db Querier, src *Source, run *Run, p *progress, res *Result, err error) {
+	if p.cp.Page <= 1 || res == nil || errors.Is(err, oaipmh.ErrBadResumptionToken) {
+		if err := deleteCheckpoint(ctx, db, src.ID); err != nil {
+			hv.logger.Log("msg", "can't delete checkpoint", "source", src.Title, "err", err)
+		}
+		return
+	}
+	if err := hv.saveProgress(ctx, db, p, res, run.ID); err != nil {
+		hv.logger.Log("msg", "can't save checkpoint", "source", src.Title, "run", run.ID, "err", err)
+		return
+	}
+	hv.logger.Log("msg", "harvest can be resumed", "source", src.Title, "run", run.ID, "page", p.cp.Page,
+		"expires", p.cp.Expires.Format(time.RFC3339))
+}
+
+// loadCheckpoint loads the checkpoint of a source, or nil if it has none.
+func loadCheckpoint(ctx context.Context, db Querier, sourceID int) (*checkpoint, error) {
+	var (
+		cp      = checkpoint{SourceID: sourceID}
+		runID   *int64
+		since   *time.Time
+		expires *time.Time
+		state   []byte
+		pages   []byte
+	)
+	err := db.QueryRow(ctx, sqlCheckpoint, sourceID).Scan(&runID, &cp.Started, &since, &cp.Page, &cp.Token, &expires,
+		&cp.Updated, &state, &cp.Set, &pages)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if runID != nil {
+		cp.RunID = *runID
+	}
+	if since != nil {
+		cp.Since = *since
+	}
+	if expires != nil {
+		cp.Expires = *expires
+	}
+	if state != nil {
+		st := &resumeState{}
+		if err := json.Unmarshal(state, st); err != nil {
+			return nil, err
+		}
+		var states []resumeState
+		if pages != nil {
+			if err := json.Unmarshal(pages, &states); err != nil {
+				return nil, err
+			}
+		}
+		for _, ps := range states {
+			st.Warnings = append(st.Warnings, ps.Warnings...)
+			st.Rejected = append(st.Rejected, ps.Rejected...)
+			st.RejectedURLs = append(st.RejectedURLs, ps.RejectedURLs...)
+			st.Seen = append(st.Seen, ps.Seen...)
+			st.IDs = append(st.IDs, ps.IDs...)
+			st.Ops = append(st.Ops, ps.Ops...)
+		}
+		cp.State = st
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint writes the checkpoint of a source, replacing the previous one.
+func saveCheckpoint(ctx context.Context, db Querier, cp *checkpoint) error {
+	var state []byte
+	if cp.State != nil {
+		var err error
+		if state, err = json.Marshal(cp.State); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(ctx, sqlSaveCheckpoint, cp.SourceID, nullableID(cp.RunID), cp.Started, nullableTime(cp.Since), cp.Page, cp.Token,
+		nullableTime(cp.Expires), cp.Updated, state, nullable(cp.Set))
+	return err
+}
+
+// saveCheckpointPage writes what a harvest harvested from the start of a page to the next checkpoint.
+func saveCheckpointPage(ctx context.Context, db Querier, sourceID, page int, st *resumeState) error {
+	state, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, sqlSaveCheckpointPage, sourceID, page, state)
+	return err
+}
+
+// deleteCheckpoint removes the checkpoint of a source with its pages.
+func deleteCheckpoint(ctx context.Context, db Querier, sourceID int) error {
+	_, err := db.Exec(ctx, sqlDeleteCheckpoint, sourceID)
+	return err
+}
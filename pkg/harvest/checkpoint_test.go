@@ -0,0 +1,206 @@
+package harvest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/harvest/harvesttest"
+)
+
+func TestResume(t *testing.T) {
+	first := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	// a repository of three one-record pages whose third page fails while broken is set
+	newRepo := func(lifetime time.Duration, broken *bool) *harvesttest.OAIPMH {
+		return &harvesttest.OAIPMH{
+			Faults: harvesttest.Faults{Hook: func(w http.ResponseWriter, r *http.Request) bool {
+				if *broken && r.URL.Query().Get("resumptionToken") == "token-2" {
+					http.Error(w, "broken", http.StatusInternalServerError)
+					return true
+				}
+				return false
+			}},
+			Records: []harvesttest.Record{
+				{Identifier: "oai:example.com:1", URN: "URN:NBN:fi:example-1", URLs: []string{"http://example.com/handle/1"}},
+				{Identifier: "oai:example.com:2", URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/handle/2"}},
+				{Identifier: "oai:example.com:3", URN: "URN:NBN:fi:example-3", URLs: []string{"http://example.com/handle/3"}},
+			},
+			PageSize:      1,
+			TokenLifetime: lifetime,
+			Now:           func() time.Time { return first },
+		}
+	}
+
+	// fails on page 3, leaving a checkpoint at the start of page 2
+	setup := func(t *testing.T, lifetime time.Duration) (*fakeDB, *harvesttest.OAIPMH, func(time.Time) (*Result, error)) {
+		broken := true
+		repo := newRepo(lifetime, &broken)
+		srv := httptest.NewServer(repo)
+
+		src := *testSource
+		src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+		src.ResumeURL = srv.URL + "/oai?verb=ListRecords&resumptionToken="
+		db := &fakeDB{}
+		run := func(now time.Time) (*Result, error) {
+			hv := New(srv.Client(), nil, WithDelay(0), WithRetryLimit(0))
+			hv.now = func() time.Time { return now }
+			return hv.Run(context.Background(), db, &src, true)
+		}
+		t.Cleanup(srv.Close)
+
+		if _, err := run(first); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if db.checkpoint == nil || db.checkpoint[4] != 2 || db.checkpoint[5] != "token-1" || db.checkpoint[8] == nil {
+			t.Fatalf("wrong checkpoint: %v", db.checkpoint)
+		}
+		broken = false
+		return db, repo, run
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		db, repo, run := setup(t, 24*time.Hour)
+		res, err := run(second)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if reqs := repo.Requests()[3:]; len(reqs) != 2 || !strings.HasSuffix(reqs[0], "resumptionToken=token-1") {
+			t.Errorf("harvest not resumed with token-1, requests: %q", reqs)
+		}
+		if res.Records != 3 {
+			t.Errorf("wrong record count, want: 3, got: %d", res.Records)
+		}
+		// the mapping of page 1 comes from the checkpoint
+		if n := len(db.executed(sqlInsertMapping, true)); n != 3 {
+			t.Errorf("want 3 inserted mappings, got: %d", n)
+		}
+		if args := db.runs[1].args; args[4] != string(RunSuccess) || args[11] != int64(1) {
+			t.Errorf("wrong run record: %v", args)
+		}
+		if u := db.executed(sqlUpdateLastRun, true); len(u) != 1 || u[0].args[1] != first {
+			t.Errorf("last successful run start not that of the resumed run: %+v", u)
+		}
+		if db.checkpoint != nil {
+			t.Errorf("checkpoint not deleted: %v", db.checkpoint)
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		db, repo, run := setup(t, 24*time.Hour)
+		// a killed harvester doesn't save its failure: the last checkpoint is the one of the start of page 2
+		saved := db.executed(sqlSaveCheckpoint, false)
+		if state, _ := saved[0].args[8].([]byte); len(saved) != 3 || state != nil {
+			t.Fatalf("want checkpoints of pages 1 and 2 and of the failure, the first without state, got: %+v", saved)
+		}
+		page := saved[1].args
+		if state, _ := page[8].([]byte); page[1] != nil || page[4] != 2 || page[5] != "token-1" || state == nil {
+			t.Fatalf("wrong checkpoint of page 2: %v", page)
+		}
+		// the checkpoint holds the counters, the page rows what was harvested from each page
+		var counters, page1 resumeState
+		if err := json.Unmarshal(page[8].([]byte), &counters); err != nil || counters.Records != 1 || len(counters.Seen) != 0 {
+			t.Errorf("checkpoint of page 2 should only count 1 record, got: %s, err: %v", page[8], err)
+		}
+		if err := json.Unmarshal(db.pages[1], &page1); err != nil || len(db.pages) != 1 || len(page1.Seen) != 1 || len(page1.Ops) == 0 {
+			t.Errorf("want the state of page 1 alone, got: %q, err: %v", db.pages, err)
+		}
+		db.checkpoint = page
+
+		res, err := run(second)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if reqs := repo.Requests()[3:]; len(reqs) != 2 || !strings.HasSuffix(reqs[0], "resumptionToken=token-1") {
+			t.Errorf("harvest not resumed with token-1, requests: %q", reqs)
+		}
+		if n := len(db.executed(sqlInsertMapping, true)); res.Records != 3 || n != 3 {
+			t.Errorf("want 3 records and inserted mappings, got: %d, %d", res.Records, n)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		db, repo, run := setup(t, 30*time.Minute)
+		if _, err := run(second); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if reqs := repo.Requests()[3:]; len(reqs) != 3 || strings.Contains(reqs[0], "resumptionToken") {
+			t.Errorf("harvest not started over, requests: %q", reqs)
+		}
+		if args := db.runs[1].args; args[11] != nil {
+			t.Errorf("fresh run recorded as resumed: %v", args)
+		}
+		if u := db.executed(sqlUpdateLastRun, true); len(u) != 1 || u[0].args[1] != second {
+			t.Errorf("wrong last successful run start: %+v", u)
+		}
+	})
+}
+
+func TestResumeSets(t *testing.T) {
+	now := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+
+	// set a has one page of records 1 and 2, set b one-record pages of 2, 3 and 4; the last page of b fails
+	// while broken is set
+	broken := true
+	repo := &harvesttest.OAIPMH{
+		Faults: harvesttest.Faults{Hook: func(w http.ResponseWriter, r *http.Request) bool {
+			if broken && r.URL.Query().Get("resumptionToken") == "token-1" {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return true
+			}
+			return false
+		}},
+		Sets: []harvesttest.Set{{Spec: "a"}, {Spec: "b"}},
+		Records: []harvesttest.Record{
+			{Identifier: "oai:example.com:1", Sets: []string{"a"}, URN: "URN:NBN:fi:example-1", URLs: []string{"http://example.com/handle/1"}},
+			{Identifier: "oai:example.com:2", Sets: []string{"a", "b"}, URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/handle/2"}},
+			{Identifier: "oai:example.com:3", Sets: []string{"b"}, URN: "URN:NBN:fi:example-3", URLs: []string{"http://example.com/handle/3"}},
+			{Identifier: "oai:example.com:4", Sets: []string{"b"}, URN: "URN:NBN:fi:example-4", URLs: []string{"http://example.com/handle/4"}},
+		},
+		PageSize:      2,
+		TokenLifetime: 24 * time.Hour,
+		Now:           func() time.Time { return now },
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	src := *testSource
+	src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+	src.ResumeURL = srv.URL + "/oai?verb=ListRecords&resumptionToken="
+	src.Sets = []string{"a", "b"}
+	db := &fakeDB{}
+	run := func() (*Result, error) {
+		hv := New(srv.Client(), nil, WithDelay(0), WithRetryLimit(0))
+		hv.now = func() time.Time { return now }
+		return hv.Run(context.Background(), db, &src, true)
+	}
+
+	if _, err := run(); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	// page 1 is set a, page 2 the first page of set b with records 2 and 3
+	if db.checkpoint == nil || db.checkpoint[4] != 2 || db.checkpoint[5] != "" || db.checkpoint[9] != "b" {
+		t.Fatalf("wrong checkpoint: %v", db.checkpoint)
+	}
+
+	broken = false
+	n := len(repo.Requests())
+	res, err := run()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if reqs := repo.Requests()[n:]; len(reqs) != 2 || !strings.Contains(reqs[0], "set=b") {
+		t.Errorf("harvest not resumed at the start of set b, requests: %q", reqs)
+	}
+	if res.Records != 4 || len(res.Warnings) != 0 {
+		t.Errorf("wrong result, want 4 records without warnings, got: %+v", res)
+	}
+	if n := len(db.executed(sqlInsertMapping, true)); n != 4 {
+		t.Errorf("want 4 inserted mappings, got: %d", n)
+	}
+}
@@ -0,0 +1,86 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNeedsApproval means the changes of a run were held for approval because there were too many of them.
+	ErrNeedsApproval = errors.New("run needs approval")
+)
+
+// maxNotifiedChanges is the number of changes listed in a quarantine notification.
+const maxNotifiedChanges = 20
+
+// checkChanges checks the changes of a run against the source's anomaly thresholds. Changed URLs and withdrawals
+// count as changes; new mappings and changes of only the URL type or r-component don't. The run is suspicious if
+// the number of changes exceeds MaxChanges or the share of the source's existing mappings they affect exceeds
+// MaxChangesPercent; a threshold of 0 is not checked. It returns why the run is suspicious, or the empty string.
+func checkChanges(src *Source, existing int, changes []Change) string {
+	n := 0
+	for _, c := range changes {
+		if c.Kind == ChangeURL || c.Kind == ChangeWithdrawn {
+			n++
+		}
+	}
+	if n == 0 {
+		return ""
+	}
+
+	percent := 100.0
+	if existing > 0 {
+		percent = 100 * float64(n) / float64(existing)
+	}
+	var exceeded []string
+	if src.MaxChanges > 0 && n > src.MaxChanges {
+		exceeded = append(exceeded, fmt.Sprintf("limit is %d", src.MaxChanges))
+	}
+	if src.MaxChangesPercent > 0 && percent > src.MaxChangesPercent {
+		exceeded = append(exceeded, fmt.Sprintf("limit is %.1f%%", src.MaxChangesPercent))
+	}
+	if len(exceeded) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d existing mappings (%.1f%%) would change or be withdrawn, %s",
+		n, existing, percent, strings.Join(exceeded, " and "))
+}
+
+// notifyQuarantine tells the contact of a source that a run was quarantined. Errors are logged.
+func (hv *Harvester) notifyQuarantine(ctx context.Context, src *Source, run *Run, changes []Change) {
+	logger := hv.logger
+	if hv.notifier == nil || src.Email == "" {
+		logger.Log("msg", "quarantined run not notified", "source", src.Title, "run", run.ID, "email", src.Email)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The harvest of %s started at %s was not committed: %s.\n\n",
+		src.Title, run.Start.Format("2006-01-02 15:04:05 MST"), run.Error)
+	fmt.Fprintf(&b, "Its changes are held for approval as run %d. If the repository was changed by mistake, "+
+		"please fix it and let us know; otherwise the changes can be approved.\n\n", run.ID)
+
+	listed := 0
+	for _, c := range changes {
+		if c.Kind != ChangeURL && c.Kind != ChangeWithdrawn {
+			continue
+		}
+		if listed == maxNotifiedChanges {
+			fmt.Fprintf(&b, "...\n")
+			break
+		}
+		if c.Kind == ChangeWithdrawn {
+			fmt.Fprintf(&b, "withdrawn %s: %s\n", c.URN, c.OldURL)
+		} else {
+			fmt.Fprintf(&b, "changed %s: %s -> %s\n", c.URN, c.OldURL, c.URL)
+		}
+		listed++
+	}
+
+	subject := fmt.Sprintf("URN harvest of %s needs approval", src.Title)
+	if err := hv.notifier.Notify(ctx, src.Email, subject, b.String()); err != nil {
+		logger.Log("msg", "can't notify source contact", "source", src.Title, "run", run.ID, "email", src.Email, "err", err)
+	}
+}
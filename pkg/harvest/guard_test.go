@@ -0,0 +1,43 @@
+package harvest
+
+import (
+	"testing"
+)
+
+func TestCheckChanges(t *testing.T) {
+	changes := func(n int) []Change {
+		var cs []Change
+		for i := 0; i < n; i++ {
+			cs = append(cs, Change{Kind: ChangeURL}, Change{Kind: ChangeNew}, Change{Kind: ChangeDetails})
+		}
+		return cs
+	}
+
+	tests := []struct {
+		maxChanges int
+		maxPercent float64
+		existing   int
+		changes    int
+		suspicious bool
+	}{
+		{0, 0, 100, 100, false},
+		{10, 0, 100, 10, false},
+		{10, 0, 100, 11, true},
+		{0, 10, 100, 10, false},
+		{0, 10, 100, 11, true},
+		{10, 10, 1000, 10, false},
+		{10, 10, 1000, 50, true},
+		{100, 10, 50, 9, true},
+		{10, 10, 50, 4, false},
+		{10, 10, 0, 11, true},
+	}
+
+	for _, test := range tests {
+		src := &Source{MaxChanges: test.maxChanges, MaxChangesPercent: test.maxPercent}
+		reason := checkChanges(src, test.existing, changes(test.changes))
+		if suspicious := reason != ""; suspicious != test.suspicious {
+			t.Errorf("checkChanges(%d, %.0f%%, %d of %d): want suspicious: %t, got: %q",
+				test.maxChanges, test.maxPercent, test.changes, test.existing, test.suspicious, reason)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/wvh/urn-harvester/pkg/urn"
+)
+
+var (
+	// ErrIncompleteRecord means a record is missing either its URN or an acceptable URL.
+	ErrIncompleteRecord = errors.New("incomplete record")
+
+	// ErrInvalidURN means the URN of a record is not a valid URN.
+	ErrInvalidURN = errors.New("invalid URN")
+
+	// ErrExcluded means a record was skipped because its URN is owned by a source excluded by the source's rules.
+	ErrExcluded = errors.New("URN owned by excluded source")
+)
+
+// FormatHandler receives the identifiers of one record at a time and writes the resulting mapping.
+// It mirrors set_urn, set_url and write_url of the original Python harvester.
+type FormatHandler interface {
+	// Reset clears the state of the previous record.
+	Reset()
+	// SetURN sets the URN of the current record.
+	SetURN(urn string)
+	// SetURL sets the URL of the current record if it is acceptable for the source, and reports whether it was.
+	SetURL(url string) bool
+	// SetOAIIdentifier sets the OAI-PMH identifier of the current record.
+	SetOAIIdentifier(id string)
+	// SetURLType sets the URL type of the current record, if it differs from the source's.
+	SetURLType(t URLType)
+	// WriteURL stores the mapping of the current record.
+	WriteURL(ctx context.Context) error
+	// Withdraw withdraws the mappings harvested from the current record, identified by its OAI-PMH identifier,
+	// and returns how many were withdrawn.
+	Withdraw(ctx context.Context) (int, error)
+}
+
+// Handler is the default FormatHandler. It rewrites and filters URLs according to the source's rules
+// and URL pattern, and writes mappings of the source's URL type, unless a record has its own, to a Store.
+type Handler struct {
+	store   Store
+	source  *Source
+	pattern *regexp.Regexp
+	rules   *compiledRules
+	logger  log.Logger
+	now     func() time.Time
+
+	// normalised URNs written or confirmed since the handler was created
+	seen map[string]struct{}
+
+	urn     string
+	url     string
+	rank    int
+	oaiID   string
+	urlType URLType
+}
+
+// NewHandler creates a format handler for a source. URLs must match the source's URL pattern from the start,
+// like Python's re.match; an empty pattern accepts any URL.
+func NewHandler(store Store, src *Source, logger log.Logger) (*Handler, error) {
+	pattern, err := regexp.Compile("^(?:" + src.URLPattern + ")")
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL pattern for source %s: %w", src.Title, err)
+	}
+	rules, err := src.Rules.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules for source %s: %w", src.Title, err)
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &Handler{
+		store:   store,
+		source:  src,
+		pattern: pattern,
+		rules:   rules,
+		logger:  logger,
+		now:     time.Now,
+		seen:    make(map[string]struct{}),
+	}, nil
+}
+
+// Reset clears the URN and URL of the previous record.
+func (h *Handler) Reset() {
+	h.urn = ""
+	h.url = ""
+	h.rank = 0
+	h.oaiID = ""
+	h.urlType = ""
+}
+
+// SetURN sets the URN of the current record. Empty values are ignored.
+func (h *Handler) SetURN(urn string) {
+	if urn != "" {
+		h.urn = urn
+	}
+}
+
+// SetOAIIdentifier sets the OAI-PMH identifier of the current record, which is stored with its mapping.
+func (h *Handler) SetOAIIdentifier(id string) {
+	h.oaiID = id
+}
+
+// SetURLType sets the URL type of the current record. An empty type is the source's.
+func (h *Handler) SetURLType(t URLType) {
+	h.urlType = t
+}
+
+// SetURL rewrites a URL using the source's rules and sets it as the URL of the current record
+// if it matches the source's URL pattern. A URL that has already been set is only replaced
+// by a URL with the same or a higher preference. It returns false if the URL does not match the pattern.
+func (h *Handler) SetURL(url string) bool {
+	url = h.rules.rewriteURL(url)
+	if url == "" || !h.pattern.MatchString(url) {
+		h.logger.Log("source", h.source.Title, "msg", "rejecting URL", "url", url)
+		return false
+	}
+
+	rank := h.rules.rank(url)
+	if h.url != "" && rank > h.rank {
+		return true
+	}
+	h.url, h.rank = url, rank
+	return true
+}
+
+// WriteURL inserts or updates the mapping for the current record and records the change in the history table.
+// URNs are stored in their normal form, see urn.Normalise. URNs that fail urn.Validate, such as Finnish NBNs
+// with a wrong check digit, are not written and ErrInvalidURN is returned.
+// The r-component of the URN is stored with the mapping; q- and f-components are dropped, they only make
+// sense in a request for the URN and are passed on at resolution time.
+// Mappings from other sources are left alone; a URN can map to one URL per source.
+// A withdrawn mapping of the source is restored. If the URN is already mapped by a source excluded by the rules,
+// ErrExcluded is returned.
+func (h *Handler) WriteURL(ctx context.Context) error {
+	if h.urn == "" || h.url == "" {
+		return ErrIncompleteRecord
+	}
+
+	u, err := urn.Parse(strings.TrimSpace(h.urn))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURN, err)
+	}
+	if err := u.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURN, err)
+	}
+	name := u.Normalise().Name()
+	urlType := h.source.URLType
+	if h.urlType != "" {
+		urlType = h.urlType
+	}
+
+	existing, err := h.store.Mappings(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range existing {
+		if h.rules.excluded[m.SourceID] && !m.IsWithdrawn() {
+			return ErrExcluded
+		}
+	}
+
+	for _, m := range existing {
+		if m.SourceID != h.source.ID {
+			continue
+		}
+		// only a record's own URL type is compared; a change of the source's applies to new URLs
+		sameType := h.urlType == "" || m.URLType == h.urlType
+		if m.URL == h.url && m.RComponent == u.RComponent && sameType && !m.IsWithdrawn() {
+			h.seen[name] = struct{}{}
+			if m.MissingRuns == 0 && (h.oaiID == "" || m.OAIIdentifier == h.oaiID) {
+				return nil
+			}
+			// back after going missing in earlier harvests, or harvested from another OAI-PMH record
+			m.MissingRuns = 0
+			if h.oaiID != "" {
+				m.OAIIdentifier = h.oaiID
+			}
+			return h.store.UpdateMapping(ctx, &m)
+		}
+
+		// the URL, URL type or r-component for this URN in this source has changed, or the mapping is back
+		old := m
+		if old.IsWithdrawn() {
+			old.URL, old.URLType = "", ""
+		}
+		m.URL = h.url
+		m.URLType = urlType
+		m.RComponent = u.RComponent
+		if h.oaiID != "" {
+			m.OAIIdentifier = h.oaiID
+		}
+		m.MissingRuns = 0
+		m.Withdrawn = time.Time{}
+		if err := h.store.UpdateMapping(ctx, &m); err != nil {
+			return err
+		}
+		h.seen[name] = struct{}{}
+		return h.store.InsertHistory(ctx, &History{
+			URN:         name,
+			RComponent:  u.RComponent,
+			URLOld:      old.URL,
+			URLNew:      h.url,
+			URLTypeOld:  old.URLType,
+			URLTypeNew:  urlType,
+			HarvestTime: h.now(),
+			SourceURL:   h.source.StartURL,
+			ArchivePage: archivedPage(ctx),
+		})
+	}
+
+	// new URN, or a URN we have already harvested from some other source
+	if err := h.store.InsertMapping(ctx, &Mapping{
+		URN:           name,
+		URL:           h.url,
+		SourceID:      h.source.ID,
+		URLType:       urlType,
+		RComponent:    u.RComponent,
+		OAIIdentifier: h.oaiID,
+	}); err != nil {
+		return err
+	}
+	h.seen[name] = struct{}{}
+	return h.store.InsertHistory(ctx, &History{
+		URN:         name,
+		RComponent:  u.RComponent,
+		URLNew:      h.url,
+		URLTypeNew:  urlType,
+		HarvestTime: h.now(),
+		SourceURL:   h.source.StartURL,
+		ArchivePage: archivedPage(ctx),
+	})
+}
+
+// markSeen records that a URN was written or confirmed by an earlier part of the harvest, as when resuming
+// a harvest from a checkpoint. Invalid URNs are ignored.
+func (h *Handler) markSeen(raw string) {
+	u, err := urn.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return
+	}
+	h.seen[u.Normalise().Name()] = struct{}{}
+}
+
+// WithdrawMissing handles the mappings of the source that were not written or confirmed by this handler,
+// which must have seen all records of a complete full harvest. Such a mapping is withdrawn once it has been
+// missing from the source's WithdrawAfter consecutive full harvests; until then its missing count is increased.
+// Withdrawn mappings stay in urn2url and get a history entry with an empty new URL.
+// It returns the number of mappings withdrawn. If WithdrawAfter is less than 1, nothing is done.
+func (h *Handler) WithdrawMissing(ctx context.Context) (int, error) {
+	if h.source.WithdrawAfter < 1 {
+		return 0, nil
+	}
+
+	mappings, err := h.store.SourceMappings(ctx, h.source.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	withdrawn := 0
+	for _, m := range mappings {
+		if _, ok := h.seen[m.URN]; ok || m.IsWithdrawn() {
+			continue
+		}
+
+		m.MissingRuns++
+		if m.MissingRuns < h.source.WithdrawAfter {
+			if err := h.store.UpdateMapping(ctx, &m); err != nil {
+				return withdrawn, err
+			}
+			continue
+		}
+
+		if err := h.withdraw(ctx, &m, ""); err != nil {
+			return withdrawn, err
+		}
+		h.logger.Log("source", h.source.Title, "msg", "mapping withdrawn", "urn", m.URN, "url", m.URL, "missing", m.MissingRuns)
+		withdrawn++
+	}
+	return withdrawn, nil
+}
+
+// Withdraw withdraws the mappings of the source harvested from the OAI-PMH record set with SetOAIIdentifier,
+// because the source reported it as deleted. Mappings that are already withdrawn are left alone.
+// It returns the number of mappings withdrawn.
+func (h *Handler) Withdraw(ctx context.Context) (int, error) {
+	if h.oaiID == "" {
+		return 0, nil
+	}
+
+	mappings, err := h.store.OAIMappings(ctx, h.source.ID, h.oaiID)
+	if err != nil {
+		return 0, err
+	}
+
+	withdrawn := 0
+	for _, m := range mappings {
+		if m.IsWithdrawn() {
+			continue
+		}
+		if err := h.withdraw(ctx, &m, archivedPage(ctx)); err != nil {
+			return withdrawn, err
+		}
+		h.logger.Log("source", h.source.Title, "msg", "mapping withdrawn", "urn", m.URN, "url", m.URL, "oai_identifier", h.oaiID)
+		withdrawn++
+	}
+	return withdrawn, nil
+}
+
+// withdraw marks a mapping as withdrawn and records a history entry with an empty new URL, linked to the archived
+// page that reported it deleted, if any.
+func (h *Handler) withdraw(ctx context.Context, m *Mapping, page string) error {
+	m.Withdrawn = h.now()
+	if err := h.store.UpdateMapping(ctx, m); err != nil {
+		return err
+	}
+	return h.store.InsertHistory(ctx, &History{
+		URN:         m.URN,
+		RComponent:  m.RComponent,
+		URLOld:      m.URL,
+		URLTypeOld:  m.URLType,
+		HarvestTime: m.Withdrawn,
+		SourceURL:   h.source.StartURL,
+		ArchivePage: page,
+	})
+}
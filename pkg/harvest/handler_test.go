@@ -0,0 +1,314 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store for tests.
+type memStore struct {
+	mappings []Mapping
+	history  []History
+}
+
+func (s *memStore) Mappings(ctx context.Context, urn string) ([]Mapping, error) {
+	var found []Mapping
+	for _, m := range s.mappings {
+		if m.URN == urn {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) SourceMappings(ctx context.Context, sourceID int) ([]Mapping, error) {
+	var found []Mapping
+	for _, m := range s.mappings {
+		if m.SourceID == sourceID {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) OAIMappings(ctx context.Context, sourceID int, identifier string) ([]Mapping, error) {
+	var found []Mapping
+	for _, m := range s.mappings {
+		if m.SourceID == sourceID && m.OAIIdentifier == identifier {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) InsertMapping(ctx context.Context, m *Mapping) error {
+	s.mappings = append(s.mappings, *m)
+	return nil
+}
+
+func (s *memStore) UpdateMapping(ctx context.Context, m *Mapping) error {
+	for i := range s.mappings {
+		if s.mappings[i].URN == m.URN && s.mappings[i].SourceID == m.SourceID {
+			s.mappings[i] = *m
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertHistory(ctx context.Context, h *History) error {
+	s.history = append(s.history, *h)
+	return nil
+}
+
+// url returns the URL of a source's mapping for a URN, or the empty string.
+func (s *memStore) url(urn string, sourceID int) string {
+	for _, m := range s.mappings {
+		if m.URN == urn && m.SourceID == sourceID {
+			return m.URL
+		}
+	}
+	return ""
+}
+
+var testSource = &Source{
+	ID:         1,
+	Title:      "test",
+	Format:     FormatOAIPMH,
+	StartURL:   "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc",
+	ResumeURL:  "http://example.com/oai?verb=ListRecords&resumptionToken=",
+	URLType:    URLTypeNormal,
+	URLPattern: `https?://example\.com/`,
+}
+
+func newTestHandler(t *testing.T, store Store) *Handler {
+	h, err := NewHandler(store, testSource, nil)
+	if err != nil {
+		t.Fatal("can't create handler:", err)
+	}
+	h.now = func() time.Time { return time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC) }
+	return h
+}
+
+func TestSetURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept bool
+	}{
+		{"http://example.com/handle/1", true},
+		{"https://example.com/handle/1", true},
+		{"http://example.org/handle/1", false},
+		{"see http://example.com/handle/1", false},
+		{"", false},
+	}
+
+	h := newTestHandler(t, &memStore{})
+	for _, test := range tests {
+		h.Reset()
+		h.SetURL(test.url)
+		if accepted := h.url != ""; accepted != test.accept {
+			t.Errorf("SetURL(%q): want accepted: %t, got: %t", test.url, test.accept, accepted)
+		}
+	}
+}
+
+func TestInvalidURLPattern(t *testing.T) {
+	if _, err := NewHandler(&memStore{}, &Source{Title: "broken", URLPattern: "(("}, nil); err == nil {
+		t.Error("expected error for invalid URL pattern, got nil")
+	}
+}
+
+func TestWriteURL(t *testing.T) {
+	ctx := context.Background()
+	urn := "URN:NBN:fi-fe2020100112342"
+	// stored in normal form
+	key := "urn:nbn:fi-fe2020100112342"
+
+	t.Run("incomplete", func(t *testing.T) {
+		h := newTestHandler(t, &memStore{})
+		h.SetURN(urn)
+		if err := h.WriteURL(ctx); !errors.Is(err, ErrIncompleteRecord) {
+			t.Errorf("want: %v, got: %v", ErrIncompleteRecord, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		h := newTestHandler(t, &memStore{})
+		h.SetURN("URN:NBN:fi fe123")
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); !errors.Is(err, ErrInvalidURN) {
+			t.Errorf("want: %v, got: %v", ErrInvalidURN, err)
+		}
+	})
+
+	t.Run("check digit", func(t *testing.T) {
+		store := &memStore{}
+		h := newTestHandler(t, store)
+		h.SetURN("URN:NBN:fi-fe2020100112345")
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); !errors.Is(err, ErrInvalidURN) {
+			t.Errorf("want: %v, got: %v", ErrInvalidURN, err)
+		}
+		if len(store.mappings) != 0 || len(store.history) != 0 {
+			t.Errorf("rejected URN written: %+v", store.mappings)
+		}
+	})
+
+	t.Run("new", func(t *testing.T) {
+		store := &memStore{}
+		h := newTestHandler(t, store)
+		h.SetURN(urn)
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if got := store.url(key, 1); got != "http://example.com/handle/1" {
+			t.Errorf("wrong URL, want: %q, got: %q", "http://example.com/handle/1", got)
+		}
+		if len(store.history) != 1 || store.history[0].URLOld != "" || store.history[0].SourceURL != testSource.StartURL {
+			t.Errorf("wrong history: %+v", store.history)
+		}
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		store := &memStore{mappings: []Mapping{{URN: key, URL: "http://example.com/handle/1", SourceID: 1}}}
+		h := newTestHandler(t, store)
+		h.SetURN(urn)
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(store.mappings) != 1 || len(store.history) != 0 {
+			t.Errorf("expected no changes, got mappings: %+v, history: %+v", store.mappings, store.history)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		store := &memStore{mappings: []Mapping{{URN: key, URL: "http://example.com/handle/1", SourceID: 1}}}
+		h := newTestHandler(t, store)
+		h.SetURN(urn)
+		h.SetURL("http://example.com/handle/2")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if got := store.url(key, 1); got != "http://example.com/handle/2" {
+			t.Errorf("wrong URL, want: %q, got: %q", "http://example.com/handle/2", got)
+		}
+		if len(store.history) != 1 || store.history[0].URLOld != "http://example.com/handle/1" {
+			t.Errorf("wrong history: %+v", store.history)
+		}
+	})
+
+	t.Run("components", func(t *testing.T) {
+		store := &memStore{}
+		h := newTestHandler(t, store)
+		h.SetURN(urn + "?+version=2?=lang=fi#abstract")
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(store.mappings) != 1 || store.mappings[0].URN != key || store.mappings[0].RComponent != "version=2" {
+			t.Errorf("wrong mappings: %+v", store.mappings)
+		}
+		if len(store.history) != 1 || store.history[0].RComponent != "version=2" {
+			t.Errorf("wrong history: %+v", store.history)
+		}
+
+		// same URL, different r-component
+		h.Reset()
+		h.SetURN(urn + "?+version=3")
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(store.mappings) != 1 || store.mappings[0].RComponent != "version=3" {
+			t.Errorf("r-component not updated: %+v", store.mappings)
+		}
+		if len(store.history) != 2 || store.history[1].URLOld != store.history[1].URLNew {
+			t.Errorf("wrong history: %+v", store.history)
+		}
+	})
+
+	t.Run("other source", func(t *testing.T) {
+		store := &memStore{mappings: []Mapping{{URN: key, URL: "http://example.org/1", SourceID: 2}}}
+		h := newTestHandler(t, store)
+		h.SetURN(urn)
+		h.SetURL("http://example.com/handle/1")
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if store.url(key, 2) != "http://example.org/1" || store.url(key, 1) != "http://example.com/handle/1" {
+			t.Errorf("wrong mappings: %+v", store.mappings)
+		}
+	})
+}
+
+func TestWithdrawMissing(t *testing.T) {
+	ctx := context.Background()
+	withdrawn := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	store := &memStore{mappings: []Mapping{
+		{URN: "urn:nbn:fi-seen", URL: "http://example.com/seen", SourceID: 1, MissingRuns: 1},
+		{URN: "urn:nbn:fi-missing", URL: "http://example.com/missing", SourceID: 1, MissingRuns: 1},
+		{URN: "urn:nbn:fi-new-missing", URL: "http://example.com/new-missing", SourceID: 1},
+		{URN: "urn:nbn:fi-withdrawn", URL: "http://example.com/withdrawn", SourceID: 1, MissingRuns: 2, Withdrawn: withdrawn},
+		{URN: "urn:nbn:fi-back", URL: "http://example.com/back", SourceID: 1, MissingRuns: 2, Withdrawn: withdrawn},
+		{URN: "urn:nbn:fi-other", URL: "http://example.org/other", SourceID: 2},
+	}}
+	src := *testSource
+	src.WithdrawAfter = 2
+	h, err := NewHandler(store, &src, nil)
+	if err != nil {
+		t.Fatal("can't create handler:", err)
+	}
+	h.now = func() time.Time { return time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC) }
+
+	for _, rec := range []Record{
+		{URN: "urn:nbn:fi-seen", URLs: []string{"http://example.com/seen"}},
+		{URN: "urn:nbn:fi-back", URLs: []string{"http://example.com/back"}},
+	} {
+		h.Reset()
+		h.SetURN(rec.URN)
+		h.SetURL(rec.URLs[0])
+		if err := h.WriteURL(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	n, err := h.WithdrawMissing(ctx)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n != 1 {
+		t.Errorf("wrong number of withdrawn mappings, want: %d, got: %d", 1, n)
+	}
+
+	want := []Mapping{
+		{URN: "urn:nbn:fi-seen", URL: "http://example.com/seen", SourceID: 1},
+		{URN: "urn:nbn:fi-missing", URL: "http://example.com/missing", SourceID: 1, MissingRuns: 2, Withdrawn: h.now()},
+		{URN: "urn:nbn:fi-new-missing", URL: "http://example.com/new-missing", SourceID: 1, MissingRuns: 1},
+		{URN: "urn:nbn:fi-withdrawn", URL: "http://example.com/withdrawn", SourceID: 1, MissingRuns: 2, Withdrawn: withdrawn},
+		{URN: "urn:nbn:fi-back", URL: "http://example.com/back", SourceID: 1, URLType: URLTypeNormal},
+		{URN: "urn:nbn:fi-other", URL: "http://example.org/other", SourceID: 2},
+	}
+	if !reflect.DeepEqual(store.mappings, want) {
+		t.Errorf("wrong mappings\nwant: %+v\n got: %+v", want, store.mappings)
+	}
+
+	wantHistory := []History{
+		{URN: "urn:nbn:fi-back", URLNew: "http://example.com/back", URLTypeNew: URLTypeNormal, HarvestTime: h.now(), SourceURL: src.StartURL},
+		{URN: "urn:nbn:fi-missing", URLOld: "http://example.com/missing", HarvestTime: h.now(), SourceURL: src.StartURL},
+	}
+	if !reflect.DeepEqual(store.history, wantHistory) {
+		t.Errorf("wrong history\nwant: %+v\n got: %+v", wantHistory, store.history)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		store := &memStore{mappings: []Mapping{{URN: "urn:nbn:fi-missing", URL: "http://example.com/missing", SourceID: 1, MissingRuns: 5}}}
+		h := newTestHandler(t, store)
+		if n, err := h.WithdrawMissing(ctx); n != 0 || err != nil || store.mappings[0].MissingRuns != 5 {
+			t.Errorf("withdrawal not disabled, got: %d, %v, mappings: %+v", n, err, store.mappings)
+		}
+	})
+}
@@ -0,0 +1,338 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/wvh/urn-harvester/pkg/archive"
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+	"github.com/wvh/urn-harvester/pkg/urn"
+)
+
+// defaultDelay is the default minimum time between consecutive requests to a host.
+const defaultDelay = 5 * time.Second
+
+// Record is one item harvested from a source: a URN and the candidate URLs found for it, in document order.
+// For OAI-PMH sources, OAIIdentifier is the identifier from the record header; a deleted record only has
+// an OAIIdentifier. URLType is set by formats whose records can have another URL type than their source.
+// Err is set for a record that could not be read, such as a malformed line, which is skipped with a warning.
+type Record struct {
+	URN           string
+	URLs          []string
+	OAIIdentifier string
+	Deleted       bool
+	URLType       URLType
+	Err           error
+}
+
+// Warning kinds.
+const (
+	WarnDuplicate  = "duplicate"
+	WarnIncomplete = "incomplete"
+	WarnExcluded   = "excluded"
+	WarnMalformed  = "malformed"
+)
+
+// Warning is a problem with a single record that does not stop the harvest.
+// Record is the 1-based position of the record in the source.
+type Warning struct {
+	Kind   string `json:"kind"`
+	Record int    `json:"record"`
+	URN    string `json:"urn"`
+	Msg    string `json:"msg"`
+}
+
+// Rejection is a record that was not written because its URN is invalid, for example because of a wrong
+// check digit. Rejections are kept apart from warnings so they can be reported back to the source.
+type Rejection struct {
+	Record int      `json:"record"`
+	URN    string   `json:"urn"`
+	URLs   []string `json:"urls,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+// Result summarises a harvest. Withdrawn is the number of mappings withdrawn because of deleted records or,
+// after a full harvest, because they went missing. Retries is the number of requests that were retried.
+type Result struct {
+	Records      int
+	Warnings     []Warning
+	Rejected     []Rejection
+	RejectedURLs []RejectedURL
+	Withdrawn    int
+	Retries      int
+
+	// changes made by a run, for notifications about held runs
+	changes []Change
+}
+
+// RecordReader iterates over the records of a source.
+// Its methods follow the Next, Err and Close pattern of pgx.Rows.
+type RecordReader interface {
+	// Next advances to the next record, returning false when there are no more records or an error occurred.
+	Next() bool
+	// Record returns the current record.
+	Record() *Record
+	// Err returns the error that stopped iteration, if any.
+	Err() error
+	// Close releases any resources held by the reader.
+	Close() error
+}
+
+// Harvester harvests sources over HTTP.
+type Harvester struct {
+	client     *http.Client
+	logger     log.Logger
+	delay      time.Duration
+	retryLimit time.Duration
+	now        func() time.Time
+	notifier   Notifier
+	archive    *archive.Archive
+}
+
+// New creates a harvester that fetches documents using the given HTTP client.
+// If client is nil, http.DefaultClient is used; if logger is nil, nothing is logged.
+//
+// The harvester sends requests through a copy of the client whose transport allows only one request at a time
+// to each host, with the harvester's delay between them, so it is safe to harvest several sources at once; see RunAll.
+// Requests that fail with a transient error are retried, see WithRetryLimit. The client's timeout applies to
+// each attempt.
+func New(client *http.Client, logger log.Logger, opts ...func(*Harvester)) *Harvester {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	hv := &Harvester{
+		client:     client,
+		logger:     logger,
+		delay:      defaultDelay,
+		retryLimit: defaultRetryLimit,
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(hv)
+	}
+
+	next := client.Transport
+	if hv.archive != nil {
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		next = &archiveTransport{next: next, archive: hv.archive, logger: hv.logger}
+	}
+	polite := *client
+	polite.Transport = newPoliteTransport(next, hv.delay)
+	hv.client = &polite
+	if hv.retryLimit > 0 {
+		hv.client = &http.Client{
+			Transport: &retryTransport{client: &polite, limit: hv.retryLimit, logger: hv.logger, wait: oaipmh.Sleep},
+			// redirects are followed by the inner client
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	return hv
+}
+
+// WithDelay sets the minimum time between consecutive requests to a host, such as pages of an OAI-PMH list.
+func WithDelay(d time.Duration) func(*Harvester) {
+	return func(hv *Harvester) {
+		hv.delay = d
+	}
+}
+
+// WithRetryLimit sets the total time the harvest of a source may spend waiting to retry requests that failed
+// with a network error or a temporary HTTP status such as 503. Waits grow exponentially, with jitter, and honour
+// the Retry-After header. Zero disables retries.
+func WithRetryLimit(d time.Duration) func(*Harvester) {
+	return func(hv *Harvester) {
+		hv.retryLimit = d
+	}
+}
+
+// open returns a record reader for the source's format. If since is not the zero time, formats that support it
+// only return records changed since then. OAI-PMH harvests continue from resume if it is not nil.
+func (hv *Harvester) open(ctx context.Context, src *Source, since time.Time, resume *checkpoint) (RecordReader, error) {
+	switch src.Format {
+	case FormatOAIPMH:
+		return hv.openOAIPMH(ctx, src, since, resume)
+	case FormatSwedish:
+		return hv.openSwedish(ctx, src)
+	case FormatOulu:
+		return hv.openOulu(ctx, src), nil
+	case FormatMARC:
+		return hv.openMARC(ctx, src)
+	case FormatCSV:
+		return hv.openTable(ctx, src, ',')
+	case FormatTSV:
+		return hv.openTable(ctx, src, '\t')
+	case FormatJSONL:
+		return hv.openJSONL(ctx, src)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, src.Format)
+	}
+}
+
+// Harvest reads all records of a source and writes their mappings to the store. Afterwards, mappings of the
+// source that were missing from the harvest are handled by Handler.WithdrawMissing.
+// See Run for harvesting in a transaction.
+func (hv *Harvester) Harvest(ctx context.Context, store Store, src *Source) (*Result, error) {
+	return hv.harvestSince(ctx, store, src, time.Time{}, nil)
+}
+
+// harvestSince reads the records of a source changed since the given time, or all records if since is zero,
+// and writes their mappings to the store. If p is not nil, it follows the pages of the harvest, and the harvest
+// continues from the checkpoint p resumes, if any.
+func (hv *Harvester) harvestSince(ctx context.Context, store Store, src *Source, since time.Time, p *progress) (*Result, error) {
+	logger := log.With(hv.logger, "source", src.Title)
+
+	h, err := NewHandler(store, src, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var resume *checkpoint
+	if p != nil && p.resume != nil {
+		resume = p.resume
+		for _, urn := range resume.State.Seen {
+			h.markSeen(urn)
+		}
+	}
+
+	ctx, budget := withRetryBudget(ctx, hv.retryLimit, logger)
+	ctx = withPageTracker(ctx, src.Title)
+	rr, err := hv.open(ctx, src, since, resume)
+	if err != nil {
+		logger.Log("msg", "harvest failed", "retries", budget.retries, "err", err)
+		return &Result{Retries: budget.retries}, err
+	}
+	defer rr.Close()
+
+	switch {
+	case resume != nil:
+		logger.Log("msg", "harvest resumed", "page", resume.Page)
+	case since.IsZero():
+		logger.Log("msg", "harvest started")
+	default:
+		logger.Log("msg", "harvest started", "since", since.Format(time.RFC3339))
+	}
+	res, err := hv.harvest(ctx, h, rr, logger, p)
+	res.Retries = budget.retries
+	if err == nil && since.IsZero() {
+		// a complete full harvest: mappings not seen have gone missing from the source
+		var n int
+		n, err = h.WithdrawMissing(ctx)
+		res.Withdrawn += n
+	}
+	if err != nil {
+		logger.Log("msg", "harvest failed", "records", res.Records, "retries", res.Retries, "err", err)
+		return res, err
+	}
+	logger.Log("msg", "harvest finished", "records", res.Records, "warnings", len(res.Warnings),
+		"rejected", len(res.Rejected), "withdrawn", res.Withdrawn, "retries", res.Retries)
+	return res, nil
+}
+
+// harvest feeds records from a reader into a format handler. Records with a URN that has already been written
+// during this harvest, incomplete and malformed records are skipped with a warning; records with an invalid URN
+// are rejected.
+// Deleted records withdraw the mappings harvested from them. If p is not nil, the result starts from the checkpoint
+// p resumes, and p is told where the pages of a pageReader start.
+func (hv *Harvester) harvest(ctx context.Context, h FormatHandler, rr RecordReader, logger log.Logger, p *progress) (*Result, error) {
+	var (
+		res  Result
+		seen = make(map[string]struct{})
+		page int
+	)
+	pr, paged := rr.(pageReader)
+	if p != nil {
+		p.restore(&res, seen)
+	}
+
+	warn := func(w Warning) {
+		res.Warnings = append(res.Warnings, w)
+		logger.Log("msg", w.Msg, "warning", w.Kind, "record", w.Record, "urn", w.URN)
+	}
+
+	for rr.Next() {
+		rec := rr.Record()
+		if p != nil && paged {
+			if n, token := pr.Page(); n != page {
+				page = n
+				p.startPage(n, pr.Set(), token, &res)
+			}
+			if pr.Set() != "" {
+				p.ids = append(p.ids, rec.OAIIdentifier)
+			}
+		}
+		res.Records++
+		if rec.Deleted {
+			h.Reset()
+			h.SetOAIIdentifier(rec.OAIIdentifier)
+			n, err := h.Withdraw(ctx)
+			if err != nil {
+				return &res, err
+			}
+			res.Withdrawn += n
+			continue
+		}
+		if rec.Err != nil {
+			warn(Warning{Kind: WarnMalformed, Record: res.Records, Msg: rec.Err.Error()})
+			continue
+		}
+		key := urnKey(rec.URN)
+		if _, ok := seen[key]; ok {
+			warn(Warning{Kind: WarnDuplicate, Record: res.Records, URN: rec.URN, Msg: "source has same URN multiple times"})
+			continue
+		}
+
+		h.Reset()
+		h.SetURN(rec.URN)
+		h.SetOAIIdentifier(rec.OAIIdentifier)
+		h.SetURLType(rec.URLType)
+		for _, url := range rec.URLs {
+			if !h.SetURL(url) {
+				res.RejectedURLs = append(res.RejectedURLs, RejectedURL{Record: res.Records, URN: rec.URN, URL: url})
+			}
+		}
+		if err := h.WriteURL(ctx); err != nil {
+			switch {
+			case errors.Is(err, ErrIncompleteRecord):
+				msg := "record has no acceptable URL"
+				if rec.URN == "" {
+					msg = "record has no URN"
+				}
+				warn(Warning{Kind: WarnIncomplete, Record: res.Records, URN: rec.URN, Msg: msg})
+				continue
+			case errors.Is(err, ErrInvalidURN):
+				res.Rejected = append(res.Rejected, Rejection{Record: res.Records, URN: rec.URN, URLs: rec.URLs, Reason: err.Error()})
+				logger.Log("msg", "record rejected", "record", res.Records, "urn", rec.URN, "err", err)
+				continue
+			case errors.Is(err, ErrExcluded):
+				warn(Warning{Kind: WarnExcluded, Record: res.Records, URN: rec.URN, Msg: "URN is owned by an excluded source"})
+				continue
+			}
+			return &res, err
+		}
+		seen[key] = struct{}{}
+		if p != nil {
+			p.seen = append(p.seen, rec.URN)
+		}
+	}
+	return &res, rr.Err()
+}
+
+// urnKey returns the key of a URN in the duplicate check of a harvest: the normal form of its name, as the
+// handler uses, so variants of a URN count as the same. Invalid URNs are their own key; they are rejected anyway.
+func urnKey(raw string) string {
+	if name, err := urn.Normalise(strings.TrimSpace(raw)); err == nil {
+		return name
+	}
+	return raw
+}
@@ -0,0 +1,157 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/wvh/urn-harvester/pkg/harvest/harvesttest"
+)
+
+// sliceReader is a RecordReader over a fixed list of records.
+type sliceReader struct {
+	records []Record
+	current *Record
+	err     error
+}
+
+func (r *sliceReader) Next() bool {
+	if len(r.records) == 0 {
+		return false
+	}
+	r.current, r.records = &r.records[0], r.records[1:]
+	return true
+}
+
+func (r *sliceReader) Record() *Record { return r.current }
+func (r *sliceReader) Err() error      { return r.err }
+func (r *sliceReader) Close() error    { return nil }
+
+func TestHarvestLoop(t *testing.T) {
+	store := &memStore{}
+	h := newTestHandler(t, store)
+	hv := New(nil, nil)
+
+	rr := &sliceReader{records: []Record{
+		{URN: "urn:nbn:fi-1", URLs: []string{"http://example.org/1", "http://example.com/1"}},
+		{URN: "urn:nbn:fi-2", URLs: []string{"http://example.org/2"}},
+		{URN: "urn:nbn:fi-1", URLs: []string{"http://example.com/duplicate"}},
+		{URN: " URN:NBN:FI-1?+pdf", URLs: []string{"http://example.com/variant"}},
+		{URN: "urn:nbn:fi-3", URLs: []string{"http://example.com/3a", "http://example.com/3b"}},
+		{URN: "URN:NBN:fi-fe3215", URLs: []string{"http://example.com/4"}},
+	}}
+
+	res, err := hv.harvest(context.Background(), h, rr, log.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := map[string]string{
+		"urn:nbn:fi-1": "http://example.com/1",
+		"urn:nbn:fi-2": "",
+		"urn:nbn:fi-3": "http://example.com/3b",
+	}
+	for urn, url := range want {
+		if got := store.url(urn, 1); got != url {
+			t.Errorf("wrong URL for %s, want: %q, got: %q", urn, url, got)
+		}
+	}
+	if len(store.mappings) != 2 {
+		t.Errorf("wrong number of mappings, want: %d, got: %d", 2, len(store.mappings))
+	}
+
+	if res.Records != 6 {
+		t.Errorf("wrong number of records, want: %d, got: %d", 6, res.Records)
+	}
+	wantWarnings := []Warning{
+		{Kind: WarnIncomplete, Record: 2, URN: "urn:nbn:fi-2", Msg: "record has no acceptable URL"},
+		{Kind: WarnDuplicate, Record: 3, URN: "urn:nbn:fi-1", Msg: "source has same URN multiple times"},
+		{Kind: WarnDuplicate, Record: 4, URN: " URN:NBN:FI-1?+pdf", Msg: "source has same URN multiple times"},
+	}
+	if !reflect.DeepEqual(res.Warnings, wantWarnings) {
+		t.Errorf("wrong warnings\nwant: %+v\n got: %+v", wantWarnings, res.Warnings)
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0].Record != 6 || res.Rejected[0].URN != "URN:NBN:fi-fe3215" {
+		t.Errorf("wrong rejections: %+v", res.Rejected)
+	}
+}
+
+func TestHarvestReaderError(t *testing.T) {
+	errBroken := errors.New("broken")
+	h := newTestHandler(t, &memStore{})
+	hv := New(nil, nil)
+
+	_, err := hv.harvest(context.Background(), h, &sliceReader{err: errBroken}, log.NewNopLogger(), nil)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("want: %v, got: %v", errBroken, err)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	hv := New(nil, nil)
+	_, err := hv.Harvest(context.Background(), &memStore{}, &Source{Title: "nope", Format: "Telex"})
+	if !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("want: %v, got: %v", ErrUnknownFormat, err)
+	}
+}
+
+func TestFakeRepositories(t *testing.T) {
+	records := []harvesttest.Record{
+		{Identifier: "oai:example.com:1", URN: "URN:NBN:fi:example-1", URLs: []string{"http://example.com/1"}},
+		{Identifier: "oai:example.com:2", URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.org/2", "http://example.com/2"}},
+		{Identifier: "oai:example.com:3", URN: "URN:NBN:fi:example-3", URLs: []string{"http://example.com/3"}},
+		{Identifier: "oai:example.com:4", URN: "URN:NBN:fi:example-4", URLs: []string{"http://example.com/4"}},
+		{Identifier: "oai:example.com:5", URN: "URN:NBN:fi:example-5", URLs: []string{"http://example.com/5"}},
+	}
+
+	tests := []struct {
+		format Format
+		repo   http.Handler
+	}{
+		{FormatOAIPMH, &harvesttest.OAIPMH{
+			Faults:   harvesttest.Faults{Throttle: 1, RetryAfter: 2 * time.Second},
+			Records:  records,
+			PageSize: 2,
+		}},
+		{FormatSwedish, &harvesttest.Swedish{Records: records}},
+		{FormatOulu, &harvesttest.Oulu{Records: records, PageSize: 2}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.format), func(t *testing.T) {
+			srv := httptest.NewServer(test.repo)
+			defer srv.Close()
+
+			src := *testSource
+			src.Format = test.format
+			src.StartURL = srv.URL + "/?verb=ListRecords&metadataPrefix=oai_dc"
+			src.ResumeURL = srv.URL + "/?verb=ListRecords&resumptionToken="
+
+			hv := New(srv.Client(), nil, WithDelay(0))
+			var waits []time.Duration
+			hv.client.Transport.(*retryTransport).wait = func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			store := &memStore{}
+			res, err := hv.Harvest(context.Background(), store, &src)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if res.Records != len(records) || len(store.mappings) != len(records) {
+				t.Errorf("want %d records and mappings, got: %+v, %+v", len(records), res, store.mappings)
+			}
+			if m := store.mappings[1]; m.URN != "urn:nbn:fi:example-2" || m.URL != "http://example.com/2" {
+				t.Errorf("wrong mapping: %+v", m)
+			}
+			if test.format == FormatOAIPMH && (res.Retries != 1 || len(waits) != 1 || waits[0] < 2*time.Second) {
+				t.Errorf("throttled request not retried after Retry-After, retries: %d, waits: %v", res.Retries, waits)
+			}
+		})
+	}
+}
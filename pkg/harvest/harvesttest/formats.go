@@ -0,0 +1,92 @@
+package harvesttest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Swedish is a fake repository in the record format of the Swedish URN resolver. Every request gets the dump of
+// all records, with an identifier element for the URN and a url element for each URL; empty values are left out.
+type Swedish struct {
+	Faults
+
+	Records []Record
+}
+
+func (s *Swedish) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.serve(w, r) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("<records>\n")
+	for i := range s.Records {
+		b.WriteString("  <record>" + urnAndURLs(&s.Records[i]) + "</record>\n")
+	}
+	b.WriteString("</records>\n")
+	writeXML(w, b.String())
+}
+
+// Oulu is a fake repository in the format of the University of Oulu repository. Lists are split into pages of
+// PageSize records, 10 by default; the page is selected by the resumptionToken argument.
+type Oulu struct {
+	Faults
+
+	Records  []Record
+	PageSize int
+}
+
+// ouluToken is the prefix of the Oulu resumption tokens, followed by the page number.
+const ouluToken = "oulu:page="
+
+func (o *Oulu) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.serve(w, r) {
+		return
+	}
+
+	size := o.PageSize
+	if size < 1 {
+		size = 10
+	}
+	page := 1
+	if token := r.URL.Query().Get("resumptionToken"); token != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(token, ouluToken))
+		if err != nil || !strings.HasPrefix(token, ouluToken) || n < 1 || (n-1)*size >= len(o.Records) {
+			http.Error(w, "bad resumption token", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+
+	start, end := (page-1)*size, page*size
+	if end > len(o.Records) {
+		end = len(o.Records)
+	}
+	var b strings.Builder
+	b.WriteString("<response>\n")
+	for i := start; i < end; i++ {
+		rec := &o.Records[i]
+		fmt.Fprintf(&b, "  <record><header><identifier>%s</identifier></header><metadata>%s</metadata></record>\n",
+			escape(rec.Identifier), urnAndURLs(rec))
+	}
+	token := ""
+	if end < len(o.Records) {
+		token = ouluToken + strconv.Itoa(page+1)
+	}
+	fmt.Fprintf(&b, "  <resumptionToken>%s</resumptionToken>\n</response>\n", escape(token))
+	writeXML(w, b.String())
+}
+
+// urnAndURLs returns an identifier element with the URN of a record and a url element for each of its URLs.
+func urnAndURLs(rec *Record) string {
+	var b strings.Builder
+	if rec.URN != "" {
+		fmt.Fprintf(&b, "<identifier>%s</identifier>", escape(rec.URN))
+	}
+	for _, u := range rec.URLs {
+		fmt.Fprintf(&b, "<url>%s</url>", escape(u))
+	}
+	return b.String()
+}
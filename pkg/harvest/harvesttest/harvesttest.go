@@ -0,0 +1,85 @@
+// Package harvesttest provides fake repositories for testing harvesters offline: http.Handlers that serve
+// OAI-PMH, Swedish and Oulu responses from a list of records, to be started with httptest.NewServer.
+//
+// Responses are deterministic: they depend only on the records, the configuration and the requests received.
+// Every handler can throttle its first requests with 503 Service Unavailable and accepts a hook to inject other
+// failures.
+package harvesttest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record is a record of a fake repository. The OAI-PMH fields are ignored by formats that don't have them.
+type Record struct {
+	// OAI-PMH header
+	Identifier string
+	Datestamp  time.Time
+	Sets       []string
+	Deleted    bool
+
+	URN  string
+	URLs []string
+
+	// Metadata holds the metadata element content of the record by metadata prefix. Records are served in oai_dc
+	// with the URN and URLs as dc:identifier values unless Metadata has an oai_dc entry. Records without metadata
+	// for another prefix are not listed in it.
+	Metadata map[string]string
+}
+
+// Faults makes a fake repository fail.
+type Faults struct {
+	// Throttle is the number of requests answered with 503 Service Unavailable before the repository answers
+	// normally. The responses have a Retry-After header of RetryAfter, rounded down to seconds, if it is set.
+	Throttle   int
+	RetryAfter time.Duration
+
+	// Hook, if set, is called with every request before it is answered. If it returns true, it has answered the
+	// request itself.
+	Hook func(w http.ResponseWriter, r *http.Request) bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// serve records a request and applies the faults, returning true if the request was answered.
+func (f *Faults) serve(w http.ResponseWriter, r *http.Request) bool {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	throttled := len(f.requests) <= f.Throttle
+	f.mu.Unlock()
+
+	if throttled {
+		if f.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter/time.Second)))
+		}
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return true
+	}
+	return f.Hook != nil && f.Hook(w, r)
+}
+
+// Requests returns the path and query of the requests received so far, in order.
+func (f *Faults) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// escape returns s with XML special characters escaped.
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writeXML writes an XML response.
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + body))
+}
@@ -0,0 +1,196 @@
+package harvesttest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+var testRecords = []Record{
+	{Identifier: "oai:example.com:1", Datestamp: day(1), Sets: []string{"a"}, URN: "URN:NBN:fi-fe1", URLs: []string{"http://example.com/1"}},
+	{Identifier: "oai:example.com:2", Datestamp: day(2), Sets: []string{"b"}, Deleted: true},
+	{Identifier: "oai:example.com:3", Datestamp: day(3), Sets: []string{"a:x"}, URN: "URN:NBN:fi-fe3", URLs: []string{"http://example.com/3"}},
+}
+
+func day(n int) time.Time {
+	return time.Date(2020, 10, n, 12, 0, 0, 0, time.UTC)
+}
+
+func get(t *testing.T, u string) (int, http.Header, string) {
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(b)
+}
+
+// list harvests records with the OAI-PMH client.
+func list(srv *httptest.Server, args string) ([]oaipmh.Record, error) {
+	rs := oaipmh.NewClient(srv.Client(), 0).ListRecords(context.Background(), srv.URL+"?verb=ListRecords&"+args,
+		srv.URL+"?verb=ListRecords&resumptionToken=")
+	defer rs.Close()
+	var recs []oaipmh.Record
+	for rs.Next() {
+		recs = append(recs, *rs.Record())
+	}
+	return recs, rs.Err()
+}
+
+func TestOAIPMH(t *testing.T) {
+	now := day(10)
+	repo := &OAIPMH{
+		Records:       testRecords,
+		Sets:          []Set{{"a", "Set A"}, {"b", "Set B"}},
+		PageSize:      2,
+		TokenLifetime: time.Hour,
+		Now:           func() time.Time { return now },
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	t.Run("pages", func(t *testing.T) {
+		recs, err := list(srv, "metadataPrefix=oai_dc")
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(recs) != 3 || !recs[1].Header.Deleted || recs[2].Identifiers[0] != "URN:NBN:fi-fe3" {
+			t.Errorf("wrong records: %+v", recs)
+		}
+	})
+
+	t.Run("selective", func(t *testing.T) {
+		tests := []struct {
+			args string
+			want int
+		}{
+			{"metadataPrefix=oai_dc&from=2020-10-02", 2},
+			{"metadataPrefix=oai_dc&until=2020-10-02", 2},
+			{"metadataPrefix=oai_dc&set=a", 2},
+			{"metadataPrefix=oai_dc&set=b", 1},
+		}
+		for _, test := range tests {
+			recs, err := list(srv, test.args)
+			if err != nil || len(recs) != test.want {
+				t.Errorf("%s: want %d records, got: %d, %v", test.args, test.want, len(recs), err)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			args string
+			want string
+		}{
+			{"metadataPrefix=marcxml", oaipmh.CodeCannotDisseminateFormat},
+			{"", oaipmh.CodeBadArgument},
+			{"metadataPrefix=oai_dc&from=2021-01-01", oaipmh.CodeNoRecordsMatch},
+			{"metadataPrefix=oai_dc&resumptionToken=token-1", oaipmh.CodeBadArgument},
+			{"resumptionToken=nonsense", oaipmh.CodeBadResumptionToken},
+		}
+		for _, test := range tests {
+			_, err := list(srv, test.args)
+			if !errors.Is(err, &oaipmh.Error{Code: test.want}) {
+				t.Errorf("%s: want: %s, got: %v", test.args, test.want, err)
+			}
+		}
+		_, _, body := get(t, srv.URL+"?verb=Nonsense")
+		if !strings.Contains(body, `code="badVerb"`) {
+			t.Errorf("bad verb accepted: %s", body)
+		}
+		if !strings.Contains(body, "<responseDate>2020-10-10T12:00:00Z</responseDate>") {
+			t.Errorf("response not dated by Now: %s", body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, _, body := get(t, srv.URL+"?verb=ListIdentifiers&metadataPrefix=oai_dc")
+		if !strings.Contains(body, `expirationDate="2020-10-10T13:00:00Z"`) {
+			t.Fatalf("no expiration date: %s", body)
+		}
+		i := strings.Index(body, "token-")
+		token := body[i : i+strings.Index(body[i:], "<")]
+
+		now = now.Add(2 * time.Hour)
+		defer func() { now = day(10) }()
+		if _, _, body := get(t, srv.URL+"?verb=ListIdentifiers&resumptionToken="+token); !strings.Contains(body, `code="badResumptionToken"`) {
+			t.Errorf("expired token accepted: %s", body)
+		}
+	})
+
+	t.Run("other verbs", func(t *testing.T) {
+		for args, want := range map[string]string{
+			"verb=Identify":            "<granularity>YYYY-MM-DD</granularity>",
+			"verb=ListSets":            "<setSpec>b</setSpec>",
+			"verb=ListMetadataFormats": "<metadataPrefix>oai_dc</metadataPrefix>",
+			"verb=GetRecord&identifier=oai:example.com:3&metadataPrefix=oai_dc": "<dc:identifier>http://example.com/3</dc:identifier>",
+			"verb=GetRecord&identifier=oai:example.com:9&metadataPrefix=oai_dc": `code="idDoesNotExist"`,
+		} {
+			if _, _, body := get(t, srv.URL+"?"+args); !strings.Contains(body, want) {
+				t.Errorf("%s: %q not found in %s", args, want, body)
+			}
+		}
+	})
+}
+
+func TestFaults(t *testing.T) {
+	repo := &Swedish{
+		Faults: Faults{
+			Throttle:   2,
+			RetryAfter: 3 * time.Second,
+			Hook: func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Path == "/broken" {
+					http.Error(w, "broken", http.StatusInternalServerError)
+					return true
+				}
+				return false
+			},
+		},
+		Records: testRecords,
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		if status, header, _ := get(t, srv.URL); status != http.StatusServiceUnavailable || header.Get("Retry-After") != "3" {
+			t.Errorf("request %d not throttled: %d %v", i+1, status, header)
+		}
+	}
+	if status, _, body := get(t, srv.URL); status != http.StatusOK || !strings.Contains(body, "<identifier>URN:NBN:fi-fe3</identifier><url>http://example.com/3</url>") {
+		t.Errorf("wrong response: %d %s", status, body)
+	}
+	if status, _, _ := get(t, srv.URL+"/broken"); status != http.StatusInternalServerError {
+		t.Errorf("hook not called, got status %d", status)
+	}
+	if reqs := repo.Requests(); len(reqs) != 4 || reqs[3] != "/broken" {
+		t.Errorf("wrong requests: %q", reqs)
+	}
+}
+
+func TestOulu(t *testing.T) {
+	srv := httptest.NewServer(&Oulu{Records: testRecords, PageSize: 2})
+	defer srv.Close()
+
+	_, _, body := get(t, srv.URL)
+	if !strings.Contains(body, "<resumptionToken>oulu:page=2</resumptionToken>") || strings.Contains(body, "fi-fe3") {
+		t.Errorf("wrong first page: %s", body)
+	}
+	_, _, body = get(t, srv.URL+"?resumptionToken=oulu:page=2")
+	if !strings.Contains(body, "<resumptionToken></resumptionToken>") || !strings.Contains(body, "fi-fe3") {
+		t.Errorf("wrong last page: %s", body)
+	}
+	if status, _, _ := get(t, srv.URL+"?resumptionToken=oulu:page=3"); status != http.StatusBadRequest {
+		t.Errorf("bad token accepted, got status %d", status)
+	}
+}
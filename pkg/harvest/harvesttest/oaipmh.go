@@ -0,0 +1,451 @@
+package harvesttest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata format of oai_dc, which every OAI-PMH repository supports.
+var formatDC = Format{
+	Prefix:    "oai_dc",
+	Schema:    "http://www.openarchives.org/OAI/2.0/oai_dc.xsd",
+	Namespace: "http://www.openarchives.org/OAI/2.0/oai_dc/",
+}
+
+// Format is a metadata format of an OAI-PMH repository.
+type Format struct {
+	Prefix    string
+	Schema    string
+	Namespace string
+}
+
+// Set is a set of an OAI-PMH repository.
+type Set struct {
+	Spec string
+	Name string
+}
+
+// OAIPMH is a fake OAI-PMH repository. It supports the Identify, ListMetadataFormats, ListSets, ListIdentifiers,
+// ListRecords and GetRecord verbs, including from, until and set arguments, and answers invalid requests with the
+// protocol's error codes. Lists are split into pages of PageSize records; resumption tokens expire after
+// TokenLifetime, if it is set, and are then answered with badResumptionToken. The zero value is an empty
+// repository with day granularity that serves oai_dc.
+type OAIPMH struct {
+	Faults
+
+	Name              string
+	AdminEmail        string
+	EarliestDatestamp time.Time
+	// DeletedRecord is the deleted record policy, "persistent" by default
+	DeletedRecord string
+	// Granularity is "YYYY-MM-DD" or "YYYY-MM-DDThh:mm:ssZ", the former by default
+	Granularity string
+
+	Records []Record
+	Sets    []Set
+	// Formats lists the metadata formats besides oai_dc.
+	Formats []Format
+
+	PageSize      int
+	TokenLifetime time.Duration
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]listState
+}
+
+// listState is the position in a list that a resumption token stands for.
+type listState struct {
+	args    url.Values
+	offset  int
+	expires time.Time
+}
+
+// oaiArgs are the arguments each verb accepts, and which of them are required.
+var oaiArgs = map[string]map[string]bool{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier": false},
+	"ListSets":            {"resumptionToken": false},
+	"ListIdentifiers":     {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+	"ListRecords":         {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+	"GetRecord":           {"identifier": true, "metadataPrefix": true},
+}
+
+func (o *OAIPMH) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+func (o *OAIPMH) granularity() string {
+	if o.Granularity == "" {
+		return "YYYY-MM-DD"
+	}
+	return o.Granularity
+}
+
+func (o *OAIPMH) datestamp(t time.Time) string {
+	if o.granularity() == "YYYY-MM-DD" {
+		return t.UTC().Format("2006-01-02")
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (o *OAIPMH) pageSize() int {
+	if o.PageSize < 1 {
+		return 10
+	}
+	return o.PageSize
+}
+
+func (o *OAIPMH) formats() []Format {
+	return append([]Format{formatDC}, o.Formats...)
+}
+
+// oaiError is an OAI-PMH error response.
+type oaiError struct {
+	code string
+	msg  string
+}
+
+// WriteOAIError writes an OAI-PMH error response of the repository, for use in hooks.
+func (o *OAIPMH) WriteOAIError(w http.ResponseWriter, code, msg string) {
+	writeXML(w, o.envelope("", fmt.Sprintf(`<error code="%s">%s</error>`, escape(code), escape(msg))))
+}
+
+func (o *OAIPMH) envelope(verb, body string) string {
+	req := "<request/>"
+	if verb != "" {
+		req = fmt.Sprintf(`<request verb="%s"/>`, escape(verb))
+	}
+	return `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <responseDate>` + o.now().UTC().Format(time.RFC3339) + `</responseDate>
+  ` + req + "\n" + body + "\n</OAI-PMH>\n"
+}
+
+func (o *OAIPMH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.serve(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		o.WriteOAIError(w, "badArgument", err.Error())
+		return
+	}
+
+	verb := r.Form.Get("verb")
+	body, oerr := o.answer(verb, r.Form)
+	if oerr != nil {
+		o.WriteOAIError(w, oerr.code, oerr.msg)
+		return
+	}
+	writeXML(w, o.envelope(verb, body))
+}
+
+// answer checks the arguments of a request and returns the verb element of the response.
+func (o *OAIPMH) answer(verb string, form url.Values) (string, *oaiError) {
+	allowed, ok := oaiArgs[verb]
+	if !ok {
+		return "", &oaiError{"badVerb", fmt.Sprintf("illegal verb: %q", verb)}
+	}
+	for arg, vals := range form {
+		if arg == "verb" {
+			continue
+		}
+		if _, ok := allowed[arg]; !ok || len(vals) > 1 {
+			return "", &oaiError{"badArgument", "illegal or repeated argument: " + arg}
+		}
+	}
+	if form.Get("resumptionToken") != "" {
+		if len(form) > 2 {
+			return "", &oaiError{"badArgument", "resumptionToken is an exclusive argument"}
+		}
+	} else {
+		for arg, required := range allowed {
+			if required && form.Get(arg) == "" {
+				return "", &oaiError{"badArgument", "missing argument: " + arg}
+			}
+		}
+	}
+
+	switch verb {
+	case "Identify":
+		return o.identify(), nil
+	case "ListMetadataFormats":
+		return o.listMetadataFormats(form.Get("identifier"))
+	case "ListSets":
+		return o.listSets(form)
+	case "GetRecord":
+		return o.getRecord(form.Get("identifier"), form.Get("metadataPrefix"))
+	default:
+		return o.list(verb, form)
+	}
+}
+
+func (o *OAIPMH) identify() string {
+	name, email, deleted := o.Name, o.AdminEmail, o.DeletedRecord
+	if name == "" {
+		name = "Test repository"
+	}
+	if email == "" {
+		email = "admin@example.com"
+	}
+	if deleted == "" {
+		deleted = "persistent"
+	}
+	return fmt.Sprintf(`<Identify>
+  <repositoryName>%s</repositoryName>
+  <baseURL>http://example.com/oai</baseURL>
+  <protocolVersion>2.0</protocolVersion>
+  <adminEmail>%s</adminEmail>
+  <earliestDatestamp>%s</earliestDatestamp>
+  <deletedRecord>%s</deletedRecord>
+  <granularity>%s</granularity>
+</Identify>`, escape(name), escape(email), o.datestamp(o.EarliestDatestamp), escape(deleted), o.granularity())
+}
+
+func (o *OAIPMH) listMetadataFormats(identifier string) (string, *oaiError) {
+	formats := o.formats()
+	if identifier != "" {
+		rec := o.find(identifier)
+		if rec == nil {
+			return "", &oaiError{"idDoesNotExist", identifier}
+		}
+		var own []Format
+		for _, f := range formats {
+			if _, ok := metadata(rec, f.Prefix); ok {
+				own = append(own, f)
+			}
+		}
+		if len(own) == 0 {
+			return "", &oaiError{"noMetadataFormats", identifier}
+		}
+		formats = own
+	}
+
+	var b strings.Builder
+	b.WriteString("<ListMetadataFormats>\n")
+	for _, f := range formats {
+		fmt.Fprintf(&b, "  <metadataFormat><metadataPrefix>%s</metadataPrefix><schema>%s</schema><metadataNamespace>%s</metadataNamespace></metadataFormat>\n",
+			escape(f.Prefix), escape(f.Schema), escape(f.Namespace))
+	}
+	b.WriteString("</ListMetadataFormats>")
+	return b.String(), nil
+}
+
+func (o *OAIPMH) listSets(form url.Values) (string, *oaiError) {
+	if form.Get("resumptionToken") != "" {
+		return "", &oaiError{"badResumptionToken", "sets are not paged"}
+	}
+	if len(o.Sets) == 0 {
+		return "", &oaiError{"noSetHierarchy", "repository has no sets"}
+	}
+	var b strings.Builder
+	b.WriteString("<ListSets>\n")
+	for _, s := range o.Sets {
+		fmt.Fprintf(&b, "  <set><setSpec>%s</setSpec><setName>%s</setName></set>\n", escape(s.Spec), escape(s.Name))
+	}
+	b.WriteString("</ListSets>")
+	return b.String(), nil
+}
+
+func (o *OAIPMH) getRecord(identifier, prefix string) (string, *oaiError) {
+	if !o.hasFormat(prefix) {
+		return "", &oaiError{"cannotDisseminateFormat", prefix}
+	}
+	rec := o.find(identifier)
+	if rec == nil {
+		return "", &oaiError{"idDoesNotExist", identifier}
+	}
+	md, ok := metadata(rec, prefix)
+	if !ok {
+		return "", &oaiError{"cannotDisseminateFormat", prefix}
+	}
+	return "<GetRecord>\n" + o.record(rec, md, true) + "</GetRecord>", nil
+}
+
+// list answers ListIdentifiers and ListRecords requests.
+func (o *OAIPMH) list(verb string, form url.Values) (string, *oaiError) {
+	args, offset := form, 0
+	if token := form.Get("resumptionToken"); token != "" {
+		o.mu.Lock()
+		st, ok := o.tokens[token]
+		o.mu.Unlock()
+		if !ok || (!st.expires.IsZero() && !o.now().Before(st.expires)) {
+			return "", &oaiError{"badResumptionToken", token}
+		}
+		args, offset = st.args, st.offset
+	}
+
+	prefix := args.Get("metadataPrefix")
+	if !o.hasFormat(prefix) {
+		return "", &oaiError{"cannotDisseminateFormat", prefix}
+	}
+	from, err := o.parseDatestamp(args.Get("from"), false)
+	if err != nil {
+		return "", &oaiError{"badArgument", "invalid from: " + args.Get("from")}
+	}
+	until, err := o.parseDatestamp(args.Get("until"), true)
+	if err != nil {
+		return "", &oaiError{"badArgument", "invalid until: " + args.Get("until")}
+	}
+	set := args.Get("set")
+	if set != "" && len(o.Sets) == 0 {
+		return "", &oaiError{"noSetHierarchy", "repository has no sets"}
+	}
+
+	var matched []int
+	for i := range o.Records {
+		rec := &o.Records[i]
+		if _, ok := metadata(rec, prefix); !ok && !rec.Deleted {
+			continue
+		}
+		if (!from.IsZero() && rec.Datestamp.Before(from)) || (!until.IsZero() && rec.Datestamp.After(until)) {
+			continue
+		}
+		if set != "" && !inSet(rec, set) {
+			continue
+		}
+		matched = append(matched, i)
+	}
+	if len(matched) == 0 {
+		return "", &oaiError{"noRecordsMatch", ""}
+	}
+	if offset >= len(matched) {
+		return "", &oaiError{"badResumptionToken", "past the end of the list"}
+	}
+
+	end := offset + o.pageSize()
+	if end > len(matched) {
+		end = len(matched)
+	}
+	var b strings.Builder
+	b.WriteString("<" + verb + ">\n")
+	for _, i := range matched[offset:end] {
+		rec := &o.Records[i]
+		md, _ := metadata(rec, prefix)
+		b.WriteString(o.record(rec, md, verb == "ListRecords"))
+	}
+	switch {
+	case end < len(matched):
+		token, expires := o.newToken(args, end)
+		exp := ""
+		if !expires.IsZero() {
+			exp = fmt.Sprintf(` expirationDate="%s"`, expires.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintf(&b, `  <resumptionToken%s completeListSize="%d" cursor="%d">%s</resumptionToken>`+"\n",
+			exp, len(matched), offset, token)
+	case offset > 0:
+		fmt.Fprintf(&b, `  <resumptionToken completeListSize="%d" cursor="%d"/>`+"\n", len(matched), offset)
+	}
+	b.WriteString("</" + verb + ">")
+	return b.String(), nil
+}
+
+func (o *OAIPMH) newToken(args url.Values, offset int) (string, time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.tokens == nil {
+		o.tokens = make(map[string]listState)
+	}
+	st := listState{args: args, offset: offset}
+	if o.TokenLifetime > 0 {
+		st.expires = o.now().Add(o.TokenLifetime)
+	}
+	token := fmt.Sprintf("token-%d", len(o.tokens)+1)
+	o.tokens[token] = st
+	return token, st.expires
+}
+
+// record returns a record element, or only its header.
+func (o *OAIPMH) record(rec *Record, md string, full bool) string {
+	var b strings.Builder
+	status := ""
+	if rec.Deleted {
+		status = ` status="deleted"`
+	}
+	fmt.Fprintf(&b, "<header%s><identifier>%s</identifier><datestamp>%s</datestamp>", status, escape(rec.Identifier),
+		o.datestamp(rec.Datestamp))
+	for _, s := range rec.Sets {
+		fmt.Fprintf(&b, "<setSpec>%s</setSpec>", escape(s))
+	}
+	b.WriteString("</header>")
+	if !full {
+		return "  " + b.String() + "\n"
+	}
+	if !rec.Deleted {
+		b.WriteString("<metadata>" + md + "</metadata>")
+	}
+	return "  <record>" + b.String() + "</record>\n"
+}
+
+// metadata returns the metadata of a record in a format.
+func metadata(rec *Record, prefix string) (string, bool) {
+	if md, ok := rec.Metadata[prefix]; ok {
+		return md, true
+	}
+	if prefix != formatDC.Prefix {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(`<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	for _, id := range append([]string{rec.URN}, rec.URLs...) {
+		if id != "" {
+			fmt.Fprintf(&b, "<dc:identifier>%s</dc:identifier>", escape(id))
+		}
+	}
+	b.WriteString("</oai_dc:dc>")
+	return b.String(), true
+}
+
+func (o *OAIPMH) find(identifier string) *Record {
+	for i := range o.Records {
+		if o.Records[i].Identifier == identifier {
+			return &o.Records[i]
+		}
+	}
+	return nil
+}
+
+func (o *OAIPMH) hasFormat(prefix string) bool {
+	for _, f := range o.formats() {
+		if f.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// inSet reports whether a record is in a set or one of its subsets.
+func inSet(rec *Record, spec string) bool {
+	for _, s := range rec.Sets {
+		if s == spec || strings.HasPrefix(s, spec+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDatestamp parses a from or until argument in the repository's granularity. An until day includes the
+// whole day.
+func (o *OAIPMH) parseDatestamp(s string, until bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if len(s) == len("2006-01-02") {
+		t, err := time.Parse("2006-01-02", s)
+		if err == nil && until {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, err
+	}
+	if o.granularity() == "YYYY-MM-DD" {
+		return time.Time{}, fmt.Errorf("finer granularity than the repository's")
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,259 @@
+package harvest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ISO 2709 delimiters.
+const (
+	marcSubfieldDelimiter = 0x1f
+	marcFieldTerminator   = 0x1e
+	marcRecordTerminator  = 0x1d
+)
+
+// marcReader reads a dump of MARC records, such as a national bibliography, in ISO 2709 (MARC21 binary) or
+// MARCXML. The URN and URLs of each record are read as for the marcxml OAI-PMH metadata format, with the
+// source's landing page rules. The dump is a single document, which can be gzip compressed; the format and
+// compression are detected from its content.
+//
+// ISO 2709 records in MARC-8 are read as they are, which is enough for URNs and URLs, as those are ASCII.
+type marcReader struct {
+	body   io.Closer
+	next   func() (*marcRecord, error)
+	rules  []FieldRule
+	record Record
+	err    error
+}
+
+// openMARC opens the dump of a MARC source. StartURL is the URL of the dump, or the path of a local file, see
+// openDocument.
+func (hv *Harvester) openMARC(ctx context.Context, src *Source) (RecordReader, error) {
+	body, err := hv.openDocument(ctx, src.StartURL)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := src.Rules.LandingPage
+	if len(rules) == 0 {
+		rules = metadataFormats["marcxml"].landingPage
+	}
+	return newMARCReader(body, rules, func(xmlBody io.ReadCloser) io.ReadCloser {
+		return hv.sanitize(src.StartURL, xmlBody)
+	}), nil
+}
+
+// newMARCReader detects the format of a dump and starts reading it. MARCXML is passed through sanitize, if it
+// is not nil.
+func newMARCReader(body io.ReadCloser, rules []FieldRule, sanitize func(io.ReadCloser) io.ReadCloser) *marcReader {
+	r := &marcReader{body: body, rules: rules}
+	br := bufio.NewReader(body)
+
+	// MARCXML starts with a tag, possibly after a byte order mark and white space; ISO 2709 with the digits of
+	// the record length
+	head, _ := br.Peek(512)
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if len(head) > 0 && head[0] == '<' {
+		var xmlBody io.ReadCloser = &readCloser{Reader: br, Closer: body}
+		if sanitize != nil {
+			xmlBody = sanitize(xmlBody)
+		}
+		r.next = marcXMLRecords(newDecoder(xmlBody))
+	} else {
+		r.next = iso2709Records(br)
+	}
+	return r
+}
+
+// Next advances to the next record. Records without a URN or URL are returned as they are, and malformed ISO
+// 2709 records with an error, so the harvester can report them.
+func (r *marcReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	rec, err := r.next()
+	switch {
+	case errors.Is(err, errBadISO2709):
+		r.record = Record{Err: err}
+		return true
+	case err == io.EOF:
+		return false
+	case err != nil:
+		r.err = err
+		return false
+	}
+	urn, urls := marcURNAndURLs(rec)
+	r.record = Record{URN: urn, URLs: landingPages(urls, r.rules)}
+	return true
+}
+
+func (r *marcReader) Record() *Record {
+	return &r.record
+}
+
+func (r *marcReader) Err() error {
+	return r.err
+}
+
+func (r *marcReader) Close() error {
+	return r.body.Close()
+}
+
+// marcXMLRecords returns a function that reads the next record element of a MARCXML document, at any depth,
+// returning io.EOF at the end of the document.
+func marcXMLRecords(dec *xml.Decoder) func() (*marcRecord, error) {
+	return func() (*marcRecord, error) {
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "record" {
+				var rec marcRecord
+				if err := dec.DecodeElement(&rec, &start); err != nil {
+					return nil, err
+				}
+				return &rec, nil
+			}
+		}
+	}
+}
+
+// errBadISO2709 means an ISO 2709 record is malformed.
+var errBadISO2709 = errors.New("malformed ISO 2709 record")
+
+// maxISO2709 is the length of the longest ISO 2709 record, which has five digits for it in its leader.
+const maxISO2709 = 99999
+
+// iso2709Records returns a function that reads the next ISO 2709 record, returning io.EOF at the end of the
+// input. Line breaks between records are skipped. A record is read up to its record terminator, so a malformed
+// record is returned as an errBadISO2709 with its number and byte offset, and the next call reads the record
+// after it.
+func iso2709Records(br *bufio.Reader) func() (*marcRecord, error) {
+	var (
+		n      int
+		offset int64
+	)
+	return func() (*marcRecord, error) {
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != '\n' && b != '\r' {
+				br.UnreadByte()
+				break
+			}
+			offset++
+		}
+		n++
+
+		start := offset
+		data, size, err := readISO2709(br)
+		offset += size
+		bad := func(format string, args ...interface{}) (*marcRecord, error) {
+			return nil, fmt.Errorf("record %d at offset %d: %w: %s", n, start, errBadISO2709, fmt.Sprintf(format, args...))
+		}
+		switch {
+		case err == io.EOF:
+			return bad("no record terminator")
+		case err != nil:
+			return nil, err
+		case len(data) > maxISO2709:
+			return bad("longer than %d bytes", maxISO2709)
+		case len(data) < 24:
+			return bad("shorter than its leader")
+		}
+
+		leader := data[:24]
+		length, ok1 := iso2709Number(leader[0:5])
+		base, ok2 := iso2709Number(leader[12:17])
+		if !ok1 || !ok2 || base <= 24 || base >= len(data) || length != len(data) {
+			return bad("invalid leader %q", leader)
+		}
+		rec, err := parseISO2709(data, base)
+		if err != nil {
+			return bad("%s", err)
+		}
+		return rec, nil
+	}
+}
+
+// readISO2709 reads up to and including the next record terminator, returning what it read and its size. Only
+// the first maxISO2709+1 bytes of a longer record are kept. The error is io.EOF if the input ends before a
+// terminator.
+func readISO2709(br *bufio.Reader) ([]byte, int64, error) {
+	var (
+		data []byte
+		size int64
+	)
+	for {
+		chunk, err := br.ReadSlice(marcRecordTerminator)
+		size += int64(len(chunk))
+		if len(data) <= maxISO2709 {
+			if rest := maxISO2709 + 1 - len(data); len(chunk) > rest {
+				chunk = chunk[:rest]
+			}
+			data = append(data, chunk...)
+		}
+		if err != bufio.ErrBufferFull {
+			return data, size, err
+		}
+	}
+}
+
+// iso2709Number parses a number of the leader or directory, which is all ASCII digits: no sign or spaces.
+func iso2709Number(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, len(b) > 0
+}
+
+// parseISO2709 parses the directory and data fields of a record whose data starts at base. Control fields
+// are skipped.
+func parseISO2709(data []byte, base int) (*marcRecord, error) {
+	if data[len(data)-1] != marcRecordTerminator {
+		return nil, errors.New("no record terminator")
+	}
+	if data[base-1] != marcFieldTerminator || (base-1-24)%12 != 0 {
+		return nil, errors.New("invalid directory")
+	}
+
+	var rec marcRecord
+	for dir := data[24 : base-1]; len(dir) > 0; dir = dir[12:] {
+		tag := string(dir[0:3])
+		length, ok1 := iso2709Number(dir[3:7])
+		start, ok2 := iso2709Number(dir[7:12])
+		if !ok1 || !ok2 || length < 1 || base+start+length > len(data)-1 {
+			return nil, fmt.Errorf("invalid directory entry %q", dir[:12])
+		}
+		if tag < "010" {
+			continue
+		}
+		field := bytes.TrimSuffix(data[base+start:base+start+length], []byte{marcFieldTerminator})
+		if len(field) < 2 {
+			return nil, fmt.Errorf("field %s: no indicators", tag)
+		}
+
+		df := marcDatafield{Tag: tag, Ind1: string(field[0]), Ind2: string(field[1])}
+		subfields := bytes.Split(field[2:], []byte{marcSubfieldDelimiter})
+		for _, sf := range subfields[1:] {
+			if len(sf) == 0 {
+				continue
+			}
+			df.Subfields = append(df.Subfields, marcSubfield{Code: string(sf[0]), Value: string(sf[1:])})
+		}
+		rec.Datafields = append(rec.Datafields, df)
+	}
+	return &rec, nil
+}
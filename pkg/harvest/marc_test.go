@@ -0,0 +1,205 @@
+package harvest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// iso2709 encodes a record with a control field 001 and the given data fields, each written as indicators
+// followed by subfields separated by "$", such as "40$uhttp://example.com/1".
+func iso2709(fields ...[2]string) []byte {
+	var dir, data bytes.Buffer
+	add := func(tag, field string) {
+		fmt.Fprintf(&dir, "%s%04d%05d", tag, len(field)+1, data.Len())
+		data.WriteString(field)
+		data.WriteByte(marcFieldTerminator)
+	}
+	add("001", "123")
+	for _, f := range fields {
+		add(f[0], strings.ReplaceAll(f[1], "$", string(rune(marcSubfieldDelimiter))))
+	}
+	dir.WriteByte(marcFieldTerminator)
+	data.WriteByte(marcRecordTerminator)
+
+	base := 24 + dir.Len()
+	leader := fmt.Sprintf("%05dnam a22%05d i 4500", base+data.Len(), base)
+	return []byte(leader + dir.String() + data.String())
+}
+
+var testISO2709 = [][]byte{
+	iso2709(
+		[2]string{"024", "7 $aURN:NBN:fi-fe3214$2urn"},
+		[2]string{"856", "42$3Cover$uhttp://example.com/cover/1.jpg"},
+		[2]string{"856", "40$uhttp://example.com/handle/1"},
+	),
+	iso2709([2]string{"856", "40$uURN:NBN:fi:example-2$uhttp://example.com/handle/2"}),
+	iso2709([2]string{"245", "10$aNo identifiers"}),
+}
+
+// testMARCXMLDump holds the records of testISO2709.
+const testMARCXMLDump = `<?xml version="1.0" encoding="UTF-8"?>
+<collection xmlns="http://www.loc.gov/MARC21/slim">
+<record>
+  <leader>00000nam a2200000 i 4500</leader>
+  <controlfield tag="001">123</controlfield>
+  <datafield tag="024" ind1="7" ind2=" ">
+    <subfield code="a">URN:NBN:fi-fe3214</subfield>
+    <subfield code="2">urn</subfield>
+  </datafield>
+  <datafield tag="856" ind1="4" ind2="2">
+    <subfield code="3">Cover</subfield>
+    <subfield code="u">http://example.com/cover/1.jpg</subfield>
+  </datafield>
+  <datafield tag="856" ind1="4" ind2="0">
+    <subfield code="u">http://example.com/handle/1</subfield>
+  </datafield>
+</record>
+<record>
+  <datafield tag="856" ind1="4" ind2="0">
+    <subfield code="u">URN:NBN:fi:example-2</subfield>
+    <subfield code="u">http://example.com/handle/2</subfield>
+  </datafield>
+</record>
+<record>
+  <datafield tag="245" ind1="1" ind2="0"><subfield code="a">No identifiers</subfield></datafield>
+</record>
+</collection>`
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestMARC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	iso := bytes.Join(testISO2709, []byte("\n"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "dump.mrc"), iso, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dumps := map[string][]byte{
+		"/dump.mrc.gz": gzipped(iso),
+		"/dump.xml":    []byte(testMARCXMLDump),
+		"/dump.xml.gz": gzipped([]byte(testMARCXMLDump)),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(dumps[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	want := []Record{
+		// the default landing page rules prefer 856 with second indicator 0
+		{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/handle/1"}},
+		{URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/handle/2"}},
+		{},
+	}
+	hv := New(srv.Client(), nil, WithDelay(0))
+	for _, startURL := range []string{
+		filepath.Join(dir, "dump.mrc"),
+		"file://" + filepath.Join(dir, "dump.mrc"),
+		srv.URL + "/dump.mrc.gz",
+		srv.URL + "/dump.xml",
+		srv.URL + "/dump.xml.gz",
+	} {
+		rr, err := hv.openMARC(context.Background(), &Source{StartURL: startURL})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", startURL, err)
+			continue
+		}
+		var got []Record
+		for rr.Next() {
+			got = append(got, *rr.Record())
+		}
+		rr.Close()
+		if err := rr.Err(); err != nil {
+			t.Errorf("%s: unexpected error: %v", startURL, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\nwant: %+v\n got: %+v", startURL, want, got)
+		}
+	}
+}
+
+func TestMARCHarvest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipped(bytes.Join(append(testISO2709, []byte("garbage\x1d")), nil)))
+	}))
+	defer srv.Close()
+
+	src := *testSource
+	src.Format = FormatMARC
+	src.StartURL = srv.URL + "/dump.mrc.gz"
+	store := &memStore{}
+	res, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), store, &src)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if res.Records != 4 || len(res.Warnings) != 2 || res.Warnings[0].Kind != WarnIncomplete || res.Warnings[1].Kind != WarnMalformed {
+		t.Errorf("wrong result, want 4 records, 1 incomplete and 1 malformed, got: %+v", res)
+	}
+	if got := store.url("urn:nbn:fi-fe3214", 1); got != "http://example.com/handle/1" {
+		t.Errorf("wrong URL, want: %q, got: %q", "http://example.com/handle/1", got)
+	}
+}
+
+func TestMARCMalformed(t *testing.T) {
+	good := testISO2709[0]
+	badLeader := append([]byte("abcde"), good[5:]...)
+	badDirectory := append([]byte{}, good...)
+	badDirectory[24+3] = 'x'
+	tooLong := append(bytes.Repeat([]byte("0"), maxISO2709+1), marcRecordTerminator)
+	signedLeader := append([]byte(fmt.Sprintf("+%04d", len(good))), good[5:]...)
+	// the start of the last directory entry, a data field, before the start of the data
+	negativeStart := append([]byte{}, good...)
+	base, _ := iso2709Number(good[12:17])
+	copy(negativeStart[base-1-12+7:], "-9999")
+
+	wantGood := Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/cover/1.jpg", "http://example.com/handle/1"}}
+	for name, input := range map[string][]byte{
+		"bad leader":     badLeader,
+		"bad directory":  badDirectory,
+		"too long":       tooLong,
+		"signed leader":  signedLeader,
+		"negative start": negativeStart,
+	} {
+		dump := bytes.Join([][]byte{good, input, good}, []byte("\n"))
+		got, err := readRecords(newMARCReader(ioutil.NopCloser(bytes.NewReader(dump)), nil, nil))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if len(got) != 3 || !reflect.DeepEqual(got[0], wantGood) || !reflect.DeepEqual(got[2], wantGood) {
+			t.Errorf("%s: records around the malformed one not read: %+v", name, got)
+			continue
+		}
+		prefix := fmt.Sprintf("record 2 at offset %d: ", len(good)+1)
+		if err := got[1].Err; !errors.Is(err, errBadISO2709) || !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("%s: want %v in %q, got: %v", name, errBadISO2709, prefix, err)
+		}
+	}
+
+	// a truncated record at the end of the dump
+	got, err := readRecords(newMARCReader(ioutil.NopCloser(bytes.NewReader(append(append([]byte{}, good...), good[:len(good)-10]...))), nil, nil))
+	if err != nil || len(got) != 2 || !errors.Is(got[1].Err, errBadISO2709) || !strings.Contains(got[1].Err.Error(), "no record terminator") {
+		t.Errorf("truncated: want %v for record 2, got: %+v, err: %v", errBadISO2709, got, err)
+	}
+}
@@ -0,0 +1,331 @@
+package harvest
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// metadataFormat extracts the URN and candidate URLs of OAI-PMH records from metadata in a format richer than
+// Dublin Core. Every candidate URL comes with the field it was found in, so the landing page can be chosen by
+// field; see Rules.LandingPage.
+type metadataFormat struct {
+	// extract reads the metadata element of a record, consuming it up to and including its end element
+	extract func(dec *xml.Decoder, start xml.StartElement) (string, []fieldURL, error)
+	// landing page rules used when the source has none
+	landingPage []FieldRule
+}
+
+// metadataFormats are the metadata formats that can be harvested besides oai_dc, by metadata prefix.
+var metadataFormats = map[string]*metadataFormat{
+	"marcxml": {
+		extract: extractMARC,
+		landingPage: []FieldRule{
+			{Field: "856", Match: map[string]string{"ind2": "0"}},
+			{Field: "856", Match: map[string]string{"ind2": "1"}},
+		},
+	},
+	"mods": {
+		extract: extractMODS,
+		landingPage: []FieldRule{
+			{Field: "url", Match: map[string]string{"usage": "primary display"}},
+			{Field: "url", Match: map[string]string{"access": "object in context"}},
+		},
+	},
+	"oai_datacite": {
+		extract: extractDataCite,
+		landingPage: []FieldRule{
+			{Field: "alternateIdentifier", Match: map[string]string{"alternateIdentifierType": "URL"}},
+		},
+	},
+}
+
+// SupportsMetadataPrefix reports whether OAI-PMH records can be harvested in the metadata format of a prefix.
+func SupportsMetadataPrefix(prefix string) bool {
+	return prefix == "oai_dc" || metadataFormats[prefix] != nil
+}
+
+// fieldURL is a candidate URL and the field it was found in. Attrs holds the attributes of the field that
+// landing page rules can match, such as MARC indicators and subfields or MODS url attributes.
+type fieldURL struct {
+	URL   string
+	Field string
+	Attrs map[string]string
+}
+
+// parser returns a metadata parser for the OAI-PMH client that turns metadata into a Record, choosing its URLs
+// with the given landing page rules, or the format's own if there are none.
+func (f *metadataFormat) parser(rules []FieldRule) func(*xml.Decoder, xml.StartElement) (interface{}, error) {
+	if len(rules) == 0 {
+		rules = f.landingPage
+	}
+	return func(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+		urn, urls, err := f.extract(dec, start)
+		if err != nil {
+			return nil, err
+		}
+		return Record{URN: urn, URLs: landingPages(urls, rules)}, nil
+	}
+}
+
+// landingPages returns the URLs found in the field of the first rule that matches any of them, in document order.
+// If no rule matches, all URLs are returned.
+func landingPages(urls []fieldURL, rules []FieldRule) []string {
+	for _, rule := range rules {
+		var matched []string
+		for _, u := range urls {
+			if rule.matches(u) {
+				matched = append(matched, u.URL)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+
+	var all []string
+	for _, u := range urls {
+		all = append(all, u.URL)
+	}
+	return all
+}
+
+// matches reports whether a URL was found in the rule's field and has the attribute values it asks for.
+// Values are compared without regard to case.
+func (rule *FieldRule) matches(u fieldURL) bool {
+	if u.Field != rule.Field {
+		return false
+	}
+	for name, value := range rule.Match {
+		if !strings.EqualFold(u.Attrs[name], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// isURN reports whether an identifier is a URN rather than a URL.
+func isURN(id string) bool {
+	return strings.HasPrefix(strings.ToLower(id), "urn:")
+}
+
+// isHTTPURL reports whether an identifier is an HTTP or HTTPS URL.
+func isHTTPURL(id string) bool {
+	id = strings.ToLower(id)
+	return strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://")
+}
+
+// marcRecord is the data fields of a MARC record, as read from MARCXML or ISO 2709. Namespaces are ignored, as
+// not all repositories declare them.
+type marcRecord struct {
+	Datafields []marcDatafield `xml:"datafield"`
+}
+
+type marcDatafield struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// extractMARC reads the URN and URLs of a MARCXML record, see marcURNAndURLs. A collection element is read as its
+// first record.
+func extractMARC(dec *xml.Decoder, start xml.StartElement) (string, []fieldURL, error) {
+	var rec marcRecord
+	if start.Name.Local == "collection" {
+		var coll struct {
+			Records []marcRecord `xml:"record"`
+		}
+		if err := dec.DecodeElement(&coll, &start); err != nil {
+			return "", nil, err
+		}
+		if len(coll.Records) == 0 {
+			return "", nil, nil
+		}
+		rec = coll.Records[0]
+	} else if err := dec.DecodeElement(&rec, &start); err != nil {
+		return "", nil, err
+	}
+	urn, urls := marcURNAndURLs(&rec)
+	return urn, urls, nil
+}
+
+// marcURNAndURLs returns the URN of a MARC record from field 024 with source "urn" in subfield 2, and the URLs
+// from subfield u of the 856 fields. A URN in 856 $u counts as the record's URN. Landing page rules match 856
+// fields by their indicators, as ind1 and ind2, and the first value of their other subfields, by code.
+func marcURNAndURLs(rec *marcRecord) (string, []fieldURL) {
+	var (
+		urn  string
+		urls []fieldURL
+	)
+	for _, df := range rec.Datafields {
+		switch df.Tag {
+		case "024":
+			var value, source string
+			for _, sf := range df.Subfields {
+				switch sf.Code {
+				case "a":
+					value = strings.TrimSpace(sf.Value)
+				case "2":
+					source = strings.TrimSpace(sf.Value)
+				}
+			}
+			if value != "" && (strings.EqualFold(source, "urn") || isURN(value)) {
+				urn = value
+			}
+		case "856":
+			attrs := map[string]string{"ind1": strings.TrimSpace(df.Ind1), "ind2": strings.TrimSpace(df.Ind2)}
+			var values []string
+			for _, sf := range df.Subfields {
+				value := strings.TrimSpace(sf.Value)
+				if sf.Code == "u" {
+					if value != "" {
+						values = append(values, value)
+					}
+					continue
+				}
+				if _, ok := attrs[sf.Code]; !ok {
+					attrs[sf.Code] = value
+				}
+			}
+			for _, value := range values {
+				if isURN(value) {
+					urn = value
+				} else {
+					urls = append(urls, fieldURL{URL: value, Field: "856", Attrs: attrs})
+				}
+			}
+		}
+	}
+	return urn, urls
+}
+
+// modsRecord is a MODS record.
+type modsRecord struct {
+	Identifiers []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"identifier"`
+	Locations []struct {
+		URLs []struct {
+			Usage        string `xml:"usage,attr"`
+			Access       string `xml:"access,attr"`
+			DisplayLabel string `xml:"displayLabel,attr"`
+			Note         string `xml:"note,attr"`
+			Value        string `xml:",chardata"`
+		} `xml:"url"`
+	} `xml:"location"`
+}
+
+// extractMODS reads the URN of a MODS record from its identifier elements of type "urn", or of type "uri" if
+// the value is a URN, and the URLs from location/url. Identifiers and locations of related items are ignored.
+// Landing page rules match url fields by their usage, access, displayLabel and note attributes. A modsCollection
+// element is read as its first record.
+func extractMODS(dec *xml.Decoder, start xml.StartElement) (string, []fieldURL, error) {
+	var rec modsRecord
+	if start.Name.Local == "modsCollection" {
+		var coll struct {
+			Records []modsRecord `xml:"mods"`
+		}
+		if err := dec.DecodeElement(&coll, &start); err != nil {
+			return "", nil, err
+		}
+		if len(coll.Records) == 0 {
+			return "", nil, nil
+		}
+		rec = coll.Records[0]
+	} else if err := dec.DecodeElement(&rec, &start); err != nil {
+		return "", nil, err
+	}
+
+	var (
+		urn  string
+		urls []fieldURL
+	)
+	for _, id := range rec.Identifiers {
+		value := strings.TrimSpace(id.Value)
+		switch strings.ToLower(id.Type) {
+		case "urn":
+			if value != "" {
+				urn = value
+			}
+		case "uri":
+			if isURN(value) {
+				urn = value
+			}
+		}
+	}
+	for _, loc := range rec.Locations {
+		for _, u := range loc.URLs {
+			value := strings.TrimSpace(u.Value)
+			if value == "" {
+				continue
+			}
+			urls = append(urls, fieldURL{URL: value, Field: "url", Attrs: map[string]string{
+				"usage":        u.Usage,
+				"access":       u.Access,
+				"displayLabel": u.DisplayLabel,
+				"note":         u.Note,
+			}})
+		}
+	}
+	return urn, urls, nil
+}
+
+// dataciteResource is a DataCite metadata record.
+type dataciteResource struct {
+	Identifier struct {
+		Type  string `xml:"identifierType,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"identifier"`
+	AlternateIdentifiers []struct {
+		Type  string `xml:"alternateIdentifierType,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"alternateIdentifiers>alternateIdentifier"`
+}
+
+// extractDataCite reads the URN of a DataCite record from its identifier or an alternateIdentifier of type
+// "URN", and the URLs from the alternateIdentifiers of type "URL" and those of other types that are HTTP URLs,
+// such as a PURL. Landing page rules match alternateIdentifier fields by their alternateIdentifierType attribute.
+// The oai_datacite wrapper around the resource is optional.
+func extractDataCite(dec *xml.Decoder, start xml.StartElement) (string, []fieldURL, error) {
+	var res dataciteResource
+	if start.Name.Local == "oai_datacite" {
+		var wrapper struct {
+			Resource dataciteResource `xml:"payload>resource"`
+		}
+		if err := dec.DecodeElement(&wrapper, &start); err != nil {
+			return "", nil, err
+		}
+		res = wrapper.Resource
+	} else if err := dec.DecodeElement(&res, &start); err != nil {
+		return "", nil, err
+	}
+
+	var (
+		urn  string
+		urls []fieldURL
+	)
+	if value := strings.TrimSpace(res.Identifier.Value); strings.EqualFold(res.Identifier.Type, "urn") && value != "" {
+		urn = value
+	}
+	for _, id := range res.AlternateIdentifiers {
+		value := strings.TrimSpace(id.Value)
+		if value == "" {
+			continue
+		}
+		switch {
+		case strings.EqualFold(id.Type, "urn"):
+			urn = value
+		case strings.EqualFold(id.Type, "url") || isHTTPURL(value):
+			urls = append(urls, fieldURL{URL: value, Field: "alternateIdentifier", Attrs: map[string]string{
+				"alternateIdentifierType": id.Type,
+			}})
+		}
+	}
+	return urn, urls, nil
+}
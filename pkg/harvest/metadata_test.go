@@ -0,0 +1,158 @@
+package harvest
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wvh/urn-harvester/pkg/harvest/harvesttest"
+)
+
+const testMARC = `<record xmlns="http://www.loc.gov/MARC21/slim">
+  <leader>00000nam a2200000 i 4500</leader>
+  <controlfield tag="001">123</controlfield>
+  <datafield tag="024" ind1="7" ind2=" ">
+    <subfield code="a">URN:NBN:fi-fe3214</subfield>
+    <subfield code="2">urn</subfield>
+  </datafield>
+  <datafield tag="024" ind1="7" ind2=" ">
+    <subfield code="a">10.1000/1</subfield>
+    <subfield code="2">doi</subfield>
+  </datafield>
+  <datafield tag="856" ind1="4" ind2="2">
+    <subfield code="3">Cover</subfield>
+    <subfield code="u">http://example.com/cover/1.jpg</subfield>
+  </datafield>
+  <datafield tag="856" ind1="4" ind2="0">
+    <subfield code="3">Fulltext</subfield>
+    <subfield code="q">application/pdf</subfield>
+    <subfield code="u">http://example.com/bitstream/1.pdf</subfield>
+  </datafield>
+  <datafield tag="856" ind1="4" ind2="0">
+    <subfield code="u">http://example.com/handle/1</subfield>
+  </datafield>
+</record>`
+
+const testMODS = `<mods xmlns="http://www.loc.gov/mods/v3">
+  <identifier type="uri">http://hdl.handle.net/1/1</identifier>
+  <identifier type="urn">URN:NBN:fi-fe3214</identifier>
+  <location>
+    <url access="raw object">http://example.com/bitstream/1.pdf</url>
+    <url usage="primary display" access="object in context">http://example.com/handle/1</url>
+  </location>
+  <relatedItem type="host">
+    <identifier type="urn">URN:NBN:fi-fe2</identifier>
+  </relatedItem>
+</mods>`
+
+const testDataCite = `<oai_datacite xmlns="http://schema.datacite.org/oai/oai-1.1/">
+  <payload>
+    <resource xmlns="http://datacite.org/schema/kernel-4">
+      <identifier identifierType="DOI">10.1000/1</identifier>
+      <alternateIdentifiers>
+        <alternateIdentifier alternateIdentifierType="URN">URN:NBN:fi-fe3214</alternateIdentifier>
+        <alternateIdentifier alternateIdentifierType="PURL">http://purl.example.com/1</alternateIdentifier>
+        <alternateIdentifier alternateIdentifierType="URL">http://example.com/handle/1</alternateIdentifier>
+        <alternateIdentifier alternateIdentifierType="ISBN">978-951-0-00000-0</alternateIdentifier>
+      </alternateIdentifiers>
+    </resource>
+  </payload>
+</oai_datacite>`
+
+func TestMetadataFormats(t *testing.T) {
+	tests := []struct {
+		prefix string
+		input  string
+		rules  []FieldRule
+		want   Record
+	}{
+		{"marcxml", testMARC, nil, Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/bitstream/1.pdf", "http://example.com/handle/1"}}},
+		{
+			"marcxml", testMARC,
+			[]FieldRule{{Field: "856", Match: map[string]string{"ind2": "0", "3": ""}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/handle/1"}},
+		},
+		{
+			"marcxml", testMARC,
+			[]FieldRule{{Field: "856", Match: map[string]string{"3": "fulltext"}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/bitstream/1.pdf"}},
+		},
+		{
+			"marcxml", `<collection>` + testMARC + `</collection>`,
+			[]FieldRule{{Field: "856", Match: map[string]string{"ind2": "1"}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/cover/1.jpg", "http://example.com/bitstream/1.pdf", "http://example.com/handle/1"}},
+		},
+		{"mods", testMODS, nil, Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/handle/1"}}},
+		{
+			"mods", testMODS,
+			[]FieldRule{{Field: "url", Match: map[string]string{"access": "raw object"}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/bitstream/1.pdf"}},
+		},
+		{"oai_datacite", testDataCite, nil, Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/handle/1"}}},
+		{
+			"oai_datacite", testDataCite,
+			[]FieldRule{{Field: "alternateIdentifier", Match: map[string]string{"alternateIdentifierType": "purl"}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://purl.example.com/1"}},
+		},
+		{
+			"oai_datacite", testDataCite,
+			[]FieldRule{{Field: "alternateIdentifier", Match: map[string]string{"alternateIdentifierType": "DOI"}}},
+			Record{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://purl.example.com/1", "http://example.com/handle/1"}},
+		},
+		{
+			"oai_datacite",
+			`<resource><identifier identifierType="URN">URN:NBN:fi-fe2</identifier></resource>`,
+			nil,
+			Record{URN: "URN:NBN:fi-fe2"},
+		},
+	}
+
+	for _, test := range tests {
+		dec := xml.NewDecoder(strings.NewReader(test.input))
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := tok.(xml.StartElement)
+		got, err := metadataFormats[test.prefix].parser(test.rules)(dec, start)
+		if err != nil {
+			t.Errorf("%s %v: unexpected error: %v", test.prefix, test.rules, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %v:\nwant: %+v\n got: %+v", test.prefix, test.rules, test.want, got)
+		}
+	}
+}
+
+func TestHarvestMARCXML(t *testing.T) {
+	repo := &harvesttest.OAIPMH{
+		Formats: []harvesttest.Format{{Prefix: "marcxml", Namespace: "http://www.loc.gov/MARC21/slim"}},
+		Records: []harvesttest.Record{
+			{Identifier: "oai:example.com:1", URN: "URN:NBN:fi:example-1", Metadata: map[string]string{"marcxml": testMARC}},
+			{Identifier: "oai:example.com:2", URN: "URN:NBN:fi:example-2"},
+		},
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	src := *testSource
+	src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+	src.MetadataPrefix = "marcxml"
+	store := &memStore{}
+	res, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), store, &src)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// record 2 has no MARCXML
+	if res.Records != 1 {
+		t.Errorf("wrong number of records, want: 1, got: %d", res.Records)
+	}
+	if got := store.url("urn:nbn:fi-fe3214", 1); got != "http://example.com/handle/1" {
+		t.Errorf("wrong URL, want: %q, got: %q", "http://example.com/handle/1", got)
+	}
+}
@@ -0,0 +1,53 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier sends messages to the contacts of sources.
+type Notifier interface {
+	Notify(ctx context.Context, to, subject, body string) error
+}
+
+// WithNotifier sets the notifier used to tell source contacts about quarantined runs.
+// Without a notifier, quarantined runs are only logged.
+func WithNotifier(n Notifier) func(*Harvester) {
+	return func(hv *Harvester) {
+		hv.notifier = n
+	}
+}
+
+// MailNotifier is a Notifier that sends plain text mail through an SMTP server.
+type MailNotifier struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// From is the sender address.
+	From string
+	// Auth authenticates to the server; it can be nil.
+	Auth smtp.Auth
+}
+
+// Notify sends a mail. The context is not used, net/smtp does not support cancellation.
+func (n *MailNotifier) Notify(ctx context.Context, to, subject, body string) error {
+	return smtp.SendMail(n.Addr, n.Auth, n.From, []string{to}, mailMessage(n.From, to, subject, body, time.Now()))
+}
+
+// mailMessage formats a plain text mail message with CRLF line endings.
+func mailMessage(from, to, subject, body string, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.TrimRight(body, "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
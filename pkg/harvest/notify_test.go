@@ -0,0 +1,23 @@
+package harvest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailMessage(t *testing.T) {
+	msg := string(mailMessage("harvester@example.com", "repo@example.com", "Harvest of Jyväskylä", "line 1\nline 2\n",
+		time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)))
+
+	for _, want := range []string{
+		"To: repo@example.com\r\n",
+		"Subject: =?utf-8?q?Harvest_of_Jyv=C3=A4skyl=C3=A4?=\r\n",
+		"Date: Thu, 01 Oct 2020 12:00:00 +0000\r\n",
+		"\r\n\r\nline 1\r\nline 2\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message does not contain %q:\n%s", want, msg)
+		}
+	}
+}
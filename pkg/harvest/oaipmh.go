@@ -0,0 +1,236 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// oaiReader adapts OAI-PMH record streams to a RecordReader. Sources harvested by set have a list for each set,
+// which are read one after the other; records already read from an earlier list are skipped. oaiReader is a
+// pageReader whose pages are numbered across its lists; when it continues an earlier harvest, its first page is
+// page offset+1, requested by token.
+type oaiReader struct {
+	ctx       context.Context
+	client    *oaipmh.Client
+	lists     []oaiList
+	resumeURL string
+
+	// current list and its records
+	list    int
+	records *oaipmh.Records
+	record  Record
+
+	offset int
+	token  oaipmh.ResumptionToken
+
+	// OAI identifiers of the records read, or nil if the source isn't harvested by set
+	ids map[string]struct{}
+}
+
+// oaiList is the ListRecords request of a set.
+type oaiList struct {
+	set      string
+	startURL string
+}
+
+// openOAIPMH starts a ListRecords harvest of an OAI-PMH source.
+// If since is not the zero time, only records changed since that day are requested. If resume is not nil,
+// the harvest continues with its token instead.
+func (hv *Harvester) openOAIPMH(ctx context.Context, src *Source, since time.Time, resume *checkpoint) (RecordReader, error) {
+	lists, format, err := oaiLists(src, since)
+	if err != nil {
+		return nil, err
+	}
+	opts := []func(*oaipmh.Client){oaipmh.OnRepair(hv.logRepair)}
+	if format != nil {
+		opts = append(opts, oaipmh.WithMetadataParser(format.parser(src.Rules.LandingPage)))
+	}
+	r := &oaiReader{
+		ctx: ctx,
+		// the delay between pages is kept by the harvester's transport
+		client:    oaipmh.NewClient(hv.client, 0, opts...),
+		lists:     lists,
+		resumeURL: src.ResumeURL,
+	}
+	if len(src.Sets) > 0 {
+		r.ids = make(map[string]struct{})
+	}
+
+	startURL := lists[0].startURL
+	if resume != nil {
+		if r.list = findList(lists, resume.Set); r.list < 0 {
+			return nil, fmt.Errorf("can't resume harvest, source doesn't harvest set %q", resume.Set)
+		}
+		startURL = lists[r.list].startURL
+		if resume.Token != "" {
+			if src.ResumeURL == "" {
+				return nil, errors.New("can't resume harvest, source has no resume URL")
+			}
+			startURL = src.ResumeURL + url.QueryEscape(resume.Token)
+		}
+		r.offset = resume.Page - 1
+		r.token = oaipmh.ResumptionToken{Value: resume.Token, ExpirationDate: resume.Expires}
+		if r.ids != nil && resume.State != nil {
+			for _, id := range resume.State.IDs {
+				r.ids[id] = struct{}{}
+			}
+		}
+	}
+	r.records = r.client.ListRecords(ctx, startURL, src.ResumeURL)
+	return r, nil
+}
+
+// oaiLists returns the ListRecords requests of a source: one for each of its sets, or the start URL if it has
+// none, with the source's metadata prefix and the from date of since, if it is not the zero time. The metadata
+// format of the prefix is nil for oai_dc.
+func oaiLists(src *Source, since time.Time) ([]oaiList, *metadataFormat, error) {
+	u, err := url.Parse(src.StartURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := u.Query()
+	if src.MetadataPrefix != "" {
+		q.Set("metadataPrefix", src.MetadataPrefix)
+	}
+	var format *metadataFormat
+	if prefix := q.Get("metadataPrefix"); prefix != "" && prefix != "oai_dc" {
+		if format = metadataFormats[prefix]; format == nil {
+			return nil, nil, fmt.Errorf("no record extractor for metadata prefix %q", prefix)
+		}
+	}
+	if !since.IsZero() {
+		// Day granularity is used because every repository must support it; records changed earlier on that
+		// day are harvested again, which is harmless.
+		q.Set("from", since.UTC().Format("2006-01-02"))
+	}
+	if len(src.Sets) == 0 {
+		if src.MetadataPrefix == "" && since.IsZero() {
+			return []oaiList{{startURL: src.StartURL}}, format, nil
+		}
+		u.RawQuery = q.Encode()
+		return []oaiList{{startURL: u.String()}}, format, nil
+	}
+
+	lists := make([]oaiList, len(src.Sets))
+	for i, set := range src.Sets {
+		q.Set("set", set)
+		u.RawQuery = q.Encode()
+		lists[i] = oaiList{set: set, startURL: u.String()}
+	}
+	return lists, format, nil
+}
+
+// findList returns the index of the list of a set, or -1 if there is none.
+func findList(lists []oaiList, set string) int {
+	for i := range lists {
+		if lists[i].set == set {
+			return i
+		}
+	}
+	return -1
+}
+
+// harvestsSet reports whether set is one of the sets of the source, or empty if the source has none.
+func (src *Source) harvestsSet(set string) bool {
+	if len(src.Sets) == 0 {
+		return set == ""
+	}
+	for _, s := range src.Sets {
+		if s == set {
+			return true
+		}
+	}
+	return false
+}
+
+// Next advances to the next record, moving on to the list of the next set at the end of a list. Deleted records
+// are returned with only their OAI identifier.
+func (r *oaiReader) Next() bool {
+	for {
+		if !r.records.Next() {
+			if r.Err() != nil || r.list == len(r.lists)-1 {
+				return false
+			}
+			r.nextList()
+			continue
+		}
+		rec := r.records.Record()
+		if r.ids != nil {
+			if _, ok := r.ids[rec.Header.Identifier]; ok {
+				continue
+			}
+			r.ids[rec.Header.Identifier] = struct{}{}
+		}
+		switch md, ok := rec.Metadata.(Record); {
+		case rec.Header.Deleted:
+			r.record = Record{OAIIdentifier: rec.Header.Identifier, Deleted: true}
+		case ok:
+			r.record = md
+			r.record.OAIIdentifier = rec.Header.Identifier
+		default:
+			r.record = fromDC(rec.Identifiers)
+			r.record.OAIIdentifier = rec.Header.Identifier
+		}
+		return true
+	}
+}
+
+// nextList starts the list of the next set, after the pages of the current one.
+func (r *oaiReader) nextList() {
+	r.offset += r.records.Page()
+	r.records.Close()
+	r.list++
+	r.token = oaipmh.ResumptionToken{}
+	r.records = r.client.ListRecords(r.ctx, r.lists[r.list].startURL, r.resumeURL)
+}
+
+// Page returns the number of the current page and the token that requested it. On later pages, that is the
+// last token seen, as the token of a page comes after its records.
+func (r *oaiReader) Page() (int, oaipmh.ResumptionToken) {
+	n := r.records.Page()
+	if n <= 1 {
+		return r.offset + n, r.token
+	}
+	return r.offset + n, r.records.ResumptionToken()
+}
+
+func (r *oaiReader) Set() string {
+	return r.lists[r.list].set
+}
+
+func (r *oaiReader) Record() *Record {
+	return &r.record
+}
+
+// Err returns the error that stopped the stream. An empty list is not an error.
+func (r *oaiReader) Err() error {
+	err := r.records.Err()
+	if errors.Is(err, oaipmh.ErrNoRecordsMatch) {
+		return nil
+	}
+	return err
+}
+
+func (r *oaiReader) Close() error {
+	return r.records.Close()
+}
+
+// fromDC splits Dublin Core identifiers into a URN and candidate URLs. Identifiers starting with "urn"
+// are URNs, anything else is a URL; if there are several URNs, the last one wins.
+func fromDC(identifiers []string) Record {
+	var rec Record
+	for _, id := range identifiers {
+		if strings.HasPrefix(strings.ToLower(id), "urn") {
+			rec.URN = id
+		} else {
+			rec.URLs = append(rec.URLs, id)
+		}
+	}
+	return rec
+}
@@ -0,0 +1,198 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/harvest/harvesttest"
+)
+
+const testOAIDeleted = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <ListRecords>
+    <record>
+      <header>
+        <identifier>oai:example.com:1</identifier>
+        <datestamp>2020-10-01</datestamp>
+      </header>
+      <metadata>
+        <oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+          <dc:identifier>URN:NBN:fi-fe3214</dc:identifier>
+          <dc:identifier>http://example.com/handle/1</dc:identifier>
+        </oai_dc:dc>
+      </metadata>
+    </record>
+    <record>
+      <header status="deleted">
+        <identifier>oai:example.com:2</identifier>
+        <datestamp>2020-10-01</datestamp>
+      </header>
+    </record>
+  </ListRecords>
+</OAI-PMH>`
+
+func TestFromDC(t *testing.T) {
+	tests := []struct {
+		identifiers []string
+		want        Record
+	}{
+		{
+			[]string{"URN:NBN:fi-fe1", "http://example.com/1"},
+			Record{URN: "URN:NBN:fi-fe1", URLs: []string{"http://example.com/1"}},
+		},
+		{
+			[]string{"http://example.com/1", "urn:nbn:fi-fe1", "http://example.com/2", "urn:nbn:fi-fe2"},
+			Record{URN: "urn:nbn:fi-fe2", URLs: []string{"http://example.com/1", "http://example.com/2"}},
+		},
+		{
+			[]string{"ISBN 978-951-0-00000-0"},
+			Record{URLs: []string{"ISBN 978-951-0-00000-0"}},
+		},
+		{
+			nil,
+			Record{},
+		},
+	}
+
+	for _, test := range tests {
+		if got := fromDC(test.identifiers); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("fromDC(%q): want: %+v, got: %+v", test.identifiers, test.want, got)
+		}
+	}
+}
+
+func TestOAIDeleted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testOAIDeleted)
+	}))
+	defer srv.Close()
+
+	src := *testSource
+	src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+	store := &memStore{mappings: []Mapping{
+		{URN: "urn:nbn:fi:example-2", URL: "http://example.com/handle/2", SourceID: 1, OAIIdentifier: "oai:example.com:2"},
+		{URN: "urn:nbn:fi:example-2", URL: "http://example.org/2", SourceID: 2, OAIIdentifier: "oai:example.com:2"},
+	}}
+
+	since := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	res, err := New(srv.Client(), nil, WithDelay(0)).harvestSince(context.Background(), store, &src, since, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if res.Records != 2 || res.Withdrawn != 1 {
+		t.Errorf("wrong result, want 2 records and 1 withdrawn, got: %+v", res)
+	}
+	if m := store.mappings[0]; !m.IsWithdrawn() {
+		t.Errorf("mapping of deleted record not withdrawn: %+v", m)
+	}
+	if m := store.mappings[1]; m.IsWithdrawn() {
+		t.Errorf("mapping of other source withdrawn: %+v", m)
+	}
+	if m := store.mappings[2]; m.URN != "urn:nbn:fi-fe3214" || m.OAIIdentifier != "oai:example.com:1" {
+		t.Errorf("OAI identifier not stored: %+v", m)
+	}
+
+	var withdrawals []History
+	for _, h := range store.history {
+		if h.URLNew == "" {
+			withdrawals = append(withdrawals, h)
+		}
+	}
+	if len(withdrawals) != 1 || withdrawals[0].URN != "urn:nbn:fi:example-2" || withdrawals[0].URLOld != "http://example.com/handle/2" {
+		t.Errorf("wrong withdrawal history: %+v", withdrawals)
+	}
+}
+
+func TestOAILists(t *testing.T) {
+	since := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		src   Source
+		since time.Time
+		want  []oaiList
+	}{
+		{
+			Source{StartURL: "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc"},
+			time.Time{},
+			[]oaiList{{startURL: "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc"}},
+		},
+		{
+			Source{StartURL: "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc"},
+			since,
+			[]oaiList{{startURL: "http://example.com/oai?from=2020-10-01&metadataPrefix=oai_dc&verb=ListRecords"}},
+		},
+		{
+			Source{StartURL: "http://example.com/oai?verb=ListRecords", MetadataPrefix: "oai_dc", Sets: []string{"com_1", "col_2"}},
+			since,
+			[]oaiList{
+				{set: "com_1", startURL: "http://example.com/oai?from=2020-10-01&metadataPrefix=oai_dc&set=com_1&verb=ListRecords"},
+				{set: "col_2", startURL: "http://example.com/oai?from=2020-10-01&metadataPrefix=oai_dc&set=col_2&verb=ListRecords"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, _, err := oaiLists(&test.src, test.since)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v:\nwant: %+v\n got: %+v", test.src, test.want, got)
+		}
+	}
+
+	src := Source{StartURL: "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc", MetadataPrefix: "ead"}
+	if _, _, err := oaiLists(&src, time.Time{}); err == nil {
+		t.Error("expected error for unsupported metadata prefix, got nil")
+	}
+}
+
+func TestOAISets(t *testing.T) {
+	repo := &harvesttest.OAIPMH{
+		Sets: []harvesttest.Set{{Spec: "a"}, {Spec: "b"}, {Spec: "c"}, {Spec: "d"}},
+		Records: []harvesttest.Record{
+			{Identifier: "oai:example.com:1", Sets: []string{"a"}, URN: "URN:NBN:fi:example-1", URLs: []string{"http://example.com/1"}},
+			{Identifier: "oai:example.com:2", Sets: []string{"a", "b"}, URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/2"}},
+			{Identifier: "oai:example.com:3", Sets: []string{"b"}, URN: "URN:NBN:fi:example-3", URLs: []string{"http://example.com/3"}},
+			{Identifier: "oai:example.com:4", Sets: []string{"c"}, URN: "URN:NBN:fi:example-4", URLs: []string{"http://example.com/4"}},
+		},
+		PageSize: 1,
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	src := *testSource
+	src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+	src.ResumeURL = srv.URL + "/oai?verb=ListRecords&resumptionToken="
+	// set d is empty
+	src.Sets = []string{"a", "d", "b"}
+	store := &memStore{}
+	res, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), store, &src)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if res.Records != 3 || len(res.Warnings) != 0 {
+		t.Errorf("wrong result, want 3 records without warnings, got: %+v", res)
+	}
+	for _, urn := range []string{"urn:nbn:fi:example-1", "urn:nbn:fi:example-2", "urn:nbn:fi:example-3"} {
+		if store.url(urn, 1) == "" {
+			t.Errorf("no mapping for %s", urn)
+		}
+	}
+	if store.url("urn:nbn:fi:example-4", 1) != "" {
+		t.Error("record of set not harvested was harvested")
+	}
+	for _, req := range repo.Requests() {
+		if strings.Contains(req, "set=c") {
+			t.Errorf("set not harvested was requested: %s", req)
+		}
+	}
+}
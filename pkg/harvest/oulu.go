@@ -0,0 +1,174 @@
+package harvest
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/url"
+
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// ouluReader reads the format of the University of Oulu repository. Each record's identifiers are in a
+// metadata element; identifier and url elements outside of metadata are ignored:
+//
+//	<metadata>
+//	  <identifier>URN:NBN:fi:oulu-...</identifier>
+//	  <url>http://...</url>
+//	</metadata>
+//	<resumptionToken>...</resumptionToken>
+//
+// Like OAI-PMH, long lists are split into pages, which are requested by appending the resumption token
+// to the source's resume URL.
+type ouluReader struct {
+	hv        *Harvester
+	ctx       context.Context
+	resumeURL string
+
+	// URL of the next page, or empty if this is the last page
+	next string
+
+	body io.ReadCloser
+	dec  *xml.Decoder
+	page int
+
+	record Record
+	err    error
+}
+
+// openOulu starts a harvest of an Oulu format source. The first page is fetched on the first call to Next.
+func (hv *Harvester) openOulu(ctx context.Context, src *Source) RecordReader {
+	return &ouluReader{
+		hv:        hv,
+		ctx:       ctx,
+		resumeURL: src.ResumeURL,
+		next:      src.StartURL,
+	}
+}
+
+// Next advances to the next record, fetching the next page if needed.
+func (r *ouluReader) Next() bool {
+	for r.err == nil {
+		if r.dec == nil {
+			if r.next == "" {
+				return false
+			}
+			body, err := r.hv.get(r.ctx, r.next)
+			if err != nil {
+				r.err = err
+				return false
+			}
+			r.body, r.dec, r.next = body, newDecoder(body), ""
+			r.page++
+		}
+
+		err := r.scan()
+		if err == io.EOF {
+			r.closeBody()
+			continue
+		}
+		if err != nil {
+			r.err = err
+			r.closeBody()
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// scan reads tokens until the end of the next metadata element, returning io.EOF at the end of the page.
+func (r *ouluReader) scan() error {
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "metadata":
+			return r.parseMetadata()
+		case "resumptionToken":
+			token, err := oaipmh.ReadText(r.dec)
+			if err != nil {
+				return err
+			}
+			if token != "" {
+				if r.resumeURL == "" {
+					return errors.New("got resumption token but source has no resume URL")
+				}
+				r.next = r.resumeURL + url.QueryEscape(token)
+			}
+		}
+	}
+}
+
+// parseMetadata reads a metadata element up to and including its end element.
+func (r *ouluReader) parseMetadata() error {
+	var depth int
+	r.record = Record{}
+
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "identifier" && t.Name.Local != "url" {
+				depth++
+				continue
+			}
+			text, err := oaipmh.ReadText(r.dec)
+			if err != nil {
+				return err
+			}
+			if text == "" {
+				continue
+			}
+			if t.Name.Local == "identifier" {
+				r.record.URN = text
+			} else {
+				r.record.URLs = append(r.record.URLs, text)
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+	}
+}
+
+func (r *ouluReader) closeBody() error {
+	r.dec = nil
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (r *ouluReader) Record() *Record {
+	return &r.record
+}
+
+func (r *ouluReader) Err() error {
+	return r.err
+}
+
+func (r *ouluReader) Close() error {
+	r.next = ""
+	return r.closeBody()
+}
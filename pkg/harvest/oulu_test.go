@@ -0,0 +1,95 @@
+package harvest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ouluServer serves the Oulu fixtures, selecting the page by resumption token.
+func ouluServer(t *testing.T) *httptest.Server {
+	pages := map[string]string{
+		"":            "page1.xml",
+		"oulu:page=2": "page2.xml",
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Query().Get("resumptionToken")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "oulu", page))
+	}))
+}
+
+func TestOulu(t *testing.T) {
+	srv := ouluServer(t)
+	defer srv.Close()
+
+	src := *testSource
+	src.Format = FormatOulu
+	src.StartURL = srv.URL + "/oulu"
+	src.ResumeURL = srv.URL + "/oulu?resumptionToken="
+	src.URLPattern = `http://urn\.example\.com/`
+
+	t.Run("records", func(t *testing.T) {
+		rr := New(srv.Client(), nil, WithDelay(0)).openOulu(context.Background(), &src)
+		defer rr.Close()
+
+		var got []Record
+		for rr.Next() {
+			got = append(got, *rr.Record())
+		}
+		if err := rr.Err(); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+
+		want := []Record{
+			{URN: "URN:ISBN:9789514200001", URLs: []string{"http://urn.example.com/1"}},
+			{URN: "URN:ISBN:9789514200002"},
+			{URN: "URN:ISBN:9789514200003", URLs: []string{"http://urn.example.com/3"}},
+			{URN: "URN:ISBN:9789514200001", URLs: []string{"http://urn.example.com/1-again"}},
+			{URN: "URN:ISBN:9789514200004", URLs: []string{"http://urn.example.com/4"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong records\nwant: %+v\n got: %+v", want, got)
+		}
+	})
+
+	t.Run("harvest", func(t *testing.T) {
+		store := &memStore{}
+		res, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), store, &src)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+
+		if len(store.mappings) != 3 {
+			t.Errorf("wrong number of mappings, want: %d, got: %d", 3, len(store.mappings))
+		}
+		if got := store.url("urn:isbn:9789514200001", src.ID); got != "http://urn.example.com/1" {
+			t.Errorf("duplicate overwrote first mapping, want: %q, got: %q", "http://urn.example.com/1", got)
+		}
+
+		if len(res.Warnings) != 2 || res.Warnings[0].Kind != WarnIncomplete || res.Warnings[1].Kind != WarnDuplicate {
+			t.Errorf("wrong warnings: %+v", res.Warnings)
+		}
+	})
+
+	t.Run("no resume URL", func(t *testing.T) {
+		src := src
+		src.ResumeURL = ""
+
+		rr := New(srv.Client(), nil, WithDelay(0)).openOulu(context.Background(), &src)
+		defer rr.Close()
+
+		for rr.Next() {
+		}
+		if rr.Err() == nil {
+			t.Error("expected error for resumption token without resume URL, got nil")
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package harvest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// politeTransport is an http.RoundTripper that keeps the harvester from hammering a server. Requests to the same
+// host are sent one at a time: the next request waits until the body of the previous response is closed and then
+// for at least delay. Requests to different hosts don't wait for each other.
+type politeTransport struct {
+	next  http.RoundTripper
+	delay time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlot
+}
+
+// hostSlot is the request slot of a host. Holding the slot means owning its single token.
+type hostSlot struct {
+	token chan struct{}
+	// end of the last request, only accessed while holding the slot
+	last time.Time
+}
+
+func newPoliteTransport(next http.RoundTripper, delay time.Duration) *politeTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &politeTransport{
+		next:  next,
+		delay: delay,
+		hosts: make(map[string]*hostSlot),
+	}
+}
+
+// hostKey returns the key used to limit requests to a URL's host. Ports are ignored: different ports on one
+// server are still one server.
+func hostKey(host string) string {
+	return strings.ToLower(host)
+}
+
+func (t *politeTransport) slot(host string) *hostSlot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := hostKey(host)
+	s, ok := t.hosts[key]
+	if !ok {
+		s = &hostSlot{token: make(chan struct{}, 1)}
+		s.token <- struct{}{}
+		t.hosts[key] = s
+	}
+	return s
+}
+
+func (t *politeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	s := t.slot(r.URL.Hostname())
+
+	ctx := r.Context()
+	select {
+	case <-s.token:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if !s.last.IsZero() {
+		if err := oaipmh.Sleep(ctx, t.delay-time.Since(s.last)); err != nil {
+			s.release()
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body, slot: s}
+	return resp, nil
+}
+
+// release marks the end of a request and frees the slot.
+func (s *hostSlot) release() {
+	s.last = time.Now()
+	s.token <- struct{}{}
+}
+
+// slotBody is a response body that frees its host slot when closed.
+type slotBody struct {
+	io.ReadCloser
+	slot *hostSlot
+	once sync.Once
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.slot.release)
+	return err
+}
@@ -0,0 +1,79 @@
+package harvest
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// SourceResult is the outcome of the run of one source by RunAll.
+type SourceResult struct {
+	Source *Source
+	Result *Result
+	Err    error
+}
+
+// RunAll runs several sources with Run, using up to workers goroutines. Sources on the same host are harvested
+// one after the other by the same worker, in the given order, so that no server is harvested twice at once; the
+// harvester's transport also keeps the delay between requests to a host. The results are in the order of sources.
+//
+// A failed source does not stop the others. If ctx is cancelled, sources that have not started are not run and
+// get the context's error.
+func (hv *Harvester) RunAll(ctx context.Context, db TxBeginner, sources []*Source, workers int, full bool) []SourceResult {
+	results := make([]SourceResult, len(sources))
+	queues := make(chan []int)
+	for i, src := range sources {
+		results[i].Source = src
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for queue := range queues {
+				for _, i := range queue {
+					if err := ctx.Err(); err != nil {
+						results[i].Err = err
+						continue
+					}
+					results[i].Result, results[i].Err = hv.Run(ctx, db, sources[i], full)
+				}
+			}
+		}()
+	}
+
+	for _, queue := range hostQueues(sources) {
+		queues <- queue
+	}
+	close(queues)
+	wg.Wait()
+	return results
+}
+
+// hostQueues groups the indices of sources by the host of their start URL, in order of first appearance.
+// Sources with an unparseable URL get a queue of their own and fail in Run.
+func hostQueues(sources []*Source) [][]int {
+	var (
+		queues [][]int
+		byHost = make(map[string]int)
+	)
+	for i, src := range sources {
+		u, err := url.Parse(src.StartURL)
+		if err != nil {
+			queues = append(queues, []int{i})
+			continue
+		}
+		key := hostKey(u.Hostname())
+		if q, ok := byHost[key]; ok {
+			queues[q] = append(queues[q], i)
+			continue
+		}
+		byHost[key] = len(queues)
+		queues = append(queues, []int{i})
+	}
+	return queues
+}
@@ -0,0 +1,133 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoliteTransport(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	var (
+		mu       sync.Mutex
+		inFlight int
+		overlap  bool
+		starts   []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		overlap = overlap || inFlight > 1
+		starts = append(starts, time.Now())
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newPoliteTransport(srv.Client().Transport, delay)}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error("unexpected error:", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if overlap {
+		t.Error("concurrent requests to one host")
+	}
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < delay {
+			t.Errorf("request %d started %v after the previous one, want at least %v", i, gap, delay)
+		}
+	}
+
+	// a cancelled request gives up waiting for the host
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("expected error for cancelled request")
+	}
+}
+
+func TestHostQueues(t *testing.T) {
+	sources := []*Source{
+		{StartURL: "https://www.doria.fi/oai"},
+		{StartURL: "https://jyx.jyu.fi/oai"},
+		{StartURL: "https://WWW.DORIA.FI:8443/other"},
+		{StartURL: "%zz"},
+		{StartURL: "https://jyx.jyu.fi/dump"},
+	}
+	want := [][]int{{0, 2}, {1, 4}, {3}}
+	if got := hostQueues(sources); !reflect.DeepEqual(got, want) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/swedish" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, testSwedishDump)
+	}))
+	defer srv.Close()
+
+	var sources []*Source
+	for i, path := range []string{"/swedish", "/broken", "/swedish"} {
+		src := *testSource
+		src.ID = i + 1
+		src.Title = fmt.Sprintf("source %d", i+1)
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + path
+		sources = append(sources, &src)
+	}
+
+	db := &fakeDB{}
+	hv := New(srv.Client(), nil, WithDelay(0), WithRetryLimit(0))
+	results := hv.RunAll(context.Background(), db, sources, 2, false)
+
+	if len(results) != len(sources) {
+		t.Fatalf("want %d results, got %d", len(sources), len(results))
+	}
+	for i, res := range results {
+		if res.Source != sources[i] {
+			t.Errorf("result %d is for source %s", i, res.Source.Title)
+		}
+		if failed := res.Err != nil; failed != (i == 1) {
+			t.Errorf("source %s: unexpected error: %v", res.Source.Title, res.Err)
+		}
+	}
+	if len(db.runs) != 3 {
+		t.Errorf("want 3 run records, got %d", len(db.runs))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, res := range hv.RunAll(ctx, &fakeDB{}, sources, 2, false) {
+		if res.Err != context.Canceled {
+			t.Errorf("source %s: want: %v, got: %v", res.Source.Title, context.Canceled, res.Err)
+		}
+	}
+}
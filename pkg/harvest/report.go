@@ -0,0 +1,91 @@
+package harvest
+
+import (
+	"context"
+)
+
+// RejectedURL is a URL of a record that was not accepted, because it does not match the source's URL pattern.
+type RejectedURL struct {
+	Record int    `json:"record"`
+	URN    string `json:"urn"`
+	URL    string `json:"url"`
+}
+
+// Report describes what a harvest would change, see DryRun.
+type Report struct {
+	Source       string        `json:"source"`
+	Full         bool          `json:"full"`
+	Records      int           `json:"records"`
+	New          []Change      `json:"new"`
+	Changed      []Change      `json:"changed"`
+	Details      []Change      `json:"details"`
+	OtherSource  []Change      `json:"other_source"`
+	Withdrawn    []Change      `json:"withdrawn"`
+	Restored     []Change      `json:"restored"`
+	RejectedURLs []RejectedURL `json:"rejected_urls"`
+	Rejected     []Rejection   `json:"rejected"`
+	Duplicates   []Warning     `json:"duplicates"`
+	Warnings     []Warning     `json:"warnings"`
+}
+
+// NewReport creates a report from the changes recorded during a harvest and its result.
+func NewReport(src *Source, full bool, changes []Change, res *Result) *Report {
+	rep := &Report{
+		Source:       src.Title,
+		Full:         full,
+		New:          []Change{},
+		Changed:      []Change{},
+		Details:      []Change{},
+		OtherSource:  []Change{},
+		Withdrawn:    []Change{},
+		Restored:     []Change{},
+		RejectedURLs: []RejectedURL{},
+		Rejected:     []Rejection{},
+		Duplicates:   []Warning{},
+		Warnings:     []Warning{},
+	}
+
+	for _, c := range changes {
+		switch c.Kind {
+		case ChangeNew:
+			rep.New = append(rep.New, c)
+		case ChangeURL:
+			rep.Changed = append(rep.Changed, c)
+		case ChangeDetails:
+			rep.Details = append(rep.Details, c)
+		case ChangeOtherSource:
+			rep.OtherSource = append(rep.OtherSource, c)
+		case ChangeWithdrawn:
+			rep.Withdrawn = append(rep.Withdrawn, c)
+		case ChangeRestored:
+			rep.Restored = append(rep.Restored, c)
+		}
+	}
+
+	if res == nil {
+		return rep
+	}
+	rep.Records = res.Records
+	rep.RejectedURLs = append(rep.RejectedURLs, res.RejectedURLs...)
+	rep.Rejected = append(rep.Rejected, res.Rejected...)
+	for _, w := range res.Warnings {
+		if w.Kind == WarnDuplicate {
+			rep.Duplicates = append(rep.Duplicates, w)
+		} else {
+			rep.Warnings = append(rep.Warnings, w)
+		}
+	}
+	return rep
+}
+
+// DryRun harvests a source like Run, but writes nothing to the store and returns a report of the changes
+// the harvest would have made instead.
+func (hv *Harvester) DryRun(ctx context.Context, store Store, src *Source, full bool) (*Report, error) {
+	since := sinceLastRun(src, full)
+	cs := NewChangeSet(store)
+	res, err := hv.harvestSince(ctx, cs, src, since, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewReport(src, since.IsZero(), cs.Changes(), res), nil
+}
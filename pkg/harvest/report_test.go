@@ -0,0 +1,68 @@
+package harvest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testSwedishDump)
+	}))
+	defer srv.Close()
+
+	src := *testSource
+	src.Format = FormatSwedish
+	src.StartURL = srv.URL
+	src.URLPattern = `http://example\.com/`
+	src.WithdrawAfter = 1
+
+	mappings := func() []Mapping {
+		return []Mapping{
+			{URN: "urn:nbn:se:kb:1", URL: "http://example.org/1", SourceID: 2},
+			{URN: "urn:nbn:se:kb:6", URL: "http://example.com/6-old", SourceID: 1},
+			{URN: "urn:nbn:se:kb:9", URL: "http://example.com/9", SourceID: 1},
+		}
+	}
+	store := &memStore{mappings: mappings()}
+
+	rep, err := New(srv.Client(), nil).DryRun(context.Background(), store, &src, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if !reflect.DeepEqual(store.mappings, mappings()) || len(store.history) != 0 {
+		t.Errorf("dry run changed the store: %+v, history: %+v", store.mappings, store.history)
+	}
+
+	if !rep.Full || rep.Records != 6 {
+		t.Errorf("wrong report header: %+v", rep)
+	}
+	if want := []Change{}; !reflect.DeepEqual(rep.New, want) {
+		t.Errorf("wrong new URNs\nwant: %+v\n got: %+v", want, rep.New)
+	}
+	if want := []Change{{Kind: ChangeOtherSource, URN: "urn:nbn:se:kb:1", URL: "http://example.com/1", Sources: []int{2}}}; !reflect.DeepEqual(rep.OtherSource, want) {
+		t.Errorf("wrong URNs from other sources\nwant: %+v\n got: %+v", want, rep.OtherSource)
+	}
+	if want := []Change{{Kind: ChangeURL, URN: "urn:nbn:se:kb:6", URL: "http://example.com/6", OldURL: "http://example.com/6-old"}}; !reflect.DeepEqual(rep.Changed, want) {
+		t.Errorf("wrong changed URLs\nwant: %+v\n got: %+v", want, rep.Changed)
+	}
+	if want := []Change{{Kind: ChangeWithdrawn, URN: "urn:nbn:se:kb:9", OldURL: "http://example.com/9"}}; !reflect.DeepEqual(rep.Withdrawn, want) {
+		t.Errorf("wrong withdrawn URNs\nwant: %+v\n got: %+v", want, rep.Withdrawn)
+	}
+	if want := []RejectedURL{{Record: 5, URN: "URN:NBN:se:kb:5", URL: "http://example.org/5"}}; !reflect.DeepEqual(rep.RejectedURLs, want) {
+		t.Errorf("wrong rejected URLs\nwant: %+v\n got: %+v", want, rep.RejectedURLs)
+	}
+	if len(rep.Duplicates) != 1 || rep.Duplicates[0].Record != 4 || len(rep.Warnings) != 3 {
+		t.Errorf("wrong warnings, duplicates: %+v, other: %+v", rep.Duplicates, rep.Warnings)
+	}
+
+	if _, err := json.Marshal(rep); err != nil {
+		t.Error("can't encode report:", err)
+	}
+}
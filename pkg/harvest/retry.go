@@ -0,0 +1,160 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// defaultRetryLimit is the default total time spent waiting for retries during the harvest of a source.
+	defaultRetryLimit = 10 * time.Minute
+
+	// first and longest backoff between attempts; a Retry-After header can ask for longer
+	minBackoff = time.Second
+	maxBackoff = 2 * time.Minute
+)
+
+// retryBudget is the retry time left for the harvest of a source, carried in the request context.
+// The requests of one harvest are sent one after the other, so it needs no locking.
+type retryBudget struct {
+	left    time.Duration
+	logger  log.Logger
+	retries int
+}
+
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a context whose requests may spend up to limit waiting for retries.
+func withRetryBudget(ctx context.Context, limit time.Duration, logger log.Logger) (context.Context, *retryBudget) {
+	b := &retryBudget{left: limit, logger: logger}
+	return context.WithValue(ctx, retryBudgetKey{}, b), b
+}
+
+// retryTransport retries requests that failed with a transient network error or HTTP status. Attempts are
+// sent with client, so redirects and the client's timeout apply to each attempt separately. Waits between attempts
+// grow exponentially with jitter; a Retry-After header in a 429 or 503 response is honoured. A request gives up when
+// the next wait would exceed the retry budget in its context, or the harvester's retry limit if it has none,
+// returning the last response or error.
+type retryTransport struct {
+	client *http.Client
+	limit  time.Duration
+	logger log.Logger
+
+	// sleeps, replaced in tests
+	wait func(context.Context, time.Duration) error
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	b, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		b = &retryBudget{left: t.limit, logger: t.logger}
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.client.Do(r)
+		if err != nil {
+			// the client wraps errors in a url.Error, and so will the caller's client
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+		}
+		if ctx.Err() != nil || !retryable(resp, err) || r.Method != http.MethodGet {
+			return resp, err
+		}
+
+		d := backoff(attempt)
+		if after, ok := retryAfter(resp, time.Now()); ok && after > d {
+			d = after
+		}
+		status := ""
+		if resp != nil {
+			status = resp.Status
+		}
+		if d > b.left {
+			b.logger.Log("msg", "giving up on request", "url", r.URL.String(), "attempt", attempt, "status", status, "err", err,
+				"retry_time_left", b.left)
+			return resp, err
+		}
+		b.logger.Log("msg", "retrying request", "url", r.URL.String(), "attempt", attempt, "status", status, "err", err,
+			"wait", d)
+		if resp != nil {
+			// drain a little, so the connection can be reused
+			io.CopyN(ioutil.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+
+		b.left -= d
+		b.retries++
+		if err := t.wait(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether a request that failed with this response or error may succeed later.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false
+		}
+		var nerr net.Error
+		return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before the attempt after the given one: minBackoff doubled for each earlier attempt,
+// up to maxBackoff, with the upper half picked at random so that harvesters don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 16 {
+		if exp := minBackoff << uint(attempt-1); exp < maxBackoff {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses the Retry-After header of a 429 or 503 response, which holds either a number of seconds
+// or an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests) {
+		return 0, false
+	}
+	s := resp.Header.Get("Retry-After")
+	if s == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
@@ -0,0 +1,126 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status int
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{503, "120", 2 * time.Minute, true},
+		{429, "0", 0, true},
+		{503, "Fri, 02 Oct 2020 03:00:30 GMT", 30 * time.Second, true},
+		{503, "Fri, 02 Oct 2020 02:00:00 GMT", 0, true},
+		{503, "", 0, false},
+		{503, "soon", 0, false},
+		{503, "-1", 0, false},
+		{500, "120", 0, false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		if test.header != "" {
+			resp.Header.Set("Retry-After", test.header)
+		}
+		got, ok := retryAfter(resp, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%d %q: want: %v %t, got: %v %t", test.status, test.header, test.want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 8: maxBackoff, 100: maxBackoff} {
+		for i := 0; i < 10; i++ {
+			if d := backoff(attempt); d < max/2 || d > max {
+				t.Errorf("attempt %d: backoff %v not between %v and %v", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/flaky":
+			if requests < 3 {
+				w.Header().Set("Retry-After", "30")
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, testSwedishDump)
+		case "/busy":
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var waits []time.Duration
+	newHarvester := func(limit time.Duration) *Harvester {
+		hv := New(srv.Client(), nil, WithDelay(0), WithRetryLimit(limit))
+		hv.client.Transport.(*retryTransport).wait = func(ctx context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+		return hv
+	}
+
+	src := *testSource
+	src.Format = FormatSwedish
+
+	t.Run("retry after", func(t *testing.T) {
+		requests, waits = 0, nil
+		src.StartURL = srv.URL + "/flaky"
+		res, err := newHarvester(time.Hour).Harvest(context.Background(), &memStore{}, &src)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if res.Retries != 2 || requests != 3 {
+			t.Errorf("want 2 retries in 3 requests, got %d in %d", res.Retries, requests)
+		}
+		for _, d := range waits {
+			if d != 30*time.Second {
+				t.Errorf("Retry-After not honoured, waited %v", d)
+			}
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		requests, waits = 0, nil
+		src.StartURL = srv.URL + "/busy"
+		res, err := newHarvester(5*time.Minute).Harvest(context.Background(), &memStore{}, &src)
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		// 120s twice fits in 5 minutes, a third time doesn't
+		if res.Retries != 2 || requests != 3 {
+			t.Errorf("want 2 retries in 3 requests, got %d in %d", res.Retries, requests)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		requests, waits = 0, nil
+		src.StartURL = srv.URL + "/missing"
+		if _, err := newHarvester(time.Hour).Harvest(context.Background(), &memStore{}, &src); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if requests != 1 {
+			t.Errorf("404 retried, %d requests", requests)
+		}
+	})
+}
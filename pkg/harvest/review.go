@@ -0,0 +1,298 @@
+package harvest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// ErrUnknownChangeSet means no change set with the requested id exists.
+	ErrUnknownChangeSet = errors.New("unknown change set")
+
+	// ErrChangeSetResolved means a change set was already approved, rejected or superseded.
+	ErrChangeSetResolved = errors.New("change set already resolved")
+
+	// ErrChangeSetStale means mappings a change set would change were changed since its run. It can only be
+	// rejected; the next run of the source harvests its changes again.
+	ErrChangeSetStale = errors.New("change set is stale")
+)
+
+// ChangeSetStatus is the state of a change set held for approval. It mirrors the change_set_status enum
+// in the database.
+type ChangeSetStatus string
+
+// Change set statuses known to the harvester. A pending change set is superseded when a later run of the same
+// source is staged or committed, because that run already contains its changes.
+const (
+	ChangeSetPending    ChangeSetStatus = "pending"
+	ChangeSetApproved   ChangeSetStatus = "approved"
+	ChangeSetRejected   ChangeSetStatus = "rejected"
+	ChangeSetSuperseded ChangeSetStatus = "superseded"
+)
+
+// reasonReview is the reason given for change sets of sources that require review.
+const reasonReview = "source requires review"
+
+// ChangeSetInfo is a row in the change_set table without its changes. ID is the id of the run that made the
+// changes; Count is the number of changes.
+type ChangeSetInfo struct {
+	ID         int64           `json:"id"`
+	SourceID   int             `json:"source_id"`
+	Source     string          `json:"source"`
+	Created    time.Time       `json:"created"`
+	Reason     string          `json:"reason"`
+	Status     ChangeSetStatus `json:"status"`
+	Resolved   *time.Time      `json:"resolved,omitempty"`
+	ResolvedBy string          `json:"resolved_by,omitempty"`
+	Count      int             `json:"count"`
+}
+
+// StagedChangeSet is a change set with the changes it would make.
+type StagedChangeSet struct {
+	ChangeSetInfo
+	Changes []Change `json:"changes"`
+}
+
+// Diff compares a staged change with the current mapping of the source. CurrentURL is empty if the source has
+// no mapping for the URN or it was withdrawn. Stale is set if the current mapping is no longer the one the
+// change was made against, for example because the URL was changed by hand.
+type Diff struct {
+	Kind        string `json:"kind"`
+	URN         string `json:"urn"`
+	CurrentURL  string `json:"current_url,omitempty"`
+	ProposedURL string `json:"proposed_url,omitempty"`
+	Stale       bool   `json:"stale,omitempty"`
+}
+
+// stageChangeSet holds the changes of a run in the change_set table, superseding the pending change sets of
+// the source.
+func stageChangeSet(ctx context.Context, db Querier, run *Run, cs *ChangeSet) error {
+	changes, err := json.Marshal(cs.Changes())
+	if err != nil {
+		return err
+	}
+	ops, err := json.Marshal(cs.Ops())
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, sqlSupersedeChangeSets, run.SourceID, run.End); err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, sqlInsertChangeSet, run.ID, run.SourceID, run.End, run.Error, changes, ops)
+	return err
+}
+
+// Review lists, approves and rejects change sets held for approval.
+type Review struct {
+	db  TxBeginner
+	now func() time.Time
+}
+
+// NewReview creates a review of the change sets in the database.
+func NewReview(db TxBeginner) *Review {
+	return &Review{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// List returns the change sets with the given status, oldest first; an empty status returns all of them.
+func (r *Review) List(ctx context.Context, status ChangeSetStatus) ([]ChangeSetInfo, error) {
+	rows, err := r.db.Query(ctx, sqlChangeSets, string(status))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ChangeSetInfo
+	for rows.Next() {
+		var c ChangeSetInfo
+		if err := rows.Scan(&c.ID, &c.SourceID, &c.Source, &c.Created, &c.Reason, &c.Status,
+			&c.Resolved, &c.ResolvedBy, &c.Count); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// Get returns a change set with its changes.
+func (r *Review) Get(ctx context.Context, id int64) (*StagedChangeSet, error) {
+	var (
+		c       StagedChangeSet
+		changes []byte
+		ops     []byte
+	)
+	err := r.db.QueryRow(ctx, sqlChangeSet, id).Scan(&c.ID, &c.SourceID, &c.Source, &c.Created, &c.Reason,
+		&c.Status, &c.Resolved, &c.ResolvedBy, &c.Count, &changes, &ops)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownChangeSet, id)
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(changes, &c.Changes); err != nil {
+		return nil, fmt.Errorf("change set %d: %w", id, err)
+	}
+	return &c, nil
+}
+
+// Diff compares the changes of a change set with the current mappings of its source.
+func (r *Review) Diff(ctx context.Context, id int64) ([]Diff, error) {
+	c, err := r.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return diffChanges(ctx, NewStore(r.db), c.SourceID, c.Changes)
+}
+
+// diffChanges compares changes with the current mappings of a source.
+func diffChanges(ctx context.Context, store Store, sourceID int, changes []Change) ([]Diff, error) {
+	diffs := make([]Diff, 0, len(changes))
+	for _, ch := range changes {
+		mappings, err := store.Mappings(ctx, ch.URN)
+		if err != nil {
+			return nil, err
+		}
+		d := Diff{Kind: ch.Kind, URN: ch.URN, ProposedURL: ch.URL}
+		for _, m := range mappings {
+			if m.SourceID == sourceID && !m.IsWithdrawn() {
+				d.CurrentURL = m.URL
+			}
+		}
+		d.Stale = d.CurrentURL != ch.OldURL
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// Approve applies the changes of a pending change set. The history entries it writes are attributed to user,
+// and the start of the run becomes the source's last successful run start unless a later run succeeded.
+// A change set is not applied if any of its changes is stale, see Diff, or if any other mapping it writes was
+// changed since its run.
+func (r *Review) Approve(ctx context.Context, id int64, user string) error {
+	return r.resolve(ctx, id, ChangeSetApproved, user, func(tx pgx.Tx, cs *lockedChangeSet) error {
+		store := NewStore(tx)
+		diffs, err := diffChanges(ctx, store, cs.sourceID, cs.changes)
+		if err != nil {
+			return err
+		}
+		stale := 0
+		for _, d := range diffs {
+			if d.Stale {
+				stale++
+			}
+		}
+		if stale > 0 {
+			return fmt.Errorf("%w: %d of the %d changes of %d", ErrChangeSetStale, stale, len(diffs), id)
+		}
+		// updates that only change bookkeeping are not among the changes, but would still revert edits
+		stale, err = staleOps(ctx, store, cs.ops)
+		if err != nil {
+			return err
+		}
+		if stale > 0 {
+			return fmt.Errorf("%w: %d mappings written by %d were changed", ErrChangeSetStale, stale, id)
+		}
+
+		for _, op := range cs.ops {
+			if op.History != nil {
+				op.History.ApprovedBy = user
+			}
+		}
+		if err := ApplyOps(ctx, store, cs.ops); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, sqlApproveLastRun, id)
+		return err
+	})
+}
+
+// staleOps counts the mappings written by ops that were changed since the ops were recorded: a mapping they
+// insert that exists now, or one they update that is no longer the version the first update replaces.
+func staleOps(ctx context.Context, store Store, ops []ChangeOp) (int, error) {
+	var (
+		stale   int
+		checked = make(map[mappingKey]bool)
+	)
+	for _, op := range ops {
+		m := op.Insert
+		if m == nil {
+			m = op.Update
+		}
+		if m == nil || checked[mappingKey{m.URN, m.SourceID}] {
+			continue
+		}
+		checked[mappingKey{m.URN, m.SourceID}] = true
+
+		current, err := sourceMapping(ctx, store, m.URN, m.SourceID)
+		if err != nil {
+			return 0, err
+		}
+		if op.Insert != nil && current != nil ||
+			op.Update != nil && (current == nil || op.Old == nil || !sameMapping(current, op.Old)) {
+			stale++
+		}
+	}
+	return stale, nil
+}
+
+// Reject discards the changes of a pending change set. They are harvested again by the next run of the source.
+func (r *Review) Reject(ctx context.Context, id int64, user string) error {
+	return r.resolve(ctx, id, ChangeSetRejected, user, nil)
+}
+
+// lockedChangeSet is a pending change set locked for resolving.
+type lockedChangeSet struct {
+	sourceID int
+	changes  []Change
+	ops      []ChangeOp
+}
+
+// resolve locks a pending change set, calls apply if it is not nil and sets the new status, all in one transaction.
+func (r *Review) resolve(ctx context.Context, id int64, status ChangeSetStatus, user string, apply func(pgx.Tx, *lockedChangeSet) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// no-op after commit
+	defer tx.Rollback(ctx)
+
+	var (
+		current ChangeSetStatus
+		cs      lockedChangeSet
+		changes []byte
+		ops     []byte
+	)
+	if err := tx.QueryRow(ctx, sqlLockChangeSet, id).Scan(&current, &cs.sourceID, &changes, &ops); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %d", ErrUnknownChangeSet, id)
+		}
+		return err
+	}
+	if current != ChangeSetPending {
+		return fmt.Errorf("%w: %d is %s", ErrChangeSetResolved, id, current)
+	}
+
+	if apply != nil {
+		if err := json.Unmarshal(changes, &cs.changes); err != nil {
+			return fmt.Errorf("change set %d: %w", id, err)
+		}
+		if err := json.Unmarshal(ops, &cs.ops); err != nil {
+			return fmt.Errorf("change set %d: %w", id, err)
+		}
+		if err := apply(tx, &cs); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, sqlResolveChangeSet, id, string(status), r.now(), user); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
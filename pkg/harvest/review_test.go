@@ -0,0 +1,129 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReview(t *testing.T) {
+	now := time.Date(2020, 10, 3, 12, 0, 0, 0, time.UTC)
+	newDB := func() *fakeDB {
+		return &fakeDB{changeSets: map[int64]fakeChangeSet{
+			1: {status: ChangeSetPending, sourceID: 1,
+				changes: []Change{{Kind: ChangeNew, URN: "urn:nbn:se:kb:1", URL: "http://example.com/1"}},
+				ops: []ChangeOp{
+					{Insert: &Mapping{URN: "urn:nbn:se:kb:1", URL: "http://example.com/1", SourceID: 1}},
+					{History: &History{URN: "urn:nbn:se:kb:1", URLNew: "http://example.com/1"}},
+				}},
+			2: {status: ChangeSetRejected},
+		}}
+	}
+	newReview := func(db *fakeDB) *Review {
+		r := NewReview(db)
+		r.now = func() time.Time { return now }
+		return r
+	}
+
+	t.Run("approve", func(t *testing.T) {
+		db := newDB()
+		if err := newReview(db).Approve(context.Background(), 1, "jack"); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if !db.committed {
+			t.Error("approval not committed")
+		}
+		if len(db.executed(sqlInsertMapping, true)) != 1 {
+			t.Error("mapping not inserted")
+		}
+		if h := db.executed(sqlInsertHistory, true); len(h) != 1 || h[0].args[8] != "jack" {
+			t.Errorf("history not attributed to approver: %+v", h)
+		}
+		r := db.executed(sqlResolveChangeSet, true)
+		if len(r) != 1 || r[0].args[1] != string(ChangeSetApproved) || r[0].args[2] != now || r[0].args[3] != "jack" {
+			t.Errorf("change set not resolved: %+v", r)
+		}
+		if len(db.executed(sqlApproveLastRun, true)) != 1 {
+			t.Error("last successful run start not updated")
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		db := newDB()
+		if err := newReview(db).Reject(context.Background(), 1, "jack"); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(db.executed(sqlInsertMapping, true)) != 0 || len(db.executed(sqlApproveLastRun, true)) != 0 {
+			t.Error("rejected changes applied")
+		}
+		if r := db.executed(sqlResolveChangeSet, true); len(r) != 1 || r[0].args[1] != string(ChangeSetRejected) {
+			t.Errorf("change set not resolved: %+v", r)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		db := newDB()
+		// added by hand since the run
+		db.mappings = []Mapping{{URN: "urn:nbn:se:kb:1", URL: "http://example.com/other", SourceID: 1}}
+		if err := newReview(db).Approve(context.Background(), 1, "jack"); !errors.Is(err, ErrChangeSetStale) {
+			t.Errorf("want: %v, got: %v", ErrChangeSetStale, err)
+		}
+		if db.committed || len(db.execs) != 0 {
+			t.Errorf("stale change set applied: %+v", db.execs)
+		}
+
+		// mappings of other sources don't make it stale
+		db = newDB()
+		db.mappings = []Mapping{{URN: "urn:nbn:se:kb:1", URL: "http://example.com/other", SourceID: 2}}
+		if err := newReview(db).Approve(context.Background(), 1, "jack"); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if err := newReview(newDB()).Reject(context.Background(), 1, "jack"); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	})
+
+	t.Run("stale bookkeeping", func(t *testing.T) {
+		missing := &Mapping{URN: "urn:nbn:se:kb:2", URL: "http://example.com/2", SourceID: 1, MissingRuns: 1}
+		newDB := func(current Mapping) *fakeDB {
+			return &fakeDB{
+				mappings: []Mapping{current},
+				changeSets: map[int64]fakeChangeSet{
+					1: {status: ChangeSetPending, sourceID: 1,
+						ops: []ChangeOp{{Update: missing, Old: &Mapping{URN: "urn:nbn:se:kb:2", URL: "http://example.com/2", SourceID: 1}}}},
+				},
+			}
+		}
+
+		// the URL was changed by hand, and approving would revert it with the missing count
+		db := newDB(Mapping{URN: "urn:nbn:se:kb:2", URL: "http://example.com/edited", SourceID: 1})
+		if err := newReview(db).Approve(context.Background(), 1, "jack"); !errors.Is(err, ErrChangeSetStale) {
+			t.Errorf("want: %v, got: %v", ErrChangeSetStale, err)
+		}
+		if db.committed || len(db.execs) != 0 {
+			t.Errorf("stale change set applied: %+v", db.execs)
+		}
+
+		db = newDB(Mapping{URN: "urn:nbn:se:kb:2", URL: "http://example.com/2", SourceID: 1})
+		if err := newReview(db).Approve(context.Background(), 1, "jack"); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if u := db.executed(sqlUpdateMapping, true); len(u) != 1 {
+			t.Errorf("missing count not updated: %+v", u)
+		}
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		db := newDB()
+		if err := newReview(db).Approve(context.Background(), 2, "jack"); !errors.Is(err, ErrChangeSetResolved) {
+			t.Errorf("want: %v, got: %v", ErrChangeSetResolved, err)
+		}
+		if err := newReview(db).Reject(context.Background(), 3, "jack"); !errors.Is(err, ErrUnknownChangeSet) {
+			t.Errorf("want: %v, got: %v", ErrUnknownChangeSet, err)
+		}
+		if db.committed || len(db.execs) != 0 {
+			t.Errorf("resolved change set changed: %+v", db.execs)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package harvest
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Rules describe the quirks of a source, so repositories that need special treatment can be configured
+// without code changes. They are stored as JSON in the rules column of the source table, for example:
+//
+//	{
+//	  "rewrite": [{"pattern": "^http://hdl\\.handle\\.net/", "replacement": "http://helda.helsinki.fi/handle/"}],
+//	  "prefer": ["^http://helda\\.helsinki\\.fi/handle/"],
+//	  "exclude_owned_by": [3, 7],
+//	  "landing_page": [{"field": "856", "match": {"ind2": "0", "3": "Fulltext"}}]
+//	}
+type Rules struct {
+	// Rewrite rules are applied in order to every candidate URL before the source's URL pattern is checked.
+	Rewrite []RewriteRule `json:"rewrite,omitempty"`
+
+	// Prefer lists URL patterns in order of preference. If a record has several acceptable URLs,
+	// the one matching the earliest pattern wins; among equals, the last URL wins.
+	Prefer []string `json:"prefer,omitempty"`
+
+	// ExcludeOwnedBy lists the ids of sources whose URNs are skipped by this source,
+	// for repositories that contain copies of another repository's items.
+	ExcludeOwnedBy []int `json:"exclude_owned_by,omitempty"`
+
+	// LandingPage lists the metadata fields that hold the landing page of a record, in order of preference, for
+	// OAI-PMH sources harvested in a format other than oai_dc. Only the URLs of the first rule that matches any
+	// of a record's fields are candidates; if none matches, all of its URLs are.
+	LandingPage []FieldRule `json:"landing_page,omitempty"`
+}
+
+// FieldRule matches the URLs found in a metadata field, such as MARC 856 or MODS url, whose attributes have the
+// given values, such as {"ind2": "0"} or {"usage": "primary display"}. Values are compared without regard to
+// case; an attribute the field doesn't have is empty.
+type FieldRule struct {
+	Field string            `json:"field"`
+	Match map[string]string `json:"match,omitempty"`
+}
+
+// RewriteRule replaces the parts of a URL matching a regular expression.
+// The replacement can refer to submatches as in regexp.ReplaceAllString.
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// ParseRules decodes rules from their JSON representation. An empty string gives empty rules.
+func ParseRules(s string) (Rules, error) {
+	var rules Rules
+	if s == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return rules, fmt.Errorf("invalid source rules: %w", err)
+	}
+	return rules, nil
+}
+
+// rewriter is a compiled rewrite rule.
+type rewriter struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// compiledRules holds the compiled regular expressions of a rule set.
+type compiledRules struct {
+	rewrite  []rewriter
+	prefer   []*regexp.Regexp
+	excluded map[int]bool
+}
+
+// compile checks and compiles the regular expressions of a rule set.
+func (rules *Rules) compile() (*compiledRules, error) {
+	c := &compiledRules{
+		excluded: make(map[int]bool, len(rules.ExcludeOwnedBy)),
+	}
+
+	for i, rule := range rules.Rewrite {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %w", i, err)
+		}
+		c.rewrite = append(c.rewrite, rewriter{re: re, replacement: rule.Replacement})
+	}
+
+	for i, pattern := range rules.Prefer {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("prefer rule %d: %w", i, err)
+		}
+		c.prefer = append(c.prefer, re)
+	}
+
+	for _, id := range rules.ExcludeOwnedBy {
+		c.excluded[id] = true
+	}
+
+	for i, rule := range rules.LandingPage {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("landing page rule %d: no field", i)
+		}
+	}
+	return c, nil
+}
+
+// rewriteURL applies the rewrite rules to a URL.
+func (c *compiledRules) rewriteURL(url string) string {
+	for _, rw := range c.rewrite {
+		url = rw.re.ReplaceAllString(url, rw.replacement)
+	}
+	return url
+}
+
+// rank returns the preference of a URL; lower is better. URLs that match no preference rule rank last.
+func (c *compiledRules) rank(url string) int {
+	for i, re := range c.prefer {
+		if re.MatchString(url) {
+			return i
+		}
+	}
+	return len(c.prefer)
+}
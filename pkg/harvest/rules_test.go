@@ -0,0 +1,102 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const testHeldaRules = `{
+	"rewrite": [{"pattern": "^http://hdl\\.handle\\.net/", "replacement": "http://helda.helsinki.fi/handle/"}],
+	"prefer": ["^http://helda\\.helsinki\\.fi/handle/"]
+}`
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(testHeldaRules)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(rules.Rewrite) != 1 || len(rules.Prefer) != 1 || rules.ExcludeOwnedBy != nil {
+		t.Errorf("wrong rules: %+v", rules)
+	}
+
+	if rules, err := ParseRules(""); err != nil || len(rules.Rewrite) != 0 {
+		t.Errorf("expected empty rules for empty string, got: %+v, err: %v", rules, err)
+	}
+
+	if _, err := ParseRules(`{"rewrite": "nope"}`); err == nil {
+		t.Error("expected error for invalid rules, got nil")
+	}
+
+	src := &Source{Title: "broken", Rules: Rules{Prefer: []string{"(("}}}
+	if _, err := NewHandler(&memStore{}, src, nil); err == nil {
+		t.Error("expected error for invalid prefer pattern, got nil")
+	}
+
+	src = &Source{Title: "broken", Rules: Rules{LandingPage: []FieldRule{{Match: map[string]string{"ind2": "0"}}}}}
+	if _, err := NewHandler(&memStore{}, src, nil); err == nil {
+		t.Error("expected error for landing page rule without field, got nil")
+	}
+}
+
+func TestRewriteAndPrefer(t *testing.T) {
+	rules, err := ParseRules(testHeldaRules)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	src := &Source{ID: 1, Title: "helda", URLPattern: `http://helda\.helsinki\.fi/|http://example\.com/`, Rules: rules}
+
+	tests := []struct {
+		urls []string
+		want string
+	}{
+		{[]string{"http://hdl.handle.net/10138/1"}, "http://helda.helsinki.fi/handle/10138/1"},
+		{[]string{"http://helda.helsinki.fi/handle/10138/1", "http://hdl.handle.net/10138/2"}, "http://helda.helsinki.fi/handle/10138/2"},
+		{[]string{"http://helda.helsinki.fi/handle/10138/1", "http://example.com/1"}, "http://helda.helsinki.fi/handle/10138/1"},
+		{[]string{"http://example.com/1", "http://helda.helsinki.fi/handle/10138/1"}, "http://helda.helsinki.fi/handle/10138/1"},
+		{[]string{"http://example.com/1", "http://example.com/2"}, "http://example.com/2"},
+	}
+
+	h, err := NewHandler(&memStore{}, src, nil)
+	if err != nil {
+		t.Fatal("can't create handler:", err)
+	}
+	for _, test := range tests {
+		h.Reset()
+		for _, url := range test.urls {
+			h.SetURL(url)
+		}
+		if h.url != test.want {
+			t.Errorf("SetURL(%q): want: %q, got: %q", test.urls, test.want, h.url)
+		}
+	}
+}
+
+func TestExcludeOwnedBy(t *testing.T) {
+	store := &memStore{mappings: []Mapping{
+		{URN: "urn:nbn:fi-ethesis1", URL: "http://helda.helsinki.fi/handle/1", SourceID: 2},
+		{URN: "urn:nbn:fi-other", URL: "http://example.org/other", SourceID: 3},
+	}}
+	src := &Source{ID: 1, Title: "doria", Rules: Rules{ExcludeOwnedBy: []int{2}}}
+
+	h, err := NewHandler(store, src, nil)
+	if err != nil {
+		t.Fatal("can't create handler:", err)
+	}
+
+	h.SetURN("urn:nbn:fi-ethesis1")
+	h.SetURL("http://doria.fi/handle/1")
+	if err := h.WriteURL(context.Background()); !errors.Is(err, ErrExcluded) {
+		t.Errorf("want: %v, got: %v", ErrExcluded, err)
+	}
+
+	h.Reset()
+	h.SetURN("urn:nbn:fi-other")
+	h.SetURL("http://doria.fi/handle/2")
+	if err := h.WriteURL(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if store.url("urn:nbn:fi-other", 1) != "http://doria.fi/handle/2" {
+		t.Errorf("mapping for URN of non-excluded source not written: %+v", store.mappings)
+	}
+}
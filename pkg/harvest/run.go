@@ -0,0 +1,211 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// RunStatus is the outcome of a harvest run. It mirrors the harvest_status enum in the database.
+type RunStatus string
+
+// Run statuses known to the harvester.
+const (
+	RunSuccess       RunStatus = "success"
+	RunFailed        RunStatus = "failed"
+	RunNeedsApproval RunStatus = "needs_approval"
+)
+
+// Run is a row in the harvest_run table, the ledger of harvests. Error is the error of a failed run,
+// or why a run needs approval.
+type Run struct {
+	ID        int64
+	SourceID  int
+	Start     time.Time
+	End       time.Time
+	Full      bool
+	Status    RunStatus
+	Records   int
+	Warnings  int
+	Rejected  int
+	Withdrawn int
+	Retries   int
+	Error     string
+	// run whose checkpoint this run resumed, or 0
+	ResumedFrom int64
+}
+
+// TxBeginner is a Querier that can start transactions.
+// It is satisfied by *pgx.Conn and *pgxpool.Pool.
+type TxBeginner interface {
+	Querier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Run harvests a source inside a single transaction and records the run in the harvest_run table.
+//
+// If the harvest succeeds, its changes, the run record and the source's last_successful_run_start are committed
+// together, and pending change sets of the source are superseded. If it fails, all changes are rolled back and
+// only a failed run record is written.
+//
+// If the run would change more mappings than the source's anomaly thresholds allow, its changes are held in the
+// change_set table instead, the run is recorded as needing approval, the source's contact is notified and
+// an error wrapping ErrNeedsApproval is returned. Runs of sources that require review are held the same way,
+// without notification or error. See Review for approving held changes.
+//
+// Unless full is set, sources that support it are harvested incrementally: only records changed since the
+// start of the last successful run are requested. The first harvest of a source is always full.
+//
+// An OAI-PMH run that got past its first page leaves a checkpoint with its last resumption token if it fails or is
+// killed. The next run that asks for the same records continues from that token instead of starting over, as long
+// as the token has not expired, and counts as starting when the failed run did. Checkpoints are written with db
+// outside the run's transaction, so db should be a pool, with a connection to spare for them.
+func (hv *Harvester) Run(ctx context.Context, db TxBeginner, src *Source, full bool) (*Result, error) {
+	since := sinceLastRun(src, full)
+	run := &Run{
+		SourceID: src.ID,
+		Start:    hv.now(),
+		Full:     since.IsZero(),
+	}
+
+	p := hv.newProgress(ctx, db, src, run, since)
+	res, err := hv.runTx(ctx, db, src, run, since, p)
+	if err != nil {
+		run.Status = RunFailed
+		run.Error = err.Error()
+		run.End = hv.now()
+		run.count(res)
+		if lerr := insertRun(ctx, db, run); lerr != nil {
+			hv.logger.Log("msg", "can't record failed run", "source", src.Title, "err", lerr)
+		}
+		if p != nil {
+			hv.saveFailed(ctx, db, src, run, p, res, err)
+		}
+		return res, err
+	}
+
+	if run.Status == RunNeedsApproval {
+		if run.Error == reasonReview {
+			hv.logger.Log("msg", "run held for review", "source", src.Title, "run", run.ID, "changes", len(res.changes))
+			return res, nil
+		}
+		hv.logger.Log("msg", "run quarantined", "source", src.Title, "run", run.ID, "reason", run.Error)
+		hv.notifyQuarantine(ctx, src, run, res.changes)
+		return res, fmt.Errorf("%w: %s", ErrNeedsApproval, run.Error)
+	}
+	return res, nil
+}
+
+// sinceLastRun returns the time since which a source is harvested, or the zero time for a full harvest. Only
+// OAI-PMH sources can be harvested incrementally; the other formats always return every record.
+func sinceLastRun(src *Source, full bool) time.Time {
+	if full || src.Format != FormatOAIPMH {
+		return time.Time{}
+	}
+	return src.LastSuccessfulRunStart
+}
+
+// runTx harvests a source in a transaction and commits it along with the run record, or holds its changes
+// for approval. If p resumes a checkpoint, the changes harvested before it are replayed first.
+func (hv *Harvester) runTx(ctx context.Context, db TxBeginner, src *Source, run *Run, since time.Time, p *progress) (*Result, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// no-op after commit
+	defer tx.Rollback(ctx)
+
+	var existing int
+	if err := tx.QueryRow(ctx, sqlCountSourceMappings, src.ID).Scan(&existing); err != nil {
+		return nil, err
+	}
+
+	store := NewStore(tx)
+	cs := NewChangeSet(store)
+	start := run.Start
+	if p != nil {
+		p.cs = cs
+		start = p.started
+		if p.resume != nil {
+			if err := ApplyOps(ctx, cs, p.resume.State.Ops); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res, err := hv.harvestSince(ctx, cs, src, since, p)
+	if err != nil {
+		return res, err
+	}
+	res.changes = cs.Changes()
+
+	run.End = hv.now()
+	run.count(res)
+	reason := checkChanges(src, existing, res.changes)
+	if reason == "" && src.ReviewRequired {
+		reason = reasonReview
+	}
+	if reason != "" {
+		run.Status = RunNeedsApproval
+		run.Error = reason
+		if err := insertRun(ctx, tx, run); err != nil {
+			return res, err
+		}
+		if err := stageChangeSet(ctx, tx, run, cs); err != nil {
+			return res, err
+		}
+		if err := deleteCheckpoint(ctx, tx, src.ID); err != nil {
+			return res, err
+		}
+		return res, tx.Commit(ctx)
+	}
+
+	if err := cs.Apply(ctx, store); err != nil {
+		return res, err
+	}
+	run.Status = RunSuccess
+	if err := insertRun(ctx, tx, run); err != nil {
+		return res, err
+	}
+	if _, err := tx.Exec(ctx, sqlUpdateLastRun, src.ID, start); err != nil {
+		return res, err
+	}
+	if _, err := tx.Exec(ctx, sqlSupersedeChangeSets, src.ID, run.End); err != nil {
+		return res, err
+	}
+	if err := deleteCheckpoint(ctx, tx, src.ID); err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// count copies the counters of a harvest result into the run record.
+func (run *Run) count(res *Result) {
+	if res == nil {
+		return
+	}
+	run.Records = res.Records
+	run.Warnings = len(res.Warnings)
+	run.Rejected = len(res.Rejected)
+	run.Withdrawn = res.Withdrawn
+	run.Retries = res.Retries
+}
+
+// insertRun writes a run record and sets its id.
+func insertRun(ctx context.Context, db Querier, run *Run) error {
+	return db.QueryRow(ctx, sqlInsertRun,
+		run.SourceID,
+		run.Start,
+		run.End,
+		run.Full,
+		string(run.Status),
+		run.Records,
+		run.Warnings,
+		run.Rejected,
+		run.Withdrawn,
+		run.Retries,
+		nullable(run.Error),
+		nullableID(run.ResumedFrom),
+	).Scan(&run.ID)
+}
@@ -0,0 +1,510 @@
+package harvest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// fakeDB is a TxBeginner that records the statements executed on it and on its transactions.
+// Mapping queries are answered from mappings; writes are recorded, not applied.
+type fakeDB struct {
+	mu         sync.Mutex
+	mappings   []Mapping
+	changeSets map[int64]fakeChangeSet
+	// arguments of the last saved checkpoint, or nil, and the states of its pages
+	checkpoint []interface{}
+	pages      map[int][]byte
+	execs      []fakeExec
+	runs       []fakeExec
+	committed  bool
+	rolledBack bool
+}
+
+// fakeExec is a statement with its arguments.
+type fakeExec struct {
+	sql  string
+	args []interface{}
+	tx   bool
+}
+
+func (db *fakeDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return db.exec(sql, args, false)
+}
+
+func (db *fakeDB) exec(sql string, args []interface{}, tx bool) (pgconn.CommandTag, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.execs = append(db.execs, fakeExec{sql: sql, args: args, tx: tx})
+	switch sql {
+	case sqlSaveCheckpoint:
+		db.checkpoint = args
+		for page := range db.pages {
+			if page >= args[4].(int) {
+				delete(db.pages, page)
+			}
+		}
+	case sqlSaveCheckpointPage:
+		if db.pages == nil {
+			db.pages = make(map[int][]byte)
+		}
+		db.pages[args[1].(int)] = args[2].([]byte)
+	case sqlDeleteCheckpoint:
+		db.checkpoint, db.pages = nil, nil
+	}
+	return nil, nil
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	var match func(m *Mapping) bool
+	switch sql {
+	case sqlMappingsByURN:
+		match = func(m *Mapping) bool { return m.URN == args[0] }
+	case sqlMappingsBySource:
+		match = func(m *Mapping) bool { return m.SourceID == args[0] }
+	case sqlMappingsByOAIIdentifier:
+		match = func(m *Mapping) bool { return m.SourceID == args[0] && m.OAIIdentifier == args[1] }
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", sql)
+	}
+
+	rows := &fakeRows{}
+	for i := range db.mappings {
+		if match(&db.mappings[i]) {
+			rows.mappings = append(rows.mappings, db.mappings[i])
+		}
+	}
+	return rows, nil
+}
+
+func (db *fakeDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return db.queryRow(sql, args, false)
+}
+
+func (db *fakeDB) queryRow(sql string, args []interface{}, tx bool) pgx.Row {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch sql {
+	case sqlInsertRun:
+		db.runs = append(db.runs, fakeExec{sql: sql, args: args, tx: tx})
+		return fakeRow(len(db.runs))
+	case sqlCountSourceMappings:
+		n := 0
+		for _, m := range db.mappings {
+			if m.SourceID == args[0] && !m.IsWithdrawn() {
+				n++
+			}
+		}
+		return fakeRow(n)
+	case sqlLockChangeSet:
+		cs, ok := db.changeSets[args[0].(int64)]
+		if !ok {
+			return errRow{pgx.ErrNoRows}
+		}
+		return cs
+	case sqlCheckpoint:
+		if db.checkpoint == nil {
+			return errRow{pgx.ErrNoRows}
+		}
+		return fakeCheckpoint{args: db.checkpoint, pages: db.pages}
+	}
+	return fakeRow(0)
+}
+
+func (db *fakeDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	return &fakeTx{db: db}, nil
+}
+
+// executed returns the statements of a kind executed in transactions, or outside them.
+func (db *fakeDB) executed(sql string, tx bool) []fakeExec {
+	var found []fakeExec
+	for _, e := range db.execs {
+		if e.sql == sql && e.tx == tx {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// fakeTx is a transaction of a fakeDB. Methods not used by the harvester panic.
+type fakeTx struct {
+	pgx.Tx
+	db   *fakeDB
+	done bool
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return tx.db.exec(sql, args, true)
+}
+
+func (tx *fakeTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return tx.db.Query(ctx, sql, args...)
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return tx.db.queryRow(sql, args, true)
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if !tx.done {
+		tx.done, tx.db.committed = true, true
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback(ctx context.Context) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if !tx.done {
+		tx.done, tx.db.rolledBack = true, true
+	}
+	return nil
+}
+
+// fakeRows is a result set of mappings, scanned like the columns of sqlMappingsByURN.
+type fakeRows struct {
+	pgx.Rows
+	mappings []Mapping
+	current  Mapping
+}
+
+func (r *fakeRows) Next() bool {
+	if len(r.mappings) == 0 {
+		return false
+	}
+	r.current, r.mappings = r.mappings[0], r.mappings[1:]
+	return true
+}
+
+func (r *fakeRows) Err() error { return nil }
+func (r *fakeRows) Close()     {}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	m := r.current
+	*dest[0].(*string) = m.URN
+	*dest[1].(*string) = m.URL
+	*dest[2].(*int) = m.SourceID
+	*dest[3].(*URLType) = m.URLType
+	*dest[4].(*string) = m.RComponent
+	*dest[5].(*string) = m.OAIIdentifier
+	*dest[6].(*int) = m.MissingRuns
+	if m.IsWithdrawn() {
+		*dest[7].(**time.Time) = &m.Withdrawn
+	}
+	return nil
+}
+
+// fakeRow is a row with a single integer column.
+type fakeRow int
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	switch d := dest[0].(type) {
+	case *int64:
+		*d = int64(r)
+	case *int:
+		*d = int(r)
+	}
+	return nil
+}
+
+// fakeChangeSet is a locked row of the change_set table.
+type fakeChangeSet struct {
+	status   ChangeSetStatus
+	sourceID int
+	changes  []Change
+	ops      []ChangeOp
+}
+
+func (cs fakeChangeSet) Scan(dest ...interface{}) error {
+	*dest[0].(*ChangeSetStatus) = cs.status
+	*dest[1].(*int) = cs.sourceID
+	changes, err := json.Marshal(cs.changes)
+	if err != nil {
+		return err
+	}
+	*dest[2].(*[]byte) = changes
+	ops, err := json.Marshal(cs.ops)
+	*dest[3].(*[]byte) = ops
+	return err
+}
+
+// fakeCheckpoint is a row of the harvest_checkpoint table, made of the arguments that saved it, with the states
+// of its pages.
+type fakeCheckpoint struct {
+	args  []interface{}
+	pages map[int][]byte
+}
+
+func (cp fakeCheckpoint) Scan(dest ...interface{}) error {
+	args := cp.args
+	if id, ok := args[1].(int64); ok {
+		*dest[0].(**int64) = &id
+	}
+	*dest[1].(*time.Time) = args[2].(time.Time)
+	if t, ok := args[3].(time.Time); ok {
+		*dest[2].(**time.Time) = &t
+	}
+	*dest[3].(*int) = args[4].(int)
+	*dest[4].(*string) = args[5].(string)
+	if t, ok := args[6].(time.Time); ok {
+		*dest[5].(**time.Time) = &t
+	}
+	*dest[6].(*time.Time) = args[7].(time.Time)
+	*dest[7].(*[]byte) = args[8].([]byte)
+	if set, ok := args[9].(string); ok {
+		*dest[8].(*string) = set
+	}
+
+	var pages []int
+	for page := range cp.pages {
+		if page < args[4].(int) {
+			pages = append(pages, page)
+		}
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+	sort.Ints(pages)
+	states := make([]json.RawMessage, len(pages))
+	for i, page := range pages {
+		states[i] = cp.pages[page]
+	}
+	b, err := json.Marshal(states)
+	*dest[9].(*[]byte) = b
+	return err
+}
+
+// errRow is a row that fails to scan.
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(dest ...interface{}) error {
+	return r.err
+}
+
+// fakeNotifier records the recipients of notifications.
+type fakeNotifier struct {
+	sent []string
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, to, subject, body string) error {
+	n.sent = append(n.sent, to)
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	var from string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/swedish":
+			fmt.Fprint(w, testSwedishDump)
+		case "/oai":
+			from = r.URL.Query().Get("from")
+			fmt.Fprint(w, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><error code="noRecordsMatch"/></OAI-PMH>`)
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Date(2020, 10, 2, 3, 0, 0, 0, time.UTC)
+	newHarvester := func() *Harvester {
+		hv := New(srv.Client(), nil, WithDelay(0), WithRetryLimit(0))
+		hv.now = func() time.Time { return start }
+		return hv
+	}
+
+	t.Run("success", func(t *testing.T) {
+		src := *testSource
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + "/swedish"
+
+		db := &fakeDB{}
+		res, err := newHarvester().Run(context.Background(), db, &src, false)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if !db.committed {
+			t.Error("transaction not committed")
+		}
+		if len(db.runs) != 1 || !db.runs[0].tx {
+			t.Fatalf("expected one run record in the transaction, got: %+v", db.runs)
+		}
+		args := db.runs[0].args
+		if args[3] != true || args[4] != string(RunSuccess) || args[5] != res.Records || args[6] != len(res.Warnings) {
+			t.Errorf("wrong run record: %v", args)
+		}
+		if len(db.executed(sqlUpdateLastRun, true)) != 1 {
+			t.Error("last successful run start not updated")
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		src := *testSource
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + "/broken"
+
+		db := &fakeDB{}
+		if _, err := newHarvester().Run(context.Background(), db, &src, false); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if db.committed || !db.rolledBack {
+			t.Errorf("transaction not rolled back, committed: %t, rolled back: %t", db.committed, db.rolledBack)
+		}
+		if len(db.runs) != 1 || db.runs[0].tx {
+			t.Fatalf("expected one run record outside the transaction, got: %+v", db.runs)
+		}
+		if args := db.runs[0].args; args[4] != string(RunFailed) || args[10] == nil {
+			t.Errorf("wrong run record: %v", args)
+		}
+		if len(db.executed(sqlUpdateLastRun, true)) != 0 {
+			t.Error("last successful run start updated for failed run")
+		}
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		src := *testSource
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + "/swedish"
+		src.Email = "repository@example.com"
+		src.MaxChanges = 1
+		src.MaxChangesPercent = 10
+
+		db := &fakeDB{mappings: []Mapping{
+			{URN: "urn:nbn:se:kb:1", URL: "http://example.com/1-old", SourceID: 1},
+			{URN: "urn:nbn:se:kb:6", URL: "http://example.com/6-old", SourceID: 1},
+			{URN: "urn:nbn:se:kb:7", URL: "http://example.com/7", SourceID: 1},
+		}}
+		notifier := &fakeNotifier{}
+		hv := newHarvester()
+		hv.notifier = notifier
+
+		_, err := hv.Run(context.Background(), db, &src, true)
+		if !errors.Is(err, ErrNeedsApproval) {
+			t.Fatalf("want: %v, got: %v", ErrNeedsApproval, err)
+		}
+		if !db.committed {
+			t.Error("quarantine not committed")
+		}
+		if len(db.runs) != 1 || db.runs[0].args[4] != string(RunNeedsApproval) {
+			t.Errorf("wrong run record: %+v", db.runs)
+		}
+		if q := db.executed(sqlInsertChangeSet, true); len(q) != 1 || q[0].args[0] != int64(1) {
+			t.Errorf("changes not quarantined: %+v", q)
+		}
+		for _, sql := range []string{sqlInsertMapping, sqlUpdateMapping, sqlInsertHistory, sqlUpdateLastRun} {
+			if len(db.executed(sql, true)) != 0 {
+				t.Errorf("quarantined run executed %s", sql)
+			}
+		}
+		if len(notifier.sent) != 1 || notifier.sent[0] != src.Email {
+			t.Errorf("source contact not notified: %v", notifier.sent)
+		}
+
+		// below both thresholds
+		src.MaxChanges, src.MaxChangesPercent = 2, 70
+		db.execs, db.runs, db.committed = nil, nil, false
+		if _, err := newHarvester().Run(context.Background(), db, &src, true); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(db.executed(sqlUpdateMapping, true)) == 0 || len(db.executed(sqlInsertChangeSet, true)) != 0 {
+			t.Error("changes not applied")
+		}
+	})
+
+	t.Run("review", func(t *testing.T) {
+		src := *testSource
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + "/swedish"
+		src.Email = "repository@example.com"
+		src.ReviewRequired = true
+
+		db := &fakeDB{}
+		notifier := &fakeNotifier{}
+		hv := newHarvester()
+		hv.notifier = notifier
+
+		if _, err := hv.Run(context.Background(), db, &src, true); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(db.runs) != 1 || db.runs[0].args[4] != string(RunNeedsApproval) {
+			t.Errorf("wrong run record: %+v", db.runs)
+		}
+		if len(db.executed(sqlSupersedeChangeSets, true)) != 1 {
+			t.Error("pending change sets not superseded")
+		}
+		if q := db.executed(sqlInsertChangeSet, true); len(q) != 1 || q[0].args[3] != reasonReview {
+			t.Errorf("changes not staged for review: %+v", q)
+		}
+		if len(db.executed(sqlInsertMapping, true)) != 0 || len(db.executed(sqlUpdateLastRun, true)) != 0 {
+			t.Error("changes applied without review")
+		}
+		if len(notifier.sent) != 0 {
+			t.Errorf("review run notified: %v", notifier.sent)
+		}
+	})
+
+	t.Run("incremental", func(t *testing.T) {
+		src := *testSource
+		src.StartURL = srv.URL + "/oai?verb=ListRecords&metadataPrefix=oai_dc"
+		src.LastSuccessfulRunStart = time.Date(2020, 9, 30, 22, 0, 0, 0, time.UTC)
+
+		db := &fakeDB{}
+		if _, err := newHarvester().Run(context.Background(), db, &src, false); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if from != "2020-09-30" {
+			t.Errorf("wrong from argument, want: %q, got: %q", "2020-09-30", from)
+		}
+		if db.runs[0].args[3] != false {
+			t.Error("incremental run recorded as full")
+		}
+
+		from = ""
+		if _, err := newHarvester().Run(context.Background(), &fakeDB{}, &src, true); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if from != "" {
+			t.Errorf("full run sent from argument %q", from)
+		}
+	})
+
+	t.Run("full only", func(t *testing.T) {
+		// the dump has no way to ask for changed records, so a run after a successful one is still full
+		src := *testSource
+		src.Format = FormatSwedish
+		src.StartURL = srv.URL + "/swedish"
+		src.LastSuccessfulRunStart = time.Date(2020, 9, 30, 22, 0, 0, 0, time.UTC)
+		src.WithdrawAfter = 1
+
+		db := &fakeDB{mappings: []Mapping{{URN: "urn:nbn:fi:example-9", URL: "http://example.com/9", SourceID: src.ID}}}
+		if _, err := newHarvester().Run(context.Background(), db, &src, false); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if db.runs[0].args[3] != true {
+			t.Error("run of a dump recorded as incremental")
+		}
+		withdrawn := false
+		for _, u := range db.executed(sqlUpdateMapping, true) {
+			if u.args[0] == "urn:nbn:fi:example-9" && u.args[7] != nil {
+				withdrawn = true
+			}
+		}
+		if !withdrawn {
+			t.Errorf("missing mapping not withdrawn: %+v", db.executed(sqlUpdateMapping, true))
+		}
+	})
+}
@@ -0,0 +1,159 @@
+// Package harvest implements the URN harvester, which collects URN to URL mappings from remote repositories
+// and writes them to the urn2url and urnhistory tables.
+package harvest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// ErrUnknownSource means no source with the requested title exists.
+	ErrUnknownSource = errors.New("unknown source")
+
+	// ErrUnknownFormat means the harvester has no parser for the source format.
+	ErrUnknownFormat = errors.New("unknown source format")
+)
+
+// Format is the harvest format of a source. It mirrors the source_format enum in the database.
+type Format string
+
+// Source formats known to the harvester.
+const (
+	FormatOAIPMH  Format = "OAI-PMH"
+	FormatSwedish Format = "Swedish"
+	FormatOulu    Format = "Oulu"
+	FormatMARC    Format = "MARC"
+	FormatCSV     Format = "CSV"
+	FormatTSV     Format = "TSV"
+	FormatJSONL   Format = "JSONL"
+)
+
+// URLType is the type of a mapping. It mirrors the url_type enum in the database.
+type URLType string
+
+// URL types known to the harvester.
+const (
+	URLTypeNormal       URLType = "normal"
+	URLTypeVapaakappale URLType = "vapaakappale"
+)
+
+// Source is a repository that publishes URN to URL mappings, as stored in the source table.
+// Nullable text columns are represented by the empty string, a NULL last_successful_run_start by the zero time.
+type Source struct {
+	ID          int
+	Title       string
+	Format      Format
+	StartURL    string
+	ResumeURL   string
+	Priority    int
+	Email       string
+	Description string
+	URLType     URLType
+	URLPattern  string
+	Rules       Rules
+
+	// WithdrawAfter is the number of consecutive full harvests a URN may be missing from the source before its
+	// mapping is withdrawn; values less than 1 disable withdrawal. See Handler.WithdrawMissing.
+	WithdrawAfter int
+
+	// MaxChanges and MaxChangesPercent are the anomaly thresholds: a run that changes or withdraws more mappings
+	// than either allows is held for approval; 0 means no limit. See Harvester.Run.
+	MaxChanges        int
+	MaxChangesPercent float64
+
+	// ReviewRequired puts the source on probation: the changes of every run are held for approval.
+	ReviewRequired bool
+
+	// LastSuccessfulRunStart is the start time of the last successful harvest, see Harvester.Run.
+	LastSuccessfulRunStart time.Time
+
+	// Sets are the OAI-PMH sets to harvest, each as a list of its own; records in several of them are harvested
+	// once. Without sets, the list of StartURL is harvested. MetadataPrefix, if set, replaces the metadataPrefix
+	// argument of StartURL.
+	Sets           []string
+	MetadataPrefix string
+
+	// Columns maps the columns or fields of CSV, TSV and JSONL sources to the parts of a mapping.
+	Columns Columns
+}
+
+// LoadSource loads the source with the given title from the database.
+func LoadSource(ctx context.Context, db Querier, title string) (*Source, error) {
+	src, err := scanSource(db.QueryRow(ctx, sqlSourceByTitle, title))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSource, title)
+		}
+		return nil, err
+	}
+	return src, nil
+}
+
+// LoadSources loads all sources from the database.
+func LoadSources(ctx context.Context, db Querier) ([]*Source, error) {
+	rows, err := db.Query(ctx, sqlSources)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sources []*Source
+	for rows.Next() {
+		src, err := scanSource(rows)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, rows.Err()
+}
+
+// scanSource scans a source selected with the columns of sqlSourceByTitle.
+func scanSource(row pgx.Row) (*Source, error) {
+	var (
+		src     Source
+		rules   string
+		columns string
+		lastRun *time.Time
+	)
+	err := row.Scan(
+		&src.ID,
+		&src.Title,
+		&src.Format,
+		&src.StartURL,
+		&src.ResumeURL,
+		&src.Priority,
+		&src.Email,
+		&src.Description,
+		&src.URLType,
+		&src.URLPattern,
+		&rules,
+		&src.WithdrawAfter,
+		&src.MaxChanges,
+		&src.MaxChangesPercent,
+		&src.ReviewRequired,
+		&lastRun,
+		&src.Sets,
+		&src.MetadataPrefix,
+		&columns,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastRun != nil {
+		src.LastSuccessfulRunStart = *lastRun
+	}
+	if src.Rules, err = ParseRules(rules); err != nil {
+		return nil, fmt.Errorf("source %s: %w", src.Title, err)
+	}
+	if src.Columns, err = ParseColumns(columns); err != nil {
+		return nil, fmt.Errorf("source %s: %w", src.Title, err)
+	}
+	return &src, nil
+}
@@ -0,0 +1,170 @@
+package harvest
+
+const (
+	// Select a source by title. Takes the title as argument.
+	sqlSourceByTitle = `
+SELECT source_id, title, format::text, start_url, COALESCE(resume_url, ''), priority,
+       COALESCE(email, ''), COALESCE(description, ''), COALESCE(source_type::text, ''), COALESCE(url_pattern, ''),
+       COALESCE(rules::text, ''), withdraw_after, COALESCE(max_changes, 0), COALESCE(max_changes_percent, 0),
+       review_required, last_successful_run_start, oai_sets, COALESCE(metadata_prefix, ''),
+       COALESCE(column_map::text, '')
+FROM source
+WHERE title = $1`
+
+	// Select all sources.
+	sqlSources = `
+SELECT source_id, title, format::text, start_url, COALESCE(resume_url, ''), priority,
+       COALESCE(email, ''), COALESCE(description, ''), COALESCE(source_type::text, ''), COALESCE(url_pattern, ''),
+       COALESCE(rules::text, ''), withdraw_after, COALESCE(max_changes, 0), COALESCE(max_changes_percent, 0),
+       review_required, last_successful_run_start, oai_sets, COALESCE(metadata_prefix, ''),
+       COALESCE(column_map::text, '')
+FROM source
+ORDER BY source_id`
+
+	// Select all mappings for a URN. Takes the URN as argument.
+	sqlMappingsByURN = `
+SELECT urn, url, COALESCE(source_id, 0), COALESCE(url_type::text, ''), COALESCE(r_component, ''),
+       COALESCE(oai_identifier, ''), missing_runs, withdrawn
+FROM urn2url
+WHERE urn = $1`
+
+	// Select all mappings of a source. Takes the source id as argument.
+	sqlMappingsBySource = `
+SELECT urn, url, COALESCE(source_id, 0), COALESCE(url_type::text, ''), COALESCE(r_component, ''),
+       COALESCE(oai_identifier, ''), missing_runs, withdrawn
+FROM urn2url
+WHERE source_id = $1`
+
+	// Count the mappings of a source that are not withdrawn. Takes the source id as argument.
+	sqlCountSourceMappings = `
+SELECT count(*)
+FROM urn2url
+WHERE source_id = $1 AND withdrawn IS NULL`
+
+	// Select the mappings of a source for an OAI-PMH identifier. Takes the source id and identifier as arguments.
+	sqlMappingsByOAIIdentifier = `
+SELECT urn, url, COALESCE(source_id, 0), COALESCE(url_type::text, ''), COALESCE(r_component, ''),
+       COALESCE(oai_identifier, ''), missing_runs, withdrawn
+FROM urn2url
+WHERE source_id = $1 AND oai_identifier = $2`
+
+	// Insert a mapping. Takes URN, URL, source id, URL type, r-component and OAI identifier as arguments.
+	sqlInsertMapping = `
+INSERT INTO urn2url (urn, url, source_id, url_type, r_component, oai_identifier)
+VALUES ($1, $2, $3, $4, $5, $6)`
+
+	// Update a source's mapping. Takes URN, source id, URL, URL type, r-component, OAI identifier, missing count
+	// and withdrawal time as arguments.
+	sqlUpdateMapping = `
+UPDATE urn2url
+SET url = $3, url_type = $4, r_component = $5, oai_identifier = $6, missing_runs = $7, withdrawn = $8
+WHERE urn = $1 AND source_id = $2`
+
+	// Insert a history entry. Takes URN, r-component, old and new URL, old and new URL type,
+	// harvest time, source URL, approving user and archived page as arguments.
+	sqlInsertHistory = `
+INSERT INTO urnhistory (urn, r_component, url_old, url_new, url_type_old, url_type_new, harvest_time, source_url, approved_by,
+                        archive_page)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	// Insert a harvest run record. Takes source id, start and end time, full flag, status, record, warning,
+	// rejection, withdrawal and retry counts, error message and resumed run id as arguments; returns the run id.
+	sqlInsertRun = `
+INSERT INTO harvest_run (source_id, start_time, end_time, full_harvest, status, records, warnings, rejected, withdrawn, retries, error,
+                         resumed_from)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+RETURNING run_id`
+
+	// Set the start time of a source's last successful run. Takes source id and start time as arguments.
+	sqlUpdateLastRun = `
+UPDATE source
+SET last_successful_run_start = $2
+WHERE source_id = $1`
+
+	// Mark the pending change sets of a source as superseded. Takes source id and time as arguments.
+	sqlSupersedeChangeSets = `
+UPDATE change_set
+SET status = 'superseded', resolved = $2
+WHERE source_id = $1 AND status = 'pending'`
+
+	// Hold the changes of a run for approval. Takes run id, source id, creation time, reason, changes and
+	// recorded writes as arguments.
+	sqlInsertChangeSet = `
+INSERT INTO change_set (run_id, source_id, created, reason, changes, ops)
+VALUES ($1, $2, $3, $4, $5, $6)`
+
+	// Select change sets, optionally by status. Takes the status or the empty string as argument.
+	sqlChangeSets = `
+SELECT c.run_id, c.source_id, s.title, c.created, c.reason, c.status::text, c.resolved, COALESCE(c.resolved_by, ''),
+       jsonb_array_length(c.changes)
+FROM change_set c JOIN source s USING (source_id)
+WHERE $1 = '' OR c.status::text = $1
+ORDER BY c.created, c.run_id`
+
+	// Select a change set with its changes and writes. Takes the run id as argument.
+	sqlChangeSet = `
+SELECT c.run_id, c.source_id, s.title, c.created, c.reason, c.status::text, c.resolved, COALESCE(c.resolved_by, ''),
+       jsonb_array_length(c.changes), c.changes, c.ops
+FROM change_set c JOIN source s USING (source_id)
+WHERE c.run_id = $1`
+
+	// Lock a change set for resolving. Takes the run id as argument.
+	sqlLockChangeSet = `
+SELECT status::text, source_id, changes, ops
+FROM change_set
+WHERE run_id = $1
+FOR UPDATE`
+
+	// Resolve a change set. Takes run id, status, time and user as arguments.
+	sqlResolveChangeSet = `
+UPDATE change_set
+SET status = $2, resolved = $3, resolved_by = $4
+WHERE run_id = $1`
+
+	// Set the last successful run start of a source to the start of an approved run, unless a later run
+	// succeeded. Takes the run id as argument.
+	sqlApproveLastRun = `
+UPDATE source
+SET last_successful_run_start = GREATEST(source.last_successful_run_start, r.start_time)
+FROM harvest_run r
+WHERE r.run_id = $1 AND source.source_id = r.source_id`
+
+	// Select the checkpoint of a source. Takes the source id as argument.
+	sqlCheckpoint = `
+SELECT c.run_id, c.started, c.since, c.page, c.token, c.expires, c.updated, c.state, COALESCE(c.oai_set, ''),
+       (SELECT jsonb_agg(p.state ORDER BY p.page)
+        FROM harvest_checkpoint_page p
+        WHERE p.source_id = c.source_id AND p.page < c.page)
+FROM harvest_checkpoint c
+WHERE c.source_id = $1`
+
+	// Insert or replace the checkpoint of a source, removing the pages of earlier runs from its page on. Takes
+	// source id, run id, start time, from date, page, token, expiration date, update time, state and set as
+	// arguments.
+	sqlSaveCheckpoint = `
+WITH pages AS (
+       DELETE FROM harvest_checkpoint_page
+       WHERE source_id = $1 AND page >= $5
+)
+INSERT INTO harvest_checkpoint (source_id, run_id, started, since, page, token, expires, updated, state, oai_set)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (source_id) DO UPDATE
+SET run_id = $2, started = $3, since = $4, page = $5, token = $6, expires = $7, updated = $8, state = $9, oai_set = $10`
+
+	// Insert or replace what a harvest harvested from the start of a page to its next checkpoint. Takes source
+	// id, page and state as arguments.
+	sqlSaveCheckpointPage = `
+INSERT INTO harvest_checkpoint_page (source_id, page, state)
+VALUES ($1, $2, $3)
+ON CONFLICT (source_id, page) DO UPDATE
+SET state = $3`
+
+	// Delete the checkpoint of a source with its pages. Takes the source id as argument.
+	sqlDeleteCheckpoint = `
+WITH pages AS (
+       DELETE FROM harvest_checkpoint_page
+       WHERE source_id = $1
+)
+DELETE FROM harvest_checkpoint
+WHERE source_id = $1`
+)
@@ -0,0 +1,185 @@
+package harvest
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Querier is the subset of the pgx API used by the harvester.
+// It is satisfied by *pgx.Conn, *pgxpool.Pool and pgx.Tx.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// Mapping is a row in the urn2url table. URN is the normalised name without components;
+// the r-component the source published the URN with, if any, is kept separately.
+// OAIIdentifier is the identifier of the OAI-PMH record the mapping was harvested from, if any.
+// MissingRuns counts the consecutive full harvests the URN was missing from its source, and Withdrawn is the time
+// the mapping was withdrawn because of that, or the zero time.
+type Mapping struct {
+	URN           string    `json:"urn"`
+	URL           string    `json:"url"`
+	SourceID      int       `json:"source_id"`
+	URLType       URLType   `json:"url_type,omitempty"`
+	RComponent    string    `json:"r_component,omitempty"`
+	OAIIdentifier string    `json:"oai_identifier,omitempty"`
+	MissingRuns   int       `json:"missing_runs,omitempty"`
+	Withdrawn     time.Time `json:"withdrawn"`
+}
+
+// IsWithdrawn checks if the mapping has been withdrawn.
+func (m *Mapping) IsWithdrawn() bool {
+	return !m.Withdrawn.IsZero()
+}
+
+// History is a row in the urnhistory table. An empty old URL means the mapping is new,
+// an empty new URL that it was withdrawn. ApprovedBy is the user who approved the change, if it was held for review.
+// ArchivePage is the id of the archived response the change was harvested from, if responses are archived.
+type History struct {
+	URN         string    `json:"urn"`
+	RComponent  string    `json:"r_component,omitempty"`
+	URLOld      string    `json:"url_old,omitempty"`
+	URLNew      string    `json:"url_new,omitempty"`
+	URLTypeOld  URLType   `json:"url_type_old,omitempty"`
+	URLTypeNew  URLType   `json:"url_type_new,omitempty"`
+	HarvestTime time.Time `json:"harvest_time"`
+	SourceURL   string    `json:"source_url"`
+	ApprovedBy  string    `json:"approved_by,omitempty"`
+	ArchivePage string    `json:"archive_page,omitempty"`
+}
+
+// Store is the persistence layer used by format handlers.
+type Store interface {
+	// Mappings returns all mappings for a URN, from any source.
+	Mappings(ctx context.Context, urn string) ([]Mapping, error)
+	// SourceMappings returns all mappings of a source.
+	SourceMappings(ctx context.Context, sourceID int) ([]Mapping, error)
+	// OAIMappings returns the mappings of a source harvested from the OAI-PMH record with the given identifier.
+	OAIMappings(ctx context.Context, sourceID int, identifier string) ([]Mapping, error)
+	// InsertMapping adds a new mapping.
+	InsertMapping(ctx context.Context, m *Mapping) error
+	// UpdateMapping changes the URL, r-component, OAI identifier, missing count and withdrawal time of an existing
+	// mapping identified by URN and source id.
+	UpdateMapping(ctx context.Context, m *Mapping) error
+	// InsertHistory records a change to a mapping.
+	InsertHistory(ctx context.Context, h *History) error
+}
+
+// pgStore is a Store backed by Postgresql.
+type pgStore struct {
+	db Querier
+}
+
+// NewStore returns a Store that uses parameterised queries on the given database handle.
+// Pass a transaction to make all writes of a harvest atomic.
+func NewStore(db Querier) Store {
+	return &pgStore{db: db}
+}
+
+func (s *pgStore) Mappings(ctx context.Context, urn string) ([]Mapping, error) {
+	return s.queryMappings(ctx, sqlMappingsByURN, urn)
+}
+
+func (s *pgStore) SourceMappings(ctx context.Context, sourceID int) ([]Mapping, error) {
+	return s.queryMappings(ctx, sqlMappingsBySource, sourceID)
+}
+
+func (s *pgStore) OAIMappings(ctx context.Context, sourceID int, identifier string) ([]Mapping, error) {
+	return s.queryMappings(ctx, sqlMappingsByOAIIdentifier, sourceID, identifier)
+}
+
+// queryMappings runs a query selecting the columns of sqlMappingsByURN.
+func (s *pgStore) queryMappings(ctx context.Context, sql string, args ...interface{}) ([]Mapping, error) {
+	rows, err := s.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mappings []Mapping
+	for rows.Next() {
+		var (
+			m         Mapping
+			withdrawn *time.Time
+		)
+		if err := rows.Scan(&m.URN, &m.URL, &m.SourceID, &m.URLType, &m.RComponent, &m.OAIIdentifier, &m.MissingRuns, &withdrawn); err != nil {
+			return nil, err
+		}
+		if withdrawn != nil {
+			m.Withdrawn = *withdrawn
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, rows.Err()
+}
+
+func (s *pgStore) InsertMapping(ctx context.Context, m *Mapping) error {
+	_, err := s.db.Exec(ctx, sqlInsertMapping,
+		m.URN,
+		m.URL,
+		m.SourceID,
+		nullable(string(m.URLType)),
+		nullable(m.RComponent),
+		nullable(m.OAIIdentifier),
+	)
+	return err
+}
+
+func (s *pgStore) UpdateMapping(ctx context.Context, m *Mapping) error {
+	_, err := s.db.Exec(ctx, sqlUpdateMapping,
+		m.URN,
+		m.SourceID,
+		m.URL,
+		nullable(string(m.URLType)),
+		nullable(m.RComponent),
+		nullable(m.OAIIdentifier),
+		m.MissingRuns,
+		nullableTime(m.Withdrawn),
+	)
+	return err
+}
+
+func (s *pgStore) InsertHistory(ctx context.Context, h *History) error {
+	_, err := s.db.Exec(ctx, sqlInsertHistory,
+		h.URN,
+		nullable(h.RComponent),
+		nullable(h.URLOld),
+		nullable(h.URLNew),
+		nullable(string(h.URLTypeOld)),
+		nullable(string(h.URLTypeNew)),
+		h.HarvestTime,
+		h.SourceURL,
+		nullable(h.ApprovedBy),
+		nullable(h.ArchivePage),
+	)
+	return err
+}
+
+// nullable converts an empty string to SQL NULL.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullableID converts a zero id to SQL NULL.
+func nullableID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// nullableTime converts the zero time to SQL NULL.
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
@@ -0,0 +1,114 @@
+package harvest
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+
+	"github.com/wvh/urn-harvester/pkg/oaipmh"
+)
+
+// swedishReader reads the record format of the Swedish URN resolver:
+//
+//	<records>
+//	  <record>
+//	    <identifier>URN:NBN:se:...</identifier>
+//	    <url>http://...</url>
+//	  </record>
+//	</records>
+//
+// The whole dump comes in one document; there are no resumption tokens.
+type swedishReader struct {
+	body   io.ReadCloser
+	dec    *xml.Decoder
+	record Record
+	err    error
+}
+
+// openSwedish fetches the dump of a Swedish format source.
+func (hv *Harvester) openSwedish(ctx context.Context, src *Source) (RecordReader, error) {
+	body, err := hv.get(ctx, src.StartURL)
+	if err != nil {
+		return nil, err
+	}
+	return newSwedishReader(body), nil
+}
+
+func newSwedishReader(body io.ReadCloser) *swedishReader {
+	return &swedishReader{
+		body: body,
+		dec:  newDecoder(body),
+	}
+}
+
+// Next advances to the next record. Records missing a URN or URL are returned as they are,
+// so the harvester can report them instead of stopping.
+func (r *swedishReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			return false
+		}
+
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "record" {
+			if r.err = r.parseRecord(); r.err != nil {
+				return false
+			}
+			return true
+		}
+	}
+}
+
+// parseRecord reads a record up to and including its end element.
+func (r *swedishReader) parseRecord() error {
+	r.record = Record{}
+
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			text, err := oaipmh.ReadText(r.dec)
+			if err != nil {
+				return err
+			}
+			switch t.Name.Local {
+			case "identifier":
+				if text != "" {
+					r.record.URN = text
+				}
+			case "url":
+				if text != "" {
+					r.record.URLs = append(r.record.URLs, text)
+				}
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func (r *swedishReader) Record() *Record {
+	return &r.record
+}
+
+func (r *swedishReader) Err() error {
+	return r.err
+}
+
+func (r *swedishReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,97 @@
+package harvest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testSwedishDump = `<?xml version="1.0" encoding="UTF-8"?>
+<records>
+  <record>
+    <identifier>URN:NBN:se:kb:1</identifier>
+    <url>http://example.com/1</url>
+  </record>
+  <record>
+    <identifier>URN:NBN:se:kb:2</identifier>
+  </record>
+  <record>
+    <url>http://example.com/3</url>
+  </record>
+  <record>
+    <identifier>URN:NBN:se:kb:1</identifier>
+    <url>http://example.com/1b</url>
+  </record>
+  <record>
+    <identifier>URN:NBN:se:kb:5</identifier>
+    <url>http://example.org/5</url>
+  </record>
+  <record>
+    <identifier>URN:NBN:se:kb:6</identifier>
+    <url>http://example.com/6</url>
+  </record>
+</records>`
+
+func TestSwedish(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testSwedishDump)
+	}))
+	defer srv.Close()
+
+	src := *testSource
+	src.Format = FormatSwedish
+	src.StartURL = srv.URL
+	src.URLPattern = `http://example\.com/`
+
+	store := &memStore{}
+	res, err := New(srv.Client(), nil).Harvest(context.Background(), store, &src)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if store.url("urn:nbn:se:kb:1", src.ID) != "http://example.com/1" || store.url("urn:nbn:se:kb:6", src.ID) != "http://example.com/6" {
+		t.Errorf("wrong mappings: %+v", store.mappings)
+	}
+	if len(store.mappings) != 2 {
+		t.Errorf("wrong number of mappings, want: %d, got: %d", 2, len(store.mappings))
+	}
+
+	if res.Records != 6 {
+		t.Errorf("wrong number of records, want: %d, got: %d", 6, res.Records)
+	}
+
+	want := []struct {
+		kind   string
+		record int
+	}{
+		{WarnIncomplete, 2},
+		{WarnIncomplete, 3},
+		{WarnDuplicate, 4},
+		{WarnIncomplete, 5},
+	}
+	if len(res.Warnings) != len(want) {
+		t.Fatalf("wrong number of warnings, want: %d, got: %d (%+v)", len(want), len(res.Warnings), res.Warnings)
+	}
+	for i, w := range want {
+		if res.Warnings[i].Kind != w.kind || res.Warnings[i].Record != w.record {
+			t.Errorf("warning %d: want: %s at record %d, got: %+v", i, w.kind, w.record, res.Warnings[i])
+		}
+	}
+}
+
+func TestSwedishTruncated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testSwedishDump[:200])
+	}))
+	defer srv.Close()
+
+	src := *testSource
+	src.Format = FormatSwedish
+	src.StartURL = srv.URL
+
+	if _, err := New(srv.Client(), nil).Harvest(context.Background(), &memStore{}, &src); err == nil {
+		t.Error("expected error for truncated dump, got nil")
+	}
+}
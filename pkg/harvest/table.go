@@ -0,0 +1,469 @@
+package harvest
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Columns tell which columns of a CSV or TSV source, or which fields of a JSONL source, hold the parts of a
+// mapping. They are stored as JSON in the column_map column of the source table, for example:
+//
+//	{"header": true, "urn": "Identifier", "url": "Link", "url_type": "3"}
+//
+// A column is given by its name in the header row, compared without regard to case, or by its number, counting
+// from 1. A column given by name must be in the header row. Columns left out are found by their default names if
+// the header row has them; otherwise the URN is in the first column and the URL in the second, and the URL type
+// and r-component are not read.
+type Columns struct {
+	// Header tells whether the first row of a CSV or TSV source is a header row. If it is not set, the first row
+	// is taken for a header row if none of its values is a URN, and read as a mapping after all if it has none of
+	// the column names.
+	Header *bool `json:"header,omitempty"`
+	// URN is the column of the URN, "urn" by default.
+	URN string `json:"urn,omitempty"`
+	// URL is the column of the URL, "url" by default.
+	URL string `json:"url,omitempty"`
+	// URLType is the column of the URL type of the mapping, "url_type" by default. Empty values are the source's.
+	URLType string `json:"url_type,omitempty"`
+	// RComponent is the column of the r-component of the URN, "r_component" by default, which is added to the
+	// URN as "?+" and its value.
+	RComponent string `json:"r_component,omitempty"`
+}
+
+// ParseColumns decodes columns from their JSON representation. An empty string gives the default columns.
+func ParseColumns(s string) (Columns, error) {
+	var columns Columns
+	if s == "" {
+		return columns, nil
+	}
+	if err := json.Unmarshal([]byte(s), &columns); err != nil {
+		return columns, fmt.Errorf("invalid column map: %w", err)
+	}
+	return columns, nil
+}
+
+// tableColumns are the indexes of the columns of a CSV or TSV source, -1 for optional columns it doesn't have.
+type tableColumns struct {
+	urn, url, urlType, rComponent int
+}
+
+// resolve finds the columns in a header row, or in a source without one if header is nil. It reports whether
+// any column was found by name.
+func (c *Columns) resolve(header []string) (tableColumns, bool, error) {
+	named := false
+	find := func(part, name, def string, pos int) (int, error) {
+		spec := name
+		if spec == "" {
+			spec = def
+		}
+		if n, err := strconv.Atoi(spec); err == nil {
+			if n < 1 {
+				return -1, fmt.Errorf("invalid %s column %q", part, spec)
+			}
+			return n - 1, nil
+		}
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), spec) {
+				named = true
+				return i, nil
+			}
+		}
+		switch {
+		case name != "" && header == nil:
+			return -1, fmt.Errorf("no header row to find %s column %q in", part, name)
+		case name != "":
+			return -1, fmt.Errorf("no %s column %q in header row", part, name)
+		}
+		return pos, nil
+	}
+
+	var (
+		cols tableColumns
+		err  error
+	)
+	if cols.urn, err = find("URN", c.URN, "urn", 0); err != nil {
+		return cols, false, err
+	}
+	if cols.url, err = find("URL", c.URL, "url", 1); err != nil {
+		return cols, false, err
+	}
+	if cols.urlType, err = find("URL type", c.URLType, "url_type", -1); err != nil {
+		return cols, false, err
+	}
+	if cols.rComponent, err = find("r-component", c.RComponent, "r_component", -1); err != nil {
+		return cols, false, err
+	}
+	return cols, named, nil
+}
+
+// isHeader reports whether the first row of a table is a header row: none of its values is a URN.
+func isHeader(row []string) bool {
+	for _, v := range row {
+		if isURN(strings.TrimSpace(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tableRecord makes a record of the parts of a mapping read from a line. An invalid URL type is an error.
+func tableRecord(urn string, urls []string, urlType, rComponent string) Record {
+	rec := Record{URN: urn, URLs: urls}
+	switch t := URLType(strings.ToLower(urlType)); t {
+	case "":
+	case URLTypeNormal, URLTypeVapaakappale:
+		rec.URLType = t
+	default:
+		rec.Err = fmt.Errorf("unknown URL type %q", urlType)
+	}
+	if rComponent != "" && urn != "" {
+		rec.URN += "?+" + rComponent
+	}
+	return rec
+}
+
+// utf8BOM is the byte order mark spreadsheets put at the start of UTF-8 files.
+const utf8BOM = "\xef\xbb\xbf"
+
+// skipBOM returns a reader of r without a leading byte order mark.
+func skipBOM(r io.Reader) *bufio.Reader {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(utf8BOM)); string(head) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
+
+// tableReader reads a CSV or TSV source, a spreadsheet with a row for each mapping. Quoted values can span lines.
+// The first row can be a header row; see Columns. Rows that can't be read are returned with an error, so the
+// harvester can report them by line number and carry on; blank lines are skipped.
+type tableReader struct {
+	body    io.Closer
+	lines   *lineReader
+	csv     *csv.Reader
+	columns Columns
+
+	// resolved columns, once the first row has been read
+	cols     tableColumns
+	resolved bool
+
+	record Record
+	err    error
+}
+
+// openTable opens a CSV or TSV source, whose fields are separated by comma. StartURL is the URL of the file, or
+// the path of a local file, see openDocument.
+func (hv *Harvester) openTable(ctx context.Context, src *Source, comma rune) (RecordReader, error) {
+	body, err := hv.openDocument(ctx, src.StartURL)
+	if err != nil {
+		return nil, err
+	}
+	return newTableReader(body, comma, src.Columns), nil
+}
+
+func newTableReader(body io.ReadCloser, comma rune, columns Columns) *tableReader {
+	lines := &lineReader{br: skipBOM(body)}
+	cr := csv.NewReader(lines)
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+	// quotes are rare in tab separated files, and a stray one shouldn't make the row unreadable
+	cr.LazyQuotes = comma == '\t'
+	return &tableReader{body: body, lines: lines, csv: cr, columns: columns}
+}
+
+// Next advances to the next row.
+func (r *tableReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		row, err := r.csv.Read()
+		var pe *csv.ParseError
+		switch {
+		case err == io.EOF:
+			return false
+		case errors.As(err, &pe):
+			r.record = Record{Err: fmt.Errorf("line %d: %v", pe.StartLine, pe.Err)}
+			return true
+		case err != nil:
+			r.err = err
+			return false
+		}
+		line := r.lines.startLine(row)
+
+		if !r.resolved {
+			header := r.columns.Header
+			if header == nil {
+				guess := isHeader(row)
+				header = &guess
+			}
+			var named bool
+			if *header {
+				r.cols, named, r.err = r.columns.resolve(row)
+			} else {
+				r.cols, named, r.err = r.columns.resolve(nil)
+			}
+			if r.err != nil {
+				r.err = fmt.Errorf("line %d: %w", line, r.err)
+				return false
+			}
+			r.resolved = true
+			// a first row without URNs or column names is more likely a broken mapping than a header row
+			if *header && (named || r.columns.Header != nil) {
+				continue
+			}
+		}
+
+		if need := maxInt(r.cols.urn, r.cols.url) + 1; len(row) < need {
+			r.record = Record{Err: fmt.Errorf("line %d: %d fields, expected at least %d", line, len(row), need)}
+			return true
+		}
+		var urls []string
+		if url := r.cell(row, r.cols.url); url != "" {
+			urls = []string{url}
+		}
+		r.record = tableRecord(r.cell(row, r.cols.urn), urls, r.cell(row, r.cols.urlType), r.cell(row, r.cols.rComponent))
+		if r.record.Err != nil {
+			r.record.Err = fmt.Errorf("line %d: %w", line, r.record.Err)
+		}
+		return true
+	}
+}
+
+// lineReader passes on its input a line at a time and counts the lines, for a csv.Reader, which reports the
+// lines of its errors but not of its rows. As the buffered reader of the csv.Reader only reads more when it
+// has no line break left, it never holds more than the rest of the line it is reading, so after it returns a
+// row, lines is the line the row ended on.
+type lineReader struct {
+	br    *bufio.Reader
+	rest  []byte
+	lines int
+	// bytes passed on since the last line break
+	col int
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.rest) == 0 {
+		line, err := r.br.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		r.rest = line
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	r.col += n
+	if len(r.rest) == 0 && p[n-1] == '\n' {
+		r.lines++
+		r.col = 0
+	}
+	return n, nil
+}
+
+// startLine returns the line a row just read from r started on, counting from 1.
+func (r *lineReader) startLine(row []string) int {
+	line := r.lines
+	if r.col > 0 {
+		// the last line, without a line break
+		line++
+	}
+	for _, v := range row {
+		line -= strings.Count(v, "\n")
+	}
+	return line
+}
+
+// cell returns the trimmed value of a column of a row, or the empty string if the row doesn't have it.
+func (r *tableReader) cell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+func (r *tableReader) Record() *Record {
+	return &r.record
+}
+
+func (r *tableReader) Err() error {
+	return r.err
+}
+
+func (r *tableReader) Close() error {
+	return r.body.Close()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// maxLine is the length of the longest line of a JSONL source.
+const maxLine = 1 << 20
+
+// scanErr returns the error of a scanner that stopped after line n, if any.
+func scanErr(scanner *bufio.Scanner, n int) error {
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line %d: %w", n+1, err)
+	}
+	return err
+}
+
+// jsonlReader reads a JSONL source, a JSON object on each line with fields named by Columns. The URL field can
+// also be an array of URLs, which are candidates like those of an OAI-PMH record. Lines that aren't objects, or
+// have fields of the wrong type, are returned with an error, so the harvester can report them by line number
+// and carry on; blank lines are skipped.
+type jsonlReader struct {
+	body    io.Closer
+	scanner *bufio.Scanner
+
+	// field names
+	urn, url, urlType, rComponent string
+
+	line   int
+	record Record
+	err    error
+}
+
+// openJSONL opens a JSONL source. StartURL is the URL of the file, or the path of a local file, see openDocument.
+func (hv *Harvester) openJSONL(ctx context.Context, src *Source) (RecordReader, error) {
+	body, err := hv.openDocument(ctx, src.StartURL)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newJSONLReader(body, src.Columns)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// newJSONLReader starts reading a JSONL source. Fields are given by name; numbers are an error.
+func newJSONLReader(body io.ReadCloser, columns Columns) (*jsonlReader, error) {
+	field := func(part, name, def string) (string, error) {
+		if name == "" {
+			return def, nil
+		}
+		if _, err := strconv.Atoi(name); err == nil {
+			return "", fmt.Errorf("%s field %q: JSONL fields are given by name", part, name)
+		}
+		return name, nil
+	}
+
+	r := &jsonlReader{body: body, scanner: bufio.NewScanner(skipBOM(body))}
+	r.scanner.Buffer(nil, maxLine)
+	var err error
+	if r.urn, err = field("URN", columns.URN, "urn"); err != nil {
+		return nil, err
+	}
+	if r.url, err = field("URL", columns.URL, "url"); err != nil {
+		return nil, err
+	}
+	if r.urlType, err = field("URL type", columns.URLType, "url_type"); err != nil {
+		return nil, err
+	}
+	if r.rComponent, err = field("r-component", columns.RComponent, "r_component"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next advances to the next line.
+func (r *jsonlReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+		r.record = r.parse(line)
+		if r.record.Err != nil {
+			r.record.Err = fmt.Errorf("line %d: %w", r.line, r.record.Err)
+		}
+		return true
+	}
+	r.err = scanErr(r.scanner, r.line)
+	return false
+}
+
+// parse makes a record of a line.
+func (r *jsonlReader) parse(line string) Record {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return Record{Err: fmt.Errorf("not a JSON object: %v", err)}
+	}
+
+	str := func(name string) (string, error) {
+		switch v := obj[name].(type) {
+		case nil:
+			return "", nil
+		case string:
+			return strings.TrimSpace(v), nil
+		default:
+			return "", fmt.Errorf("field %q is not a string", name)
+		}
+	}
+	urn, err := str(r.urn)
+	if err != nil {
+		return Record{Err: err}
+	}
+	urlType, err := str(r.urlType)
+	if err != nil {
+		return Record{Err: err}
+	}
+	rComponent, err := str(r.rComponent)
+	if err != nil {
+		return Record{Err: err}
+	}
+
+	var urls []string
+	switch v := obj[r.url].(type) {
+	case nil:
+	case string:
+		if url := strings.TrimSpace(v); url != "" {
+			urls = append(urls, url)
+		}
+	case []interface{}:
+		for _, u := range v {
+			url, ok := u.(string)
+			if !ok {
+				return Record{Err: fmt.Errorf("field %q is not a string or an array of strings", r.url)}
+			}
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+	default:
+		return Record{Err: fmt.Errorf("field %q is not a string or an array of strings", r.url)}
+	}
+	return tableRecord(urn, urls, urlType, rComponent)
+}
+
+func (r *jsonlReader) Record() *Record {
+	return &r.record
+}
+
+func (r *jsonlReader) Err() error {
+	return r.err
+}
+
+func (r *jsonlReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,300 @@
+package harvest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseColumns(t *testing.T) {
+	columns, err := ParseColumns(`{"urn": "Identifier", "url": "3"}`)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if want := (Columns{URN: "Identifier", URL: "3"}); columns != want {
+		t.Errorf("wrong columns, want: %+v, got: %+v", want, columns)
+	}
+	if columns, err := ParseColumns(""); err != nil || columns != (Columns{}) {
+		t.Errorf("expected default columns for empty string, got: %+v, err: %v", columns, err)
+	}
+	if _, err := ParseColumns(`{"urn": 1}`); err == nil {
+		t.Error("expected error for invalid columns, got nil")
+	}
+}
+
+// readRecords reads all records of a reader, and its error.
+func readRecords(rr RecordReader) ([]Record, error) {
+	defer rr.Close()
+	var recs []Record
+	for rr.Next() {
+		recs = append(recs, *rr.Record())
+	}
+	return recs, rr.Err()
+}
+
+// recordErrs replaces the errors of records with their messages, for comparison.
+func recordErrs(recs []Record) ([]Record, []string) {
+	var msgs []string
+	for i := range recs {
+		if recs[i].Err != nil {
+			msgs = append(msgs, recs[i].Err.Error())
+			recs[i].Err = nil
+		}
+	}
+	return recs, msgs
+}
+
+func TestTable(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name    string
+		comma   rune
+		columns Columns
+		input   string
+		want    []Record
+		errs    []string
+	}{
+		{
+			name:  "no header",
+			comma: ',',
+			input: "URN:NBN:fi-fe3214,http://example.com/1\n\nURN:NBN:fi:example-2, http://example.com/2 ,extra\n",
+			want: []Record{
+				{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}},
+				{URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/2"}},
+			},
+		},
+		{
+			name:  "header",
+			comma: ',',
+			input: "\xef\xbb\xbfTitle,URL,URN\r\n\"Book, first\",http://example.com/1,URN:NBN:fi-fe3214\r\n",
+			want:  []Record{{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}}},
+		},
+		{
+			name:    "mapped header",
+			comma:   ',',
+			columns: Columns{URN: "identifier", URL: "2"},
+			input:   "Identifier,Link\nURN:NBN:fi-fe3214,http://example.com/1\n",
+			want:    []Record{{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}}},
+		},
+		{
+			name:  "optional columns",
+			comma: '\t',
+			input: "urn\turl\turl_type\tr_component\n" +
+				"URN:NBN:fi-fe3214\thttp://example.com/1\tvapaakappale\tpdf\n" +
+				"URN:NBN:fi:example-2\thttp://example.com/2\n" +
+				"URN:NBN:fi:example-3\thttp://example.com/3\tspecial\n" +
+				"URN:NBN:fi:example-4\n" +
+				"URN:NBN:fi:example-5\thttp://example.com/5\"\tNormal\n",
+			want: []Record{
+				{URN: "URN:NBN:fi-fe3214?+pdf", URLs: []string{"http://example.com/1"}, URLType: URLTypeVapaakappale},
+				{URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/2"}},
+				{URN: "URN:NBN:fi:example-3", URLs: []string{"http://example.com/3"}},
+				{},
+				{URN: "URN:NBN:fi:example-5", URLs: []string{"http://example.com/5\""}, URLType: URLTypeNormal},
+			},
+			errs: []string{`line 4: unknown URL type "special"`, "line 5: 1 fields, expected at least 2"},
+		},
+		{
+			name:  "bad quotes",
+			comma: ',',
+			input: "URN:NBN:fi-fe3214,http://example.com/\"1\"\n" +
+				"URN:NBN:fi:example-2,http://example.com/2\n",
+			want: []Record{{}, {URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/2"}}},
+			errs: []string{`line 1: bare " in non-quoted-field`},
+		},
+		{
+			name:  "multi-line values",
+			comma: ',',
+			input: "title,urn,url\n" +
+				"\"Book,\nsecond line\n\",URN:NBN:fi-fe3214,http://example.com/1\n" +
+				"Book,URN:NBN:fi:example-2,http://example.com/2,\"\nnote\"\n" +
+				"Book,URN:NBN:fi:example-3\n" +
+				"\"Book\n\"\"second\"\"\",URN:NBN:fi:example-4",
+			want: []Record{
+				{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}},
+				{URN: "URN:NBN:fi:example-2", URLs: []string{"http://example.com/2"}},
+				{},
+				{},
+			},
+			errs: []string{"line 7: 2 fields, expected at least 3", "line 8: 2 fields, expected at least 3"},
+		},
+		{
+			name:    "header without column names",
+			comma:   ',',
+			columns: Columns{Header: &yes},
+			input:   "Identifier,Link\nURN:NBN:fi-fe3214,http://example.com/1\n",
+			want:    []Record{{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}}},
+		},
+		{
+			name:  "guessed header without column names",
+			comma: ',',
+			input: "Identifier,Link\nURN:NBN:fi-fe3214,http://example.com/1\n",
+			want: []Record{
+				{URN: "Identifier", URLs: []string{"Link"}},
+				{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}},
+			},
+		},
+		{
+			name:    "header row read as data",
+			comma:   ',',
+			columns: Columns{Header: &no, URL: "3"},
+			input:   "urn,title,url\nURN:NBN:fi-fe3214,Book,http://example.com/1\n",
+			want: []Record{
+				{URN: "urn", URLs: []string{"url"}},
+				{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := readRecords(newTableReader(ioutil.NopCloser(strings.NewReader(test.input)), test.comma, test.columns))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		got, errs := recordErrs(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\nwant: %+v\n got: %+v", test.name, test.want, got)
+		}
+		if !reflect.DeepEqual(errs, test.errs) {
+			t.Errorf("%s: wrong errors, want: %q, got: %q", test.name, test.errs, errs)
+		}
+	}
+
+	for name, columns := range map[string]Columns{
+		"missing column":    {URN: "id"},
+		"zero column":       {URL: "0"},
+		"no header row":     {Header: &no, URN: "identifier"},
+		"missing in header": {Header: &yes, URL: "url"},
+	} {
+		input := "Identifier,Link\nURN:NBN:fi-fe3214,http://example.com/1\n"
+		if _, err := readRecords(newTableReader(ioutil.NopCloser(strings.NewReader(input)), ',', columns)); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+	// columns are only found by name in a header row
+	input := "URN:NBN:fi-fe3214,http://example.com/1\n"
+	if _, err := readRecords(newTableReader(ioutil.NopCloser(strings.NewReader(input)), ',', Columns{URL: "link"})); err == nil {
+		t.Error("no header: expected error, got nil")
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	input := `{"urn": "URN:NBN:fi-fe3214", "url": "http://example.com/1", "title": "Book"}
+
+{"urn": "URN:NBN:fi:example-2", "url": ["http://example.com/2", " http://example.com/2.pdf "], "url_type": "vapaakappale", "r_component": "pdf"}
+{"urn": "URN:NBN:fi:example-3", "url": 3}
+not json
+{"urn": "URN:NBN:fi:example-4", "url_type": "special"}
+`
+	r, err := newJSONLReader(ioutil.NopCloser(strings.NewReader(input)), Columns{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got, err := readRecords(r)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	got, errs := recordErrs(got)
+	want := []Record{
+		{URN: "URN:NBN:fi-fe3214", URLs: []string{"http://example.com/1"}},
+		{URN: "URN:NBN:fi:example-2?+pdf", URLs: []string{"http://example.com/2", "http://example.com/2.pdf"}, URLType: URLTypeVapaakappale},
+		{},
+		{},
+		{URN: "URN:NBN:fi:example-4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\nwant: %+v\n got: %+v", want, got)
+	}
+	wantErrs := []string{
+		`line 4: field "url" is not a string or an array of strings`,
+		"line 5: not a JSON object: invalid character 'o' in literal null (expecting 'u')",
+		`line 6: unknown URL type "special"`,
+	}
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("wrong errors, want: %q, got: %q", wantErrs, errs)
+	}
+
+	r, err = newJSONLReader(ioutil.NopCloser(strings.NewReader(`{"id": "URN:NBN:fi-fe3214", "link": "http://example.com/1"}`)), Columns{URN: "id", URL: "link"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got, err := readRecords(r); err != nil || len(got) != 1 || got[0].URN != "URN:NBN:fi-fe3214" || len(got[0].URLs) != 1 {
+		t.Errorf("mapped fields: wrong records: %+v, err: %v", got, err)
+	}
+
+	if _, err := newJSONLReader(ioutil.NopCloser(strings.NewReader("")), Columns{URN: "1"}); err == nil {
+		t.Error("expected error for numbered field, got nil")
+	}
+
+	long := `{"urn": "` + strings.Repeat("x", maxLine) + `"}`
+	r, _ = newJSONLReader(ioutil.NopCloser(strings.NewReader(long)), Columns{})
+	if _, err := readRecords(r); err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("expected error for line 1, got: %v", err)
+	}
+}
+
+func TestTableHarvest(t *testing.T) {
+	files := map[string]string{
+		"/urns.csv": "urn,url,url_type\n" +
+			"URN:NBN:fi-fe3214,http://example.com/1,\n" +
+			"URN:NBN:fi:example-2,http://example.com/2,vapaakappale\n" +
+			"URN:NBN:fi:example-3,http://example.com/3,special\n",
+		"/urns.jsonl": `{"urn": "URN:NBN:fi-fe3214", "url": "http://example.com/1"}
+{"urn": "URN:NBN:fi:example-2", "url": "http://example.com/2", "url_type": "vapaakappale"}
+{"urn": "URN:NBN:fi:example-3", "url": "http://example.com/3", "url_type": "special"}
+`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(file))
+	}))
+	defer srv.Close()
+
+	for format, path := range map[Format]string{FormatCSV: "/urns.csv", FormatJSONL: "/urns.jsonl"} {
+		src := *testSource
+		src.Format = format
+		src.StartURL = srv.URL + path
+		store := &memStore{}
+		res, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), store, &src)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+
+		if res.Records != 3 || len(res.Warnings) != 1 || res.Warnings[0].Kind != WarnMalformed || res.Warnings[0].Record != 3 {
+			t.Errorf("%s: wrong result, want 3 records and record 3 malformed, got: %+v", format, res)
+		}
+		types := map[string]URLType{}
+		for _, m := range store.mappings {
+			types[m.URN] = m.URLType
+		}
+		want := map[string]URLType{"urn:nbn:fi-fe3214": URLTypeNormal, "urn:nbn:fi:example-2": URLTypeVapaakappale}
+		if !reflect.DeepEqual(types, want) {
+			t.Errorf("%s: wrong URL types, want: %v, got: %v", format, want, types)
+		}
+	}
+
+	src := *testSource
+	src.Format = FormatCSV
+	src.StartURL = srv.URL + "/urns.csv"
+	src.Columns = Columns{URN: "identifier"}
+	if _, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), &memStore{}, &src); err == nil || errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("expected error for missing column, got: %v", err)
+	}
+
+	src.StartURL = srv.URL + "/missing.csv"
+	_, err := New(srv.Client(), nil, WithDelay(0)).Harvest(context.Background(), &memStore{}, &src)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("want HTTP error 404, got: %v", err)
+	}
+}
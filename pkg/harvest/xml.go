@@ -0,0 +1,125 @@
+package harvest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/wvh/urn-harvester/pkg/sanitize"
+)
+
+// sanitizedBody is a response body that repairs broken XML while it is read.
+type sanitizedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// readCloser reads a document through another reader, such as a decompressor or a buffer, and closes the
+// document itself.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// HTTPError means a request for a document returned a non-successful status code.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// get requests a document from a source, returning its body if the request was successful.
+// The body is passed through a sanitizing reader; repairs are logged.
+func (hv *Harvester) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	body, err := hv.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return hv.sanitize(url, body), nil
+}
+
+// fetch requests a document from a source, returning its body as it is if the request was successful.
+func (hv *Harvester) fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp.Body, nil
+}
+
+// openDocument opens a document that is read as a whole, such as a dump: a URL, or the path of a local file,
+// with or without the file scheme. Gzip compressed documents are decompressed, whatever their name or content
+// type.
+func (hv *Harvester) openDocument(ctx context.Context, location string) (io.ReadCloser, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	switch u.Scheme {
+	case "http", "https":
+		body, err = hv.fetch(ctx, location)
+	case "file":
+		body, err = os.Open(u.Path)
+	case "":
+		body, err = os.Open(location)
+	default:
+		return nil, fmt.Errorf("can't read document from %q", location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(body)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			body.Close()
+			return nil, fmt.Errorf("%s: %w", location, err)
+		}
+		return &readCloser{Reader: zr, Closer: body}, nil
+	}
+	return &readCloser{Reader: br, Closer: body}, nil
+}
+
+// sanitize passes the body of a document through a sanitizing reader that logs its repairs.
+func (hv *Harvester) sanitize(url string, body io.ReadCloser) io.ReadCloser {
+	return &sanitizedBody{
+		Reader: sanitize.NewReader(body, sanitize.OnRepair(func(rep sanitize.Repair) {
+			hv.logRepair(url, rep)
+		})),
+		Closer: body,
+	}
+}
+
+// logRepair logs a repair made to a document by the sanitizing reader.
+func (hv *Harvester) logRepair(url string, rep sanitize.Repair) {
+	hv.logger.Log("msg", "repaired invalid input", "url", url, "offset", rep.Offset, "repair", rep.Kind, "byte", fmt.Sprintf("%#02x", rep.Byte))
+}
+
+// newDecoder creates an XML token decoder that can read documents in the single-byte encodings used by sources.
+func newDecoder(r io.Reader) *xml.Decoder {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = sanitize.CharsetReader
+	return dec
+}
@@ -0,0 +1,394 @@
+package oaipmh
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/sanitize"
+)
+
+// Client is an OAI-PMH client. Responses are passed through a sanitizing reader,
+// so stray invalid characters don't abort a harvest.
+type Client struct {
+	client   *http.Client
+	delay    time.Duration
+	onRepair func(string, sanitize.Repair)
+	parse    MetadataParser
+}
+
+// MetadataParser reads the metadata of a record in a format other than Dublin Core. It is called with the start
+// element of the metadata, the only child of the record's metadata element, and must consume the element up to
+// and including its end element, for example with Decoder.DecodeElement.
+type MetadataParser func(dec *xml.Decoder, start xml.StartElement) (interface{}, error)
+
+// NewClient creates an OAI-PMH client that waits for the given delay between consecutive requests
+// of a list. If client is nil, http.DefaultClient is used.
+func NewClient(client *http.Client, delay time.Duration, opts ...func(*Client)) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &Client{
+		client: client,
+		delay:  delay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// OnRepair allows passing a callback function executed when a response had to be repaired.
+// The callback function will receive the request URL and a description of the repair.
+func OnRepair(f func(string, sanitize.Repair)) func(*Client) {
+	return func(c *Client) {
+		c.onRepair = f
+	}
+}
+
+// WithMetadataParser sets the parser of record metadata. Without one, the dc:identifier values of the metadata
+// are collected.
+func WithMetadataParser(parse MetadataParser) func(*Client) {
+	return func(c *Client) {
+		c.parse = parse
+	}
+}
+
+// ListRecords returns a stream of the records of a ListRecords request, starting at startURL.
+// Subsequent pages are requested by appending the escaped resumption token to resumeURL,
+// which therefore typically ends in "resumptionToken=".
+func (c *Client) ListRecords(ctx context.Context, startURL, resumeURL string) *Records {
+	return &Records{
+		client:    c,
+		ctx:       ctx,
+		next:      startURL,
+		resumeURL: resumeURL,
+	}
+}
+
+// Records is a stream of records from a ListRecords request. Pages are fetched as needed.
+// Its methods follow the Next, Err and Close pattern of pgx.Rows.
+type Records struct {
+	client    *Client
+	ctx       context.Context
+	resumeURL string
+
+	// URL of the next page, or empty if this is the last page
+	next string
+
+	body  io.ReadCloser
+	dec   *xml.Decoder
+	page  int
+	token ResumptionToken
+
+	record *Record
+	err    error
+}
+
+// Next advances to the next record, fetching the next page if needed.
+// It returns false at the end of the list or when an error occurred; check Err to see which.
+func (r *Records) Next() bool {
+	for r.err == nil {
+		if r.dec == nil {
+			if r.next == "" {
+				return false
+			}
+			if r.page > 0 {
+				if err := r.wait(); err != nil {
+					r.err = err
+					return false
+				}
+			}
+			if err := r.fetch(r.next); err != nil {
+				r.err = err
+				return false
+			}
+		}
+
+		rec, err := r.scan()
+		if err == io.EOF {
+			r.closeBody()
+			continue
+		}
+		if err != nil {
+			r.err = err
+			r.closeBody()
+			return false
+		}
+		r.record = rec
+		return true
+	}
+	return false
+}
+
+// Record returns the current record.
+func (r *Records) Record() *Record {
+	return r.record
+}
+
+// Err returns the error that stopped the stream, if any.
+func (r *Records) Err() error {
+	return r.err
+}
+
+// Page returns the number of pages fetched so far.
+func (r *Records) Page() int {
+	return r.page
+}
+
+// ResumptionToken returns the most recent resumption token seen in the stream.
+func (r *Records) ResumptionToken() ResumptionToken {
+	return r.token
+}
+
+// Close stops the stream and releases the current response body.
+func (r *Records) Close() error {
+	r.next = ""
+	return r.closeBody()
+}
+
+func (r *Records) closeBody() error {
+	r.dec = nil
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// wait sleeps for the client's delay, returning early if the context is cancelled.
+func (r *Records) wait() error {
+	return Sleep(r.ctx, r.client.delay)
+}
+
+// Sleep waits for d, returning early with the context's error if it is cancelled.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// fetch requests a page and sets up the token decoder for its body.
+func (r *Records) fetch(u string) error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return &HTTPError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var opts []func(*sanitize.Reader)
+	if r.client.onRepair != nil {
+		opts = append(opts, sanitize.OnRepair(func(rep sanitize.Repair) {
+			r.client.onRepair(u, rep)
+		}))
+	}
+
+	r.body = resp.Body
+	r.dec = xml.NewDecoder(sanitize.NewReader(resp.Body, opts...))
+	r.dec.CharsetReader = sanitize.CharsetReader
+	r.next = ""
+	r.page++
+	return nil
+}
+
+// scan reads tokens until the next record, returning io.EOF at the end of the page.
+// Resumption tokens and errors are handled on the way.
+func (r *Records) scan() (*Record, error) {
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "record":
+			return parseRecord(r.dec, r.client.parse)
+		case "resumptionToken":
+			token, err := parseResumptionToken(r.dec, start)
+			if err != nil {
+				return nil, err
+			}
+			r.token = token
+			if token.Value != "" {
+				if r.resumeURL == "" {
+					return nil, errors.New("oai-pmh: got resumption token but no resume URL")
+				}
+				r.next = r.resumeURL + url.QueryEscape(token.Value)
+			}
+		case "error":
+			text, err := ReadText(r.dec)
+			if err != nil {
+				return nil, err
+			}
+			return nil, &Error{Code: attr(start, "code"), Message: text}
+		}
+	}
+}
+
+// parseRecord reads a record up to and including its end element. The metadata is read by parse, if it is not nil.
+func parseRecord(dec *xml.Decoder, parse MetadataParser) (*Record, error) {
+	var (
+		rec        Record
+		depth      int
+		inHeader   bool
+		inMetadata bool
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1 && t.Name.Local == "header":
+				inHeader = true
+				rec.Header.Deleted = attr(t, "status") == "deleted"
+			case depth == 1 && t.Name.Local == "metadata":
+				inMetadata = true
+			case inHeader && depth == 2:
+				text, err := ReadText(dec)
+				if err != nil {
+					return nil, err
+				}
+				depth--
+				switch t.Name.Local {
+				case "identifier":
+					rec.Header.Identifier = text
+				case "datestamp":
+					rec.Header.Datestamp = text
+				case "setSpec":
+					rec.Header.SetSpecs = append(rec.Header.SetSpecs, text)
+				}
+			case inMetadata && parse != nil && depth == 2:
+				md, err := parse(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				depth--
+				rec.Metadata = md
+			case inMetadata && isDC(t.Name) && t.Name.Local == "identifier":
+				text, err := ReadText(dec)
+				if err != nil {
+					return nil, err
+				}
+				depth--
+				if text != "" {
+					rec.Identifiers = append(rec.Identifiers, text)
+				}
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				return &rec, nil
+			}
+			if depth == 1 {
+				inHeader, inMetadata = false, false
+			}
+			depth--
+		}
+	}
+}
+
+// parseResumptionToken reads a resumptionToken element and its attributes.
+func parseResumptionToken(dec *xml.Decoder, start xml.StartElement) (ResumptionToken, error) {
+	var token ResumptionToken
+
+	text, err := ReadText(dec)
+	if err != nil {
+		return token, err
+	}
+	token.Value = text
+
+	if s := attr(start, "expirationDate"); s != "" {
+		// an unparseable expiration date is not worth failing the harvest over
+		token.ExpirationDate, _ = parseDatestamp(s)
+	}
+	if s := attr(start, "completeListSize"); s != "" {
+		token.CompleteListSize, _ = strconv.Atoi(s)
+	}
+	if s := attr(start, "cursor"); s != "" {
+		token.Cursor, _ = strconv.Atoi(s)
+	}
+	return token, nil
+}
+
+// ReadText returns the trimmed character data of the current element, consuming its end element.
+// Text in nested elements is included.
+func ReadText(dec *xml.Decoder) (string, error) {
+	var (
+		b     strings.Builder
+		depth int
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return strings.TrimSpace(b.String()), nil
+			}
+			depth--
+		}
+	}
+}
+
+// attr returns the value of the named attribute, ignoring namespaces.
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// isDC checks if an element is in the Dublin Core namespace. Undeclared "dc" prefixes are accepted as well.
+func isDC(name xml.Name) bool {
+	return name.Space == NamespaceDC || name.Space == "dc"
+}
@@ -0,0 +1,263 @@
+package oaipmh
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wvh/urn-harvester/pkg/sanitize"
+)
+
+const testPage1 = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <responseDate>2020-10-01T12:00:00Z</responseDate>
+  <request verb="ListRecords" metadataPrefix="oai_dc">http://example.com/oai</request>
+  <ListRecords>
+    <record>
+      <header>
+        <identifier>oai:example.com:1</identifier>
+        <datestamp>2020-09-01T10:00:00Z</datestamp>
+        <setSpec>com_1</setSpec>
+      </header>
+      <metadata>
+        <oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+          <dc:title>First</dc:title>
+          <dc:identifier>URN:NBN:fi-fe1</dc:identifier>
+          <dc:identifier>http://example.com/handle/1</dc:identifier>
+        </oai_dc:dc>
+      </metadata>
+    </record>
+    <record>
+      <header status="deleted">
+        <identifier>oai:example.com:2</identifier>
+        <datestamp>2020-09-02</datestamp>
+      </header>
+    </record>
+    <resumptionToken expirationDate="2020-10-02T12:00:00Z" completeListSize="3" cursor="0">page/2+more</resumptionToken>
+  </ListRecords>
+</OAI-PMH>`
+
+const testPage2 = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <ListRecords>
+    <record>
+      <header>
+        <identifier>oai:example.com:3</identifier>
+        <datestamp>2020-09-03</datestamp>
+      </header>
+      <metadata>
+        <oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+          <dc:identifier>http://example.com/handle/3</dc:identifier>
+          <dc:identifier>urn:nbn:fi-fe3</dc:identifier>
+        </oai_dc:dc>
+      </metadata>
+    </record>
+    <resumptionToken completeListSize="3" cursor="2"/>
+  </ListRecords>
+</OAI-PMH>`
+
+const testErrorPage = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <error code="%s">%s</error>
+</OAI-PMH>`
+
+func testServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch token := r.URL.Query().Get("resumptionToken"); token {
+		case "":
+			fmt.Fprint(w, testPage1)
+		case "page/2+more":
+			fmt.Fprint(w, testPage2)
+		default:
+			fmt.Fprintf(w, testErrorPage, CodeBadResumptionToken, "unknown token "+token)
+		}
+	}))
+}
+
+func TestListRecords(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+
+	client := NewClient(srv.Client(), time.Millisecond)
+	records := client.ListRecords(context.Background(), srv.URL+"?verb=ListRecords&metadataPrefix=oai_dc", srv.URL+"?verb=ListRecords&resumptionToken=")
+	defer records.Close()
+
+	var got []Record
+	for records.Next() {
+		got = append(got, *records.Record())
+	}
+	if err := records.Err(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := []Record{
+		{
+			Header:      Header{Identifier: "oai:example.com:1", Datestamp: "2020-09-01T10:00:00Z", SetSpecs: []string{"com_1"}},
+			Identifiers: []string{"URN:NBN:fi-fe1", "http://example.com/handle/1"},
+		},
+		{
+			Header: Header{Identifier: "oai:example.com:2", Datestamp: "2020-09-02", Deleted: true},
+		},
+		{
+			Header:      Header{Identifier: "oai:example.com:3", Datestamp: "2020-09-03"},
+			Identifiers: []string{"http://example.com/handle/3", "urn:nbn:fi-fe3"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong records\nwant: %+v\n got: %+v", want, got)
+	}
+
+	if records.Page() != 2 {
+		t.Errorf("wrong number of pages, want: %d, got: %d", 2, records.Page())
+	}
+	if token := records.ResumptionToken(); token.Value != "" || token.Cursor != 2 || token.CompleteListSize != 3 {
+		t.Errorf("wrong final resumption token: %+v", token)
+	}
+}
+
+func TestMetadataParser(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+
+	// collects the names of the metadata element's children
+	parse := func(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+		var md struct {
+			Elements []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		}
+		if err := dec.DecodeElement(&md, &start); err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range md.Elements {
+			names = append(names, e.XMLName.Local)
+		}
+		return names, nil
+	}
+	client := NewClient(srv.Client(), 0, WithMetadataParser(parse))
+	records := client.ListRecords(context.Background(), srv.URL+"?verb=ListRecords&metadataPrefix=oai_dc", srv.URL+"?verb=ListRecords&resumptionToken=")
+	defer records.Close()
+
+	var got []interface{}
+	for records.Next() {
+		if rec := records.Record(); rec.Identifiers != nil {
+			t.Errorf("identifiers collected with a metadata parser: %q", rec.Identifiers)
+		}
+		got = append(got, records.Record().Metadata)
+	}
+	if err := records.Err(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := []interface{}{[]string{"title", "identifier", "identifier"}, nil, []string{"identifier", "identifier"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong metadata\nwant: %q\n got: %q", want, got)
+	}
+}
+
+func TestListRecordsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want error
+	}{
+		{"no records", CodeNoRecordsMatch, ErrNoRecordsMatch},
+		{"bad token", CodeBadResumptionToken, ErrBadResumptionToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, testErrorPage, test.code, "nope")
+			}))
+			defer srv.Close()
+
+			records := NewClient(srv.Client(), 0).ListRecords(context.Background(), srv.URL, srv.URL)
+			defer records.Close()
+
+			if records.Next() {
+				t.Error("expected no records")
+			}
+			if !errors.Is(records.Err(), test.want) {
+				t.Errorf("want: %v, got: %v", test.want, records.Err())
+			}
+			var oaiErr *Error
+			if !errors.As(records.Err(), &oaiErr) || oaiErr.Message != "nope" {
+				t.Errorf("expected OAI-PMH error with message, got: %#v", records.Err())
+			}
+		})
+	}
+
+	t.Run("http status", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "gone fishing", http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		records := NewClient(srv.Client(), 0).ListRecords(context.Background(), srv.URL, srv.URL)
+		defer records.Close()
+
+		records.Next()
+		var httpErr *HTTPError
+		if !errors.As(records.Err(), &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected HTTP error with status %d, got: %v", http.StatusServiceUnavailable, records.Err())
+		}
+	})
+}
+
+func TestListRecordsCancel(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	records := NewClient(srv.Client(), time.Hour).ListRecords(ctx, srv.URL, srv.URL+"?resumptionToken=")
+	defer records.Close()
+
+	// read the first page, then cancel while waiting for the second
+	for i := 0; i < 2; i++ {
+		if !records.Next() {
+			t.Fatal("expected record, got error:", records.Err())
+		}
+	}
+	cancel()
+
+	if records.Next() {
+		t.Error("expected no more records after cancel")
+	}
+	if !errors.Is(records.Err(), context.Canceled) {
+		t.Errorf("want: %v, got: %v", context.Canceled, records.Err())
+	}
+}
+
+func TestListRecordsRepair(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a stray Latin-1 non-breaking space in an otherwise UTF-8 document
+		fmt.Fprint(w, strings.Replace(testPage2, "<dc:identifier>http", "<dc:identifier>\xa0http", 1))
+	}))
+	defer srv.Close()
+
+	var repairs []sanitize.Repair
+	client := NewClient(srv.Client(), 0, OnRepair(func(u string, rep sanitize.Repair) {
+		repairs = append(repairs, rep)
+	}))
+	records := client.ListRecords(context.Background(), srv.URL, "")
+	defer records.Close()
+
+	if !records.Next() {
+		t.Fatal("expected record, got error:", records.Err())
+	}
+	if got := records.Record().Identifiers; len(got) != 2 || got[0] != "http://example.com/handle/3" {
+		t.Errorf("wrong identifiers: %q", got)
+	}
+	if len(repairs) != 1 || repairs[0].Kind != sanitize.InvalidUTF8 {
+		t.Errorf("wrong repairs: %+v", repairs)
+	}
+}
@@ -0,0 +1,180 @@
+package oaipmh
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wvh/urn-harvester/pkg/sanitize"
+)
+
+// Granularities of datestamps a repository can support.
+const (
+	GranularityDay    = "YYYY-MM-DD"
+	GranularitySecond = "YYYY-MM-DDThh:mm:ssZ"
+)
+
+// Deleted record policies a repository can have.
+const (
+	DeletedNo         = "no"
+	DeletedTransient  = "transient"
+	DeletedPersistent = "persistent"
+)
+
+// Identity describes a repository, as returned by the Identify verb.
+type Identity struct {
+	RepositoryName    string   `xml:"repositoryName"`
+	BaseURL           string   `xml:"baseURL"`
+	ProtocolVersion   string   `xml:"protocolVersion"`
+	AdminEmails       []string `xml:"adminEmail"`
+	EarliestDatestamp string   `xml:"earliestDatestamp"`
+	DeletedRecord     string   `xml:"deletedRecord"`
+	Granularity       string   `xml:"granularity"`
+}
+
+// MetadataFormat is a metadata format a repository can disseminate.
+type MetadataFormat struct {
+	Prefix    string `xml:"metadataPrefix"`
+	Schema    string `xml:"schema"`
+	Namespace string `xml:"metadataNamespace"`
+}
+
+// Set is a set of a repository. Sets can be nested: the spec of a subset starts with that of its parent and
+// a colon.
+type Set struct {
+	Spec string `xml:"setSpec"`
+	Name string `xml:"setName"`
+}
+
+// response is a response to one of the verbs that aren't streamed.
+type response struct {
+	Error *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"error"`
+	Identify            *Identity `xml:"Identify"`
+	ListMetadataFormats *struct {
+		Formats []MetadataFormat `xml:"metadataFormat"`
+	} `xml:"ListMetadataFormats"`
+	ListSets *struct {
+		Sets  []Set  `xml:"set"`
+		Token string `xml:"resumptionToken"`
+	} `xml:"ListSets"`
+}
+
+// RequestURL returns the URL of a request to the repository at baseURL, with the given verb and arguments.
+func RequestURL(baseURL, verb string, args url.Values) string {
+	u := baseURL + querySeparator(baseURL) + "verb=" + url.QueryEscape(verb)
+	if len(args) > 0 {
+		u += "&" + args.Encode()
+	}
+	return u
+}
+
+// ResumeURL returns the URL to which the escaped resumption tokens of a list request with the given verb are
+// appended, ending in "resumptionToken=".
+func ResumeURL(baseURL, verb string) string {
+	return baseURL + querySeparator(baseURL) + "verb=" + url.QueryEscape(verb) + "&resumptionToken="
+}
+
+func querySeparator(baseURL string) string {
+	switch {
+	case !strings.Contains(baseURL, "?"):
+		return "?"
+	case strings.HasSuffix(baseURL, "?"), strings.HasSuffix(baseURL, "&"):
+		return ""
+	}
+	return "&"
+}
+
+// Identify describes the repository at baseURL.
+func (c *Client) Identify(ctx context.Context, baseURL string) (*Identity, error) {
+	var resp response
+	if err := c.get(ctx, RequestURL(baseURL, "Identify", nil), &resp); err != nil {
+		return nil, err
+	}
+	if resp.Identify == nil {
+		return nil, errors.New("oai-pmh: no Identify element in response")
+	}
+	return resp.Identify, nil
+}
+
+// ListMetadataFormats returns the metadata formats of the repository at baseURL.
+func (c *Client) ListMetadataFormats(ctx context.Context, baseURL string) ([]MetadataFormat, error) {
+	var resp response
+	if err := c.get(ctx, RequestURL(baseURL, "ListMetadataFormats", nil), &resp); err != nil {
+		return nil, err
+	}
+	if resp.ListMetadataFormats == nil {
+		return nil, errors.New("oai-pmh: no ListMetadataFormats element in response")
+	}
+	return resp.ListMetadataFormats.Formats, nil
+}
+
+// ListSets returns the sets of the repository at baseURL, following resumption tokens. A repository that
+// doesn't support sets has none.
+func (c *Client) ListSets(ctx context.Context, baseURL string) ([]Set, error) {
+	var (
+		sets []Set
+		next = RequestURL(baseURL, "ListSets", nil)
+	)
+	for page := 0; next != ""; page++ {
+		if page > 0 {
+			if err := Sleep(ctx, c.delay); err != nil {
+				return sets, err
+			}
+		}
+		var resp response
+		if err := c.get(ctx, next, &resp); err != nil {
+			if errors.Is(err, &Error{Code: CodeNoSetHierarchy}) {
+				return nil, nil
+			}
+			return sets, err
+		}
+		if resp.ListSets == nil {
+			return sets, errors.New("oai-pmh: no ListSets element in response")
+		}
+		sets = append(sets, resp.ListSets.Sets...)
+
+		next = ""
+		if token := strings.TrimSpace(resp.ListSets.Token); token != "" {
+			next = ResumeURL(baseURL, "ListSets") + url.QueryEscape(token)
+		}
+	}
+	return sets, nil
+}
+
+// get fetches a response and decodes it into v, returning the OAI-PMH error it holds, if any.
+func (c *Client) get(ctx context.Context, u string, v *response) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var opts []func(*sanitize.Reader)
+	if c.onRepair != nil {
+		opts = append(opts, sanitize.OnRepair(func(rep sanitize.Repair) {
+			c.onRepair(u, rep)
+		}))
+	}
+	dec := xml.NewDecoder(sanitize.NewReader(resp.Body, opts...))
+	dec.CharsetReader = sanitize.CharsetReader
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if v.Error != nil {
+		return &Error{Code: v.Error.Code, Message: strings.TrimSpace(v.Error.Message)}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package oaipmh
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const testIdentify = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <Identify>
+    <repositoryName>Example repository</repositoryName>
+    <baseURL>http://example.com/oai</baseURL>
+    <protocolVersion>2.0</protocolVersion>
+    <adminEmail>admin@example.com</adminEmail>
+    <adminEmail>support@example.com</adminEmail>
+    <earliestDatestamp>2005-01-01T00:00:00Z</earliestDatestamp>
+    <deletedRecord>transient</deletedRecord>
+    <granularity>YYYY-MM-DDThh:mm:ssZ</granularity>
+    <description><oai-identifier/></description>
+  </Identify>
+</OAI-PMH>`
+
+const testFormats = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <ListMetadataFormats>
+    <metadataFormat>
+      <metadataPrefix>oai_dc</metadataPrefix>
+      <schema>http://www.openarchives.org/OAI/2.0/oai_dc.xsd</schema>
+      <metadataNamespace>http://www.openarchives.org/OAI/2.0/oai_dc/</metadataNamespace>
+    </metadataFormat>
+    <metadataFormat>
+      <metadataPrefix>marcxml</metadataPrefix>
+      <schema>http://www.loc.gov/standards/marcxml/schema/MARC21slim.xsd</schema>
+      <metadataNamespace>http://www.loc.gov/MARC21/slim</metadataNamespace>
+    </metadataFormat>
+  </ListMetadataFormats>
+</OAI-PMH>`
+
+const testSets1 = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <ListSets>
+    <set><setSpec>com_1</setSpec><setName>Community 1</setName></set>
+    <resumptionToken>sets/2</resumptionToken>
+  </ListSets>
+</OAI-PMH>`
+
+const testSets2 = `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+  <ListSets>
+    <set><setSpec>com_1:col_2</setSpec><setName>Collection 2</setName></set>
+    <resumptionToken/>
+  </ListSets>
+</OAI-PMH>`
+
+func TestIdentify(t *testing.T) {
+	noSets := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("verb") == "Identify":
+			fmt.Fprint(w, testIdentify)
+		case q.Get("verb") == "ListMetadataFormats":
+			fmt.Fprint(w, testFormats)
+		case q.Get("verb") == "ListSets" && noSets:
+			fmt.Fprintf(w, testErrorPage, CodeNoSetHierarchy, "no sets")
+		case q.Get("verb") == "ListSets" && q.Get("resumptionToken") == "":
+			fmt.Fprint(w, testSets1)
+		case q.Get("verb") == "ListSets" && q.Get("resumptionToken") == "sets/2":
+			fmt.Fprint(w, testSets2)
+		default:
+			fmt.Fprintf(w, testErrorPage, CodeBadArgument, r.URL.RawQuery)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := NewClient(srv.Client(), 0)
+
+	id, err := c.Identify(ctx, srv.URL)
+	if err != nil {
+		t.Fatal("Identify:", err)
+	}
+	want := &Identity{
+		RepositoryName:    "Example repository",
+		BaseURL:           "http://example.com/oai",
+		ProtocolVersion:   "2.0",
+		AdminEmails:       []string{"admin@example.com", "support@example.com"},
+		EarliestDatestamp: "2005-01-01T00:00:00Z",
+		DeletedRecord:     DeletedTransient,
+		Granularity:       GranularitySecond,
+	}
+	if !reflect.DeepEqual(id, want) {
+		t.Errorf("wrong identity\nwant: %+v\n got: %+v", want, id)
+	}
+
+	formats, err := c.ListMetadataFormats(ctx, srv.URL)
+	if err != nil {
+		t.Fatal("ListMetadataFormats:", err)
+	}
+	if len(formats) != 2 || formats[1].Prefix != "marcxml" || formats[1].Namespace != "http://www.loc.gov/MARC21/slim" {
+		t.Errorf("wrong formats: %+v", formats)
+	}
+
+	sets, err := c.ListSets(ctx, srv.URL)
+	if err != nil {
+		t.Fatal("ListSets:", err)
+	}
+	if want := []Set{{"com_1", "Community 1"}, {"com_1:col_2", "Collection 2"}}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("wrong sets\nwant: %+v\n got: %+v", want, sets)
+	}
+
+	noSets = true
+	if sets, err := c.ListSets(ctx, srv.URL); err != nil || sets != nil {
+		t.Errorf("want no sets and no error, got: %v, %v", sets, err)
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	tests := []struct {
+		base, want string
+	}{
+		{"http://example.com/oai", "http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc&set=com_1%3Acol_2"},
+		{"http://example.com/oai?key=1", "http://example.com/oai?key=1&verb=ListRecords&metadataPrefix=oai_dc&set=com_1%3Acol_2"},
+	}
+	for _, test := range tests {
+		got := RequestURL(test.base, "ListRecords", url.Values{"metadataPrefix": {"oai_dc"}, "set": {"com_1:col_2"}})
+		if got != test.want {
+			t.Errorf("RequestURL(%q): want: %q, got: %q", test.base, test.want, got)
+		}
+	}
+	if got := ResumeURL("http://example.com/oai", "ListRecords"); got != "http://example.com/oai?verb=ListRecords&resumptionToken=" {
+		t.Errorf("wrong resume URL: %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Package oaipmh implements a streaming OAI-PMH client.
+//
+// Responses are parsed incrementally with the encoding/xml token decoder, so only the current record
+// is held in memory regardless of the size of the repository.
+//
+// See: http://www.openarchives.org/OAI/openarchivesprotocol.html
+package oaipmh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// XML namespaces used in OAI-PMH responses.
+const (
+	NamespaceOAI = "http://www.openarchives.org/OAI/2.0/"
+	NamespaceDC  = "http://purl.org/dc/elements/1.1/"
+)
+
+// Error codes defined by the OAI-PMH protocol.
+const (
+	CodeBadArgument             = "badArgument"
+	CodeBadResumptionToken      = "badResumptionToken"
+	CodeBadVerb                 = "badVerb"
+	CodeCannotDisseminateFormat = "cannotDisseminateFormat"
+	CodeIDDoesNotExist          = "idDoesNotExist"
+	CodeNoRecordsMatch          = "noRecordsMatch"
+	CodeNoMetadataFormats       = "noMetadataFormats"
+	CodeNoSetHierarchy          = "noSetHierarchy"
+)
+
+var (
+	// ErrBadResumptionToken means the repository rejected a resumption token, most likely because it expired.
+	ErrBadResumptionToken = &Error{Code: CodeBadResumptionToken}
+
+	// ErrNoRecordsMatch means the request was valid but there are no records to return,
+	// which is common for incremental harvests.
+	ErrNoRecordsMatch = &Error{Code: CodeNoRecordsMatch}
+)
+
+// Error is an error reported by an OAI-PMH repository in the error element of a response.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "oai-pmh: " + e.Code
+	}
+	return "oai-pmh: " + e.Code + ": " + e.Message
+}
+
+// Is reports whether target is an OAI-PMH error with the same code, so errors.Is can be used to test
+// for error codes, e.g. errors.Is(err, ErrNoRecordsMatch).
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// HTTPError means a request returned a non-successful status code.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("oai-pmh: %s: %s", e.URL, e.Status)
+}
+
+// Header is the header of a record.
+type Header struct {
+	Identifier string
+	Datestamp  string
+	SetSpecs   []string
+	Deleted    bool
+}
+
+// Record is a harvested record. Identifiers holds the dc:identifier values of the record's metadata; if the
+// client has a metadata parser, Metadata holds what it made of the metadata instead.
+type Record struct {
+	Header      Header
+	Identifiers []string
+	Metadata    interface{}
+}
+
+// ResumptionToken is the flow control token of an incomplete list. An empty Value marks the last page.
+type ResumptionToken struct {
+	Value            string
+	ExpirationDate   time.Time
+	CompleteListSize int
+	Cursor           int
+}
+
+// parseDatestamp parses a UTC datestamp in either day or seconds granularity.
+func parseDatestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == len("2006-01-02") {
+		return time.Parse("2006-01-02", s)
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -72,13 +72,25 @@ func NewConnectionFromApp(ctx context.Context, app string) (*pgx.Conn, error) {
 	return pgx.ConnectConfig(context.Background(), config)
 }
 
+// MinConns makes a pool hold at least n connections, more if its default size is larger.
+func MinConns(n int32) func(*pgxpool.Config) {
+	return func(c *pgxpool.Config) {
+		if c.MaxConns < n {
+			c.MaxConns = n
+		}
+	}
+}
+
 // NewPool starts a new Postgresql pool using connection parameters defined in the environment.
 // Prefer this pool function for the main database backend.
-func NewPool(ctx context.Context) (*pgxpool.Pool, error) {
+func NewPool(ctx context.Context, opts ...func(*pgxpool.Config)) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig("")
 	if err != nil {
 		return nil, err
 	}
+	for _, opt := range opts {
+		opt(config)
+	}
 	// pass pgconn struct
 	//addAppname(&config.ConnConfig.Config)
 	return pgxpool.ConnectConfig(context.Background(), config)
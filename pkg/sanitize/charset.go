@@ -0,0 +1,81 @@
+package sanitize
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1252High maps the bytes 0x80 to 0x9F of Windows-1252 to Unicode.
+// Bytes that are undefined in Windows-1252 map to the corresponding C1 control character, like Latin-1.
+var windows1252High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// windows1252 decodes a single Windows-1252 byte.
+func windows1252(b byte) rune {
+	if b >= 0x80 && b < 0xA0 {
+		return windows1252High[b-0x80]
+	}
+	return rune(b)
+}
+
+// latin1 decodes a single ISO-8859-1 byte.
+func latin1(b byte) rune {
+	return rune(b)
+}
+
+// CharsetReader converts single-byte encoded input to UTF-8. It can be used as the CharsetReader
+// of an xml.Decoder and supports ISO-8859-1 and Windows-1252.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		return &byteDecoder{r: bufio.NewReader(input), decode: latin1}, nil
+	case "windows-1252", "cp1252":
+		return &byteDecoder{r: bufio.NewReader(input), decode: windows1252}, nil
+	}
+	return nil, fmt.Errorf("sanitize: unsupported charset: %s", charset)
+}
+
+// byteDecoder converts a single-byte encoding to UTF-8.
+type byteDecoder struct {
+	r      *bufio.Reader
+	decode func(byte) rune
+	buf    [utf8.UTFMax]byte
+	pend   []byte
+}
+
+func (d *byteDecoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(d.pend) > 0 {
+			c := copy(p[n:], d.pend)
+			d.pend = d.pend[c:]
+			n += c
+			continue
+		}
+
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		r := d.decode(b)
+		if r < utf8.RuneSelf {
+			p[n] = byte(r)
+			n++
+			continue
+		}
+		size := utf8.EncodeRune(d.buf[:], r)
+		d.pend = d.buf[:size]
+	}
+	return n, nil
+}
@@ -0,0 +1,189 @@
+// Package sanitize provides a streaming reader that repairs broken XML input.
+//
+// Some repositories occasionally serve documents with stray bytes that make the whole document invalid,
+// such as a Latin-1 non-breaking space (0xA0) in an otherwise UTF-8 document, or control characters
+// that are not allowed in XML. Instead of failing a harvest over a single character, the reader
+// repairs such input on the fly and reports the byte offset of every repair.
+package sanitize
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of repairs.
+const (
+	// InvalidChar means a character that is not allowed in XML was removed.
+	InvalidChar = "invalid-char"
+	// InvalidUTF8 means a byte that is not valid UTF-8 was decoded as Windows-1252 instead.
+	InvalidUTF8 = "invalid-utf8"
+)
+
+// maxSniff is the maximum number of bytes read to find the XML declaration.
+const maxSniff = 1024
+
+// readSize is the size of reads from the underlying reader.
+const readSize = 32 * 1024
+
+var reEncoding = regexp.MustCompile(`^(?:\x{FEFF})?\s*<\?xml[^>]*?\sencoding\s*=\s*["']([A-Za-z0-9._-]+)["']`)
+
+// Repair describes a change made to the input. Offset is the position of the offending byte in the original input.
+type Repair struct {
+	Offset int64
+	Kind   string
+	Byte   byte
+}
+
+// Reader is an io.Reader that repairs XML input.
+//
+// If the document has no XML declaration or declares UTF-8, invalid UTF-8 bytes are decoded as Windows-1252
+// and characters that are not allowed in XML are removed. Documents declaring another encoding are assumed
+// to use an ASCII-compatible single-byte encoding and only have control characters removed;
+// use CharsetReader to decode them.
+type Reader struct {
+	r        io.Reader
+	onRepair func(Repair)
+
+	raw    []byte // input not yet processed
+	out    []byte // processed output not yet returned
+	offset int64  // input offset of raw[0]
+
+	sniffed bool
+	utf8    bool
+	eof     bool
+	err     error
+	repairs int
+}
+
+// NewReader returns a sanitizing reader for r.
+func NewReader(r io.Reader, opts ...func(*Reader)) *Reader {
+	sr := &Reader{
+		r:    r,
+		utf8: true,
+	}
+	for _, opt := range opts {
+		opt(sr)
+	}
+	return sr
+}
+
+// OnRepair allows passing a callback function executed for every repair made to the input.
+func OnRepair(f func(Repair)) func(*Reader) {
+	return func(sr *Reader) {
+		sr.onRepair = f
+	}
+}
+
+// Repairs returns the number of repairs made so far.
+func (sr *Reader) Repairs() int {
+	return sr.repairs
+}
+
+// Read reads repaired input into p.
+func (sr *Reader) Read(p []byte) (int, error) {
+	for len(sr.out) == 0 {
+		if sr.eof && len(sr.raw) == 0 {
+			if sr.err != nil {
+				return 0, sr.err
+			}
+			return 0, io.EOF
+		}
+		if !sr.eof {
+			sr.fill()
+		}
+		if !sr.sniffed {
+			if !sr.eof && len(sr.raw) < maxSniff && !bytes.Contains(sr.raw, []byte("?>")) {
+				continue
+			}
+			sr.sniff()
+		}
+		sr.process()
+	}
+
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk of input.
+func (sr *Reader) fill() {
+	buf := make([]byte, readSize)
+	n, err := sr.r.Read(buf)
+	sr.raw = append(sr.raw, buf[:n]...)
+	if err != nil {
+		sr.eof = true
+		if err != io.EOF {
+			sr.err = err
+		}
+	}
+}
+
+// sniff looks at the XML declaration to decide whether the input is supposed to be UTF-8.
+func (sr *Reader) sniff() {
+	sr.sniffed = true
+	m := reEncoding.FindSubmatch(sr.raw)
+	if m == nil {
+		return
+	}
+	switch strings.ToLower(string(m[1])) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+	default:
+		sr.utf8 = false
+	}
+}
+
+// process repairs as much of the raw input as possible, moving it to the output buffer.
+// Incomplete UTF-8 sequences at the end of the input are kept until more input arrives.
+func (sr *Reader) process() {
+	i := 0
+	for i < len(sr.raw) {
+		b := sr.raw[i]
+
+		if b < utf8.RuneSelf || !sr.utf8 {
+			if b < 0x20 && b != '\t' && b != '\n' && b != '\r' {
+				sr.repair(int64(i), InvalidChar, b)
+			} else {
+				sr.out = append(sr.out, b)
+			}
+			i++
+			continue
+		}
+
+		if !utf8.FullRune(sr.raw[i:]) && !sr.eof {
+			break
+		}
+
+		r, size := utf8.DecodeRune(sr.raw[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			sr.repair(int64(i), InvalidUTF8, b)
+			sr.out = append(sr.out, string(windows1252(b))...)
+		case !isXMLChar(r):
+			sr.repair(int64(i), InvalidChar, b)
+		default:
+			sr.out = append(sr.out, sr.raw[i:i+size]...)
+		}
+		i += size
+	}
+
+	sr.offset += int64(i)
+	sr.raw = append(sr.raw[:0], sr.raw[i:]...)
+}
+
+func (sr *Reader) repair(i int64, kind string, b byte) {
+	sr.repairs++
+	if sr.onRepair != nil {
+		sr.onRepair(Repair{Offset: sr.offset + i, Kind: kind, Byte: b})
+	}
+}
+
+// isXMLChar checks if a rune is in the Char production of the XML 1.0 specification.
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
@@ -0,0 +1,141 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		out     string
+		repairs []Repair
+	}{
+		{
+			name: "clean",
+			in:   "<a>hyvää päivää</a>",
+			out:  "<a>hyvää päivää</a>",
+		},
+		{
+			name:    "latin1 nbsp",
+			in:      "<a>x\xa0y</a>",
+			out:     "<a>x y</a>",
+			repairs: []Repair{{Offset: 4, Kind: InvalidUTF8, Byte: 0xa0}},
+		},
+		{
+			name:    "windows-1252 quote",
+			in:      "<a>\x93q\x94</a>",
+			out:     "<a>“q”</a>",
+			repairs: []Repair{{Offset: 3, Kind: InvalidUTF8, Byte: 0x93}, {Offset: 5, Kind: InvalidUTF8, Byte: 0x94}},
+		},
+		{
+			name:    "control characters",
+			in:      "<a>\x00b\x1b\tc\r\n</a>",
+			out:     "<a>b\tc\r\n</a>",
+			repairs: []Repair{{Offset: 3, Kind: InvalidChar, Byte: 0x00}, {Offset: 5, Kind: InvalidChar, Byte: 0x1b}},
+		},
+		{
+			name:    "non-character",
+			in:      "<a>￿b</a>",
+			out:     "<a>b</a>",
+			repairs: []Repair{{Offset: 3, Kind: InvalidChar, Byte: 0xef}},
+		},
+		{
+			name:    "truncated rune at end",
+			in:      "<a/>\xc3",
+			out:     "<a/>Ã",
+			repairs: []Repair{{Offset: 4, Kind: InvalidUTF8, Byte: 0xc3}},
+		},
+		{
+			name:    "declared latin1",
+			in:      `<?xml version="1.0" encoding="ISO-8859-1"?><a>p` + "\xe4\x01" + `iv</a>`,
+			out:     `<?xml version="1.0" encoding="ISO-8859-1"?><a>p` + "\xe4" + `iv</a>`,
+			repairs: []Repair{{Offset: 48, Kind: InvalidChar, Byte: 0x01}},
+		},
+		{
+			name:    "declared utf-8",
+			in:      `<?xml version="1.0" encoding="UTF-8"?><a>` + "\xa0" + `</a>`,
+			out:     `<?xml version="1.0" encoding="UTF-8"?><a>` + " " + `</a>`,
+			repairs: []Repair{{Offset: 41, Kind: InvalidUTF8, Byte: 0xa0}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var repairs []Repair
+			// read one byte at a time to exercise incomplete runes at buffer boundaries
+			sr := NewReader(iotest.OneByteReader(strings.NewReader(test.in)), OnRepair(func(r Repair) {
+				repairs = append(repairs, r)
+			}))
+
+			out, err := ioutil.ReadAll(sr)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(out) != test.out {
+				t.Errorf("wrong output, want: %q, got: %q", test.out, out)
+			}
+			if !reflect.DeepEqual(repairs, test.repairs) {
+				t.Errorf("wrong repairs, want: %+v, got: %+v", test.repairs, repairs)
+			}
+			if sr.Repairs() != len(test.repairs) {
+				t.Errorf("wrong repair count, want: %d, got: %d", len(test.repairs), sr.Repairs())
+			}
+		})
+	}
+}
+
+// errReader always fails with the given error.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestReaderError(t *testing.T) {
+	errBroken := io.ErrClosedPipe
+	sr := NewReader(io.MultiReader(strings.NewReader("<a>"), errReader{errBroken}))
+	if _, err := ioutil.ReadAll(sr); err != errBroken {
+		t.Errorf("want: %v, got: %v", errBroken, err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"utf-8 with stray byte", []byte("<a>Turun\xa0yliopisto</a>"), "Turun yliopisto"},
+		{"latin1", []byte(`<?xml version="1.0" encoding="ISO-8859-1"?><a>J` + "\xe4" + `rvenp` + "\xe4\xe4" + `</a>`), "Järvenpää"},
+		{"windows-1252", []byte(`<?xml version="1.0" encoding="windows-1252"?><a>` + "\x80" + `5</a>`), "€5"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dec := xml.NewDecoder(NewReader(bytes.NewReader(test.in)))
+			dec.CharsetReader = CharsetReader
+
+			var got string
+			if err := dec.Decode(&got); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+
+	if _, err := CharsetReader("ebcdic", nil); err == nil {
+		t.Error("expected error for unsupported charset, got nil")
+	}
+}
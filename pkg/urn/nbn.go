@@ -0,0 +1,61 @@
+package urn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrCheckDigit means the check digit of an NBN does not match its other digits.
+	ErrCheckDigit = errors.New("invalid check digit")
+)
+
+// nbnFinnishLibrary is the NSS prefix of NBNs assigned by the National Library of Finland.
+const nbnFinnishLibrary = "fi-fe"
+
+// weights for the check digit, applied from the rightmost digit
+var checkWeights = [3]int{7, 3, 1}
+
+// CheckDigit computes the check digit for a string of decimal digits.
+// The digits are multiplied from right to left by the repeating weights 7, 3 and 1; the check digit
+// is the difference between the sum and the next multiple of ten, like for Finnish reference numbers.
+func CheckDigit(digits string) (byte, error) {
+	if digits == "" {
+		return 0, fmt.Errorf("%w: no digits", ErrInvalid)
+	}
+
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		c := digits[i]
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: not a digit: %q", ErrInvalid, c)
+		}
+		sum += int(c-'0') * checkWeights[(len(digits)-1-i)%len(checkWeights)]
+	}
+	return byte('0' + (10-sum%10)%10), nil
+}
+
+// Validate checks namespace-specific rules. NBNs assigned by the National Library of Finland
+// (URN:NBN:fi-fe...) must consist of digits, the last of which is a check digit; see CheckDigit.
+// Other URNs are not checked beyond the syntax checks done by Parse.
+func (u *URN) Validate() error {
+	if !strings.EqualFold(u.NID, NIDNBN) || len(u.NSS) < len(nbnFinnishLibrary) ||
+		!strings.EqualFold(u.NSS[:len(nbnFinnishLibrary)], nbnFinnishLibrary) {
+		return nil
+	}
+
+	digits := u.NSS[len(nbnFinnishLibrary):]
+	if len(digits) < 2 {
+		return fmt.Errorf("%w: NBN too short", ErrInvalid)
+	}
+
+	check, err := CheckDigit(digits[:len(digits)-1])
+	if err != nil {
+		return err
+	}
+	if last := digits[len(digits)-1]; last != check {
+		return fmt.Errorf("%w: got %c, expected %c", ErrCheckDigit, last, check)
+	}
+	return nil
+}
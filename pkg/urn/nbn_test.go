@@ -0,0 +1,67 @@
+package urn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   byte
+	}{
+		// 1*7 + 2*3 + 3*1 = 16
+		{"321", '4'},
+		// 0
+		{"0", '0'},
+		// 5*7 = 35
+		{"5", '5'},
+		// 2*7 + 1*3 + 0 + 1*7 + 1*3 + 0 + 0 + 1*3 + 0 + 2*7 + 0 + 2*1 = 46
+		{"202010011012", '4'},
+	}
+
+	for _, test := range tests {
+		got, err := CheckDigit(test.digits)
+		if err != nil {
+			t.Errorf("CheckDigit(%q): unexpected error: %v", test.digits, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("CheckDigit(%q): want: %c, got: %c", test.digits, test.want, got)
+		}
+	}
+
+	for _, bad := range []string{"", "12a3"} {
+		if _, err := CheckDigit(bad); !errors.Is(err, ErrInvalid) {
+			t.Errorf("CheckDigit(%q): want: %v, got: %v", bad, ErrInvalid, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		urn  string
+		want error
+	}{
+		{"URN:NBN:fi-fe3214", nil},
+		{"urn:nbn:FI-FE2020100110124", nil},
+		{"URN:NBN:fi-fe3215", ErrCheckDigit},
+		{"URN:NBN:fi-fe2020100110120", ErrCheckDigit},
+		{"URN:NBN:fi-fe4", ErrInvalid},
+		{"URN:NBN:fi-fe32x4", ErrInvalid},
+		// not assigned by the National Library, no check digit
+		{"URN:NBN:fi:jyu-201906283438", nil},
+		{"URN:NBN:fi-fi3215", nil},
+		{"URN:ISBN:fi-fe3215", nil},
+	}
+
+	for _, test := range tests {
+		u, err := Parse(test.urn)
+		if err != nil {
+			t.Fatalf("Parse(%q): unexpected error: %v", test.urn, err)
+		}
+		if err := u.Validate(); !errors.Is(err, test.want) {
+			t.Errorf("Validate(%q): want: %v, got: %v", test.urn, test.want, err)
+		}
+	}
+}
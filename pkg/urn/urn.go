@@ -0,0 +1,275 @@
+// Package urn parses and normalises Uniform Resource Names as defined in RFC 8141,
+// with additional rules for National Bibliography Numbers (RFC 8458).
+//
+// See: https://tools.ietf.org/html/rfc8141
+package urn
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrInvalid means a string is not a syntactically valid URN.
+	ErrInvalid = errors.New("invalid URN")
+)
+
+const (
+	prefix = "urn:"
+
+	// NID of National Bibliography Numbers.
+	NIDNBN = "nbn"
+)
+
+// URN is a parsed URN: the namespace identifier, the namespace specific string,
+// and the optional r-, q- and f-components without their leading "?+", "?=" and "#".
+type URN struct {
+	NID        string
+	NSS        string
+	RComponent string
+	QComponent string
+	FComponent string
+}
+
+// Parse parses a URN of the form urn:<NID>:<NSS>[?+<r-component>][?=<q-component>][#<f-component>].
+// The returned URN is not normalised; see Normalise.
+func Parse(s string) (*URN, error) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return nil, fmt.Errorf("%w: missing urn: prefix", ErrInvalid)
+	}
+	s = s[len(prefix):]
+
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: missing namespace specific string", ErrInvalid)
+	}
+
+	u := &URN{NID: s[:i]}
+	if !validNID(u.NID) {
+		return nil, fmt.Errorf("%w: invalid namespace identifier %q", ErrInvalid, u.NID)
+	}
+	s = s[i+1:]
+
+	// split off the f-component first; it may contain anything the other components can
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		u.FComponent, s = s[i+1:], s[:i]
+		if !validComponent(u.FComponent) {
+			return nil, fmt.Errorf("%w: invalid f-component", ErrInvalid)
+		}
+	}
+
+	if i := strings.Index(s, "?="); i >= 0 {
+		u.QComponent, s = s[i+2:], s[:i]
+		if u.QComponent == "" || !validComponent(u.QComponent) {
+			return nil, fmt.Errorf("%w: invalid q-component", ErrInvalid)
+		}
+	}
+
+	if i := strings.Index(s, "?+"); i >= 0 {
+		u.RComponent, s = s[i+2:], s[:i]
+		if u.RComponent == "" || !validComponent(u.RComponent) {
+			return nil, fmt.Errorf("%w: invalid r-component", ErrInvalid)
+		}
+	}
+
+	u.NSS = s
+	if !validNSS(u.NSS) {
+		return nil, fmt.Errorf("%w: invalid namespace specific string %q", ErrInvalid, u.NSS)
+	}
+	return u, nil
+}
+
+// Name returns the assigned name of a URN, urn:<NID>:<NSS>, without any components.
+func (u *URN) Name() string {
+	return prefix + u.NID + ":" + u.NSS
+}
+
+// String returns the full URN, including components.
+func (u *URN) String() string {
+	s := u.Name()
+	if u.RComponent != "" {
+		s += "?+" + u.RComponent
+	}
+	if u.QComponent != "" {
+		s += "?=" + u.QComponent
+	}
+	if u.FComponent != "" {
+		s += "#" + u.FComponent
+	}
+	return s
+}
+
+// Normalise returns a copy of the URN in the normal form used for lexical equivalence:
+// the NID is lowercased and the hexadecimal digits of percent-encoded characters are uppercased.
+// For NBNs, the country code or ISIL prefix of the NSS is lowercased as well; the NSS of
+// Finnish NBNs (URN:NBN:fi) is case-insensitive as a whole and is lowercased entirely.
+// Components are kept as they are.
+func (u *URN) Normalise() *URN {
+	n := *u
+	n.NID = strings.ToLower(u.NID)
+	n.NSS = normalisePercent(u.NSS)
+
+	if n.NID == NIDNBN {
+		n.NSS = normaliseNBN(n.NSS)
+	}
+	return &n
+}
+
+// Resolve returns the URL a request for this URN should be redirected to, given the URL its name maps to.
+// As described in RFC 8141 section 2.3, the q-component is passed on to the resource: its parameters are added
+// to the query of the target URL. The f-component is a fragment for the client and replaces the fragment of
+// the target URL. The r-component is meant for the resolver itself and is not passed on.
+func (u *URN) Resolve(target string) (string, error) {
+	t, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if u.QComponent != "" {
+		if t.RawQuery == "" {
+			t.RawQuery = u.QComponent
+		} else {
+			t.RawQuery += "&" + u.QComponent
+		}
+	}
+	if u.FComponent != "" {
+		frag, err := url.PathUnescape(u.FComponent)
+		if err != nil {
+			return "", err
+		}
+		t.Fragment = frag
+	}
+	return t.String(), nil
+}
+
+// IsNBN checks if the URN is a National Bibliography Number of the given country, e.g. "fi".
+// Comparison is case-insensitive.
+func (u *URN) IsNBN(country string) bool {
+	if !strings.EqualFold(u.NID, NIDNBN) {
+		return false
+	}
+	p := nbnPrefix(u.NSS)
+	return strings.EqualFold(p, country)
+}
+
+// Normalise parses a URN and returns the normal form of its assigned name, without components.
+func Normalise(s string) (string, error) {
+	u, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return u.Normalise().Name(), nil
+}
+
+// Equal checks if two URNs are lexically equivalent. Components are not taken into account.
+// Invalid URNs are never equal to anything.
+func Equal(a, b string) bool {
+	na, err := Normalise(a)
+	if err != nil {
+		return false
+	}
+	nb, err := Normalise(b)
+	if err != nil {
+		return false
+	}
+	return na == nb
+}
+
+// normaliseNBN lowercases the prefix of an NBN, or all of it for Finnish NBNs.
+func normaliseNBN(nss string) string {
+	p := nbnPrefix(nss)
+	if strings.EqualFold(p, "fi") {
+		return strings.ToLower(nss)
+	}
+	return strings.ToLower(p) + nss[len(p):]
+}
+
+// nbnPrefix returns the country code or ISIL prefix of an NBN, which ends at the first ':' or '-'.
+func nbnPrefix(nss string) string {
+	if i := strings.IndexAny(nss, ":-"); i >= 0 {
+		return nss[:i]
+	}
+	return nss
+}
+
+// normalisePercent uppercases the hexadecimal digits of percent-encoded octets.
+func normalisePercent(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := []byte(s)
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] == '%' {
+			b[i+1] = upperHex(b[i+1])
+			b[i+2] = upperHex(b[i+2])
+			i += 2
+		}
+	}
+	return string(b)
+}
+
+func upperHex(c byte) byte {
+	if c >= 'a' && c <= 'f' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// validNID checks the NID production: 2 to 32 letters, digits and hyphens, not starting or ending with a hyphen.
+func validNID(nid string) bool {
+	if len(nid) < 2 || len(nid) > 32 || nid[0] == '-' || nid[len(nid)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(nid); i++ {
+		if !isAlnum(nid[i]) && nid[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validNSS checks the NSS production: pchar *(pchar / "/").
+func validNSS(nss string) bool {
+	if nss == "" || nss[0] == '/' {
+		return false
+	}
+	return validChars(nss, "/")
+}
+
+// validComponent checks the r-, q- and f-component productions: pchar *(pchar / "/" / "?").
+func validComponent(c string) bool {
+	return validChars(c, "/?")
+}
+
+// validChars checks that a string consists of pchars, valid percent-encodings and the extra characters.
+func validChars(s, extra string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return false
+			}
+			i += 2
+		case isPchar(c), strings.IndexByte(extra, c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isPchar checks for unreserved, sub-delims, ":" and "@" characters as defined in RFC 3986.
+func isPchar(c byte) bool {
+	return isAlnum(c) || strings.IndexByte("-._~!$&'()*+,;=:@", c) >= 0
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
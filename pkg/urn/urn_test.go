@@ -0,0 +1,180 @@
+package urn
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *URN
+	}{
+		{"urn:nbn:fi-fe2020100112345", &URN{NID: "nbn", NSS: "fi-fe2020100112345"}},
+		{"URN:NBN:fi:jyu-201906283438", &URN{NID: "NBN", NSS: "fi:jyu-201906283438"}},
+		{"urn:isbn:978-951-0-00000-0", &URN{NID: "isbn", NSS: "978-951-0-00000-0"}},
+		{"urn:example:a/b%2Fc", &URN{NID: "example", NSS: "a/b%2Fc"}},
+		{"urn:example:foo?+res?=q=1&x=2#frag", &URN{NID: "example", NSS: "foo", RComponent: "res", QComponent: "q=1&x=2", FComponent: "frag"}},
+		{"urn:example:foo?=a?+b", &URN{NID: "example", NSS: "foo", QComponent: "a?+b"}},
+		{"urn:example:foo#", &URN{NID: "example", NSS: "foo"}},
+		{"urn:urn-7:foo", &URN{NID: "urn-7", NSS: "foo"}},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.in)
+		if err != nil {
+			t.Errorf("Parse(%q): unexpected error: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q): want: %+v, got: %+v", test.in, test.want, got)
+		}
+		// the "urn:" prefix is always written in lowercase, and empty components are dropped
+		if got.String()[4:] != test.in[4:] && test.in != "urn:example:foo#" {
+			t.Errorf("String(): want: %q, got: %q", test.in, got.String())
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"urn",
+		"http://example.com/",
+		"urn:nbn",
+		"urn:n:foo",
+		"urn:-nbn:foo",
+		"urn:nbn-:foo",
+		"urn:abcdefghijklmnopqrstuvwxyz0123456:foo",
+		"urn:nb_n:foo",
+		"urn:nbn:",
+		"urn:nbn:/foo",
+		"urn:nbn:fi fe123",
+		"urn:nbn:foo?bar",
+		"urn:nbn:foo%2",
+		"urn:nbn:foo%zz",
+		"urn:nbn:foo?+",
+		"urn:nbn:foo?=",
+		"urn:nbn:foo#bar baz",
+		"urn:nbn:ääkkönen",
+	}
+
+	for _, test := range tests {
+		if u, err := Parse(test); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q): want error: %v, got: %+v, %v", test, ErrInvalid, u, err)
+		}
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"urn:nbn:fi-fe2020100112345", "urn:nbn:fi-fe2020100112345"},
+		{"URN:NBN:fi-fe2020100112345", "urn:nbn:fi-fe2020100112345"},
+		{"URN:NBN:FI-FE2020100112345", "urn:nbn:fi-fe2020100112345"},
+		{"urn:nbn:FI:JYU-201906283438", "urn:nbn:fi:jyu-201906283438"},
+		{"URN:NBN:SE:KB:ABC", "urn:nbn:se:KB:ABC"},
+		{"URN:NBN:de-101-ABC", "urn:nbn:de-101-ABC"},
+		{"URN:ISBN:978-951-0-00000-X", "urn:isbn:978-951-0-00000-X"},
+		{"urn:Example:a%2fb%c3%a4", "urn:example:a%2Fb%C3%A4"},
+		{"urn:nbn:fi-fe1?+r?=q#f", "urn:nbn:fi-fe1"},
+	}
+
+	for _, test := range tests {
+		got, err := Normalise(test.in)
+		if err != nil {
+			t.Errorf("Normalise(%q): unexpected error: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Normalise(%q): want: %q, got: %q", test.in, test.want, got)
+		}
+	}
+
+	if _, err := Normalise("urn:nbn"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("want: %v, got: %v", ErrInvalid, err)
+	}
+
+	u := &URN{NID: "NBN", NSS: "FI-FE1", RComponent: "R", QComponent: "Q", FComponent: "F"}
+	if got := u.Normalise().String(); got != "urn:nbn:fi-fe1?+R?=Q#F" {
+		t.Errorf("components changed by normalisation: %q", got)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"urn:nbn:fi-fe1", "URN:NBN:FI-FE1", true},
+		{"urn:nbn:fi-fe1", "urn:nbn:fi-fe1?=foo#bar", true},
+		{"urn:example:a%2f", "URN:EXAMPLE:a%2F", true},
+		{"urn:example:abc", "urn:example:ABC", false},
+		{"urn:nbn:se:kb:abc", "urn:nbn:SE:kb:abc", true},
+		{"urn:nbn:se:kb:abc", "urn:nbn:se:KB:abc", false},
+		{"urn:nbn:fi-fe1", "urn:nbn:fi-fe2", false},
+		{"urn:nbn", "urn:nbn", false},
+	}
+
+	for _, test := range tests {
+		if got := Equal(test.a, test.b); got != test.equal {
+			t.Errorf("Equal(%q, %q): want: %t, got: %t", test.a, test.b, test.equal, got)
+		}
+	}
+}
+
+func TestIsNBN(t *testing.T) {
+	tests := []struct {
+		urn     string
+		country string
+		want    bool
+	}{
+		{"URN:NBN:fi-fe1", "fi", true},
+		{"urn:nbn:FI:jyu-1", "fi", true},
+		{"urn:nbn:se:kb:1", "fi", false},
+		{"urn:nbn:fin-1", "fi", false},
+		{"urn:isbn:fi-1", "fi", false},
+	}
+
+	for _, test := range tests {
+		u, err := Parse(test.urn)
+		if err != nil {
+			t.Fatalf("Parse(%q): unexpected error: %v", test.urn, err)
+		}
+		if got := u.IsNBN(test.country); got != test.want {
+			t.Errorf("IsNBN(%q, %q): want: %t, got: %t", test.urn, test.country, test.want, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		urn    string
+		target string
+		want   string
+	}{
+		{"urn:nbn:fi-fe1", "http://example.com/handle/1", "http://example.com/handle/1"},
+		{"urn:nbn:fi-fe1?+resolver=x", "http://example.com/handle/1", "http://example.com/handle/1"},
+		{"urn:nbn:fi-fe1?=lang=fi", "http://example.com/handle/1", "http://example.com/handle/1?lang=fi"},
+		{"urn:nbn:fi-fe1?=lang=fi&page=2", "http://example.com/view?id=1", "http://example.com/view?id=1&lang=fi&page=2"},
+		{"urn:nbn:fi-fe1#chapter2", "http://example.com/handle/1#top", "http://example.com/handle/1#chapter2"},
+		{"urn:nbn:fi-fe1?+r?=q=1#f%20g", "http://example.com/handle/1", "http://example.com/handle/1?q=1#f%20g"},
+	}
+
+	for _, test := range tests {
+		u, err := Parse(test.urn)
+		if err != nil {
+			t.Fatalf("Parse(%q): unexpected error: %v", test.urn, err)
+		}
+		got, err := u.Resolve(test.target)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q): unexpected error: %v", test.urn, test.target, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Resolve(%q, %q): want: %q, got: %q", test.urn, test.target, test.want, got)
+		}
+	}
+}
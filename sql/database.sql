@@ -1,5 +1,6 @@
-CREATE TYPE source_format AS ENUM ('OAI-PMH', 'Swedish', 'Oulu');
+CREATE TYPE source_format AS ENUM ('OAI-PMH', 'Swedish', 'Oulu', 'MARC', 'CSV', 'TSV', 'JSONL');
 CREATE TYPE url_type AS ENUM ('normal', 'vapaakappale');
+CREATE TYPE harvest_status AS ENUM ('success', 'failed', 'needs_approval');
 
 CREATE TABLE source (
        source_id        integer GENERATED ALWAYS AS IDENTITY UNIQUE,
@@ -11,17 +12,41 @@ CREATE TABLE source (
        email            text,
        description      text,
        source_type      url_type,
-       url_pattern	text
+       url_pattern	text,
+       rules            jsonb,
+       withdraw_after   integer NOT NULL DEFAULT 3,
+       max_changes      integer DEFAULT 100,
+       max_changes_percent real DEFAULT 10,
+       review_required  boolean NOT NULL DEFAULT false,
+       last_successful_run_start timestamp with time zone,
+       oai_sets         text[],
+       metadata_prefix  text,
+       column_map       jsonb
 );
 
+COMMENT ON COLUMN source.rules IS 'Harvester quirks: URL rewrite and preference rules, URNs to exclude; see doc/harvester.md';
+COMMENT ON COLUMN source.withdraw_after IS 'Number of consecutive full harvests a URN may be missing before its mapping is withdrawn; 0 disables withdrawal';
+COMMENT ON COLUMN source.max_changes IS 'Anomaly threshold: a run that changes or withdraws more mappings than this or than max_changes_percent allows is held for approval; 0 or NULL is no limit';
+COMMENT ON COLUMN source.max_changes_percent IS 'Anomaly threshold as a percentage of the existing mappings of the source';
+COMMENT ON COLUMN source.review_required IS 'Probation: changes of every run are held for approval';
+COMMENT ON COLUMN source.last_successful_run_start IS 'Start of the last successful harvest run; incremental harvests ask for changes since then';
+COMMENT ON COLUMN source.oai_sets IS 'OAI-PMH sets to harvest, each as its own list; NULL harvests the whole repository';
+COMMENT ON COLUMN source.metadata_prefix IS 'OAI-PMH metadata prefix to harvest, overriding the one in start_url';
+COMMENT ON COLUMN source.column_map IS 'Columns of CSV and TSV sources, or fields of JSONL sources, holding the URN, URL, URL type and r-component; see doc/harvester.md';
+
 CREATE TABLE urn2url (
        urn           text NOT NULL,
        url           text NOT NULL,
        source_id     INTEGER REFERENCES source(source_id),
        url_type      url_type,
-       r_component   text
+       r_component   text,
+       oai_identifier text,
+       missing_runs  integer NOT NULL DEFAULT 0,
+       withdrawn     timestamp with time zone
 );
 
+CREATE INDEX urn2url_source_idx ON urn2url (source_id, oai_identifier);
+
 CREATE TABLE urnhistory (
        urn              text NOT NULL,
        r_component      text,
@@ -30,5 +55,68 @@ CREATE TABLE urnhistory (
        url_type_old     url_type,
        url_type_new     url_type,
        harvest_time     timestamp with time zone,
-       source_url       text NOT NULL
+       source_url       text NOT NULL,
+       approved_by      text,
+       -- id of the raw response in the harvester's archive, if it keeps one
+       archive_page     text
+);
+
+CREATE TABLE harvest_run (
+       run_id           bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+       source_id        integer NOT NULL REFERENCES source(source_id),
+       start_time       timestamp with time zone NOT NULL,
+       end_time         timestamp with time zone,
+       full_harvest     boolean NOT NULL,
+       status           harvest_status NOT NULL,
+       records          integer NOT NULL DEFAULT 0,
+       warnings         integer NOT NULL DEFAULT 0,
+       rejected         integer NOT NULL DEFAULT 0,
+       withdrawn        integer NOT NULL DEFAULT 0,
+       retries          integer NOT NULL DEFAULT 0,
+       error            text,
+       resumed_from     bigint REFERENCES harvest_run(run_id)
+);
+
+CREATE INDEX harvest_run_source_idx ON harvest_run (source_id, start_time);
+
+CREATE TABLE harvest_checkpoint (
+       source_id        integer PRIMARY KEY REFERENCES source(source_id),
+       run_id           bigint REFERENCES harvest_run(run_id),
+       started          timestamp with time zone NOT NULL,
+       since            timestamp with time zone,
+       page             integer NOT NULL,
+       oai_set          text,
+       token            text NOT NULL,
+       expires          timestamp with time zone,
+       updated          timestamp with time zone NOT NULL,
+       state            jsonb
+);
+
+COMMENT ON TABLE harvest_checkpoint IS 'Position of the current or last failed OAI-PMH harvest of a source; state holds the counters of what the run harvested before the page the token requests';
+
+CREATE TABLE harvest_checkpoint_page (
+       source_id        integer NOT NULL,
+       page             integer NOT NULL,
+       state            jsonb NOT NULL,
+       PRIMARY KEY (source_id, page)
+);
+
+COMMENT ON TABLE harvest_checkpoint_page IS 'What the checkpointed harvest of a source harvested from the start of a page to its next checkpoint';
+
+CREATE TYPE change_set_status AS ENUM ('pending', 'approved', 'rejected', 'superseded');
+
+CREATE TABLE change_set (
+       run_id           bigint PRIMARY KEY REFERENCES harvest_run(run_id),
+       source_id        integer NOT NULL REFERENCES source(source_id),
+       created          timestamp with time zone NOT NULL,
+       reason           text NOT NULL,
+       changes          jsonb NOT NULL,
+       ops              jsonb NOT NULL,
+       status           change_set_status NOT NULL DEFAULT 'pending',
+       resolved         timestamp with time zone,
+       resolved_by      text
 );
+
+CREATE INDEX change_set_source_idx ON change_set (source_id, status);
+
+COMMENT ON TABLE change_set IS 'Changes of harvest runs held for approval, because of the anomaly guard or because the source requires review; ops are the writes to replay on approval';